@@ -2,38 +2,42 @@ package client
 
 import (
 	"context"
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/warnshun/pcbook/pb"
 	"google.golang.org/grpc"
 )
 
-// AuthClient is a client to call authentication RPC
+// ErrNotLoggedIn error
+var ErrNotLoggedIn = errors.New("not logged in")
+
+// AuthClient is a client to call authentication RPC,
+// it keeps the refresh token of the login to get new access tokens
 type AuthClient struct {
-	service  pb.AuthServiceClient
-	username string
-	password string
+	service      pb.AuthServiceClient
+	mutex        sync.Mutex
+	refreshToken string
 }
 
 // NewAuthClient creates a new auth client
-func NewAuthClient(cc *grpc.ClientConn, username string, password string) *AuthClient {
+func NewAuthClient(cc *grpc.ClientConn) *AuthClient {
 	service := pb.NewAuthServiceClient(cc)
 
 	return &AuthClient{
-		service:  service,
-		username: username,
-		password: password,
+		service: service,
 	}
 }
 
 // Login login user and return a token
-func (client *AuthClient) Login() (string, error) {
+func (client *AuthClient) Login(username string, password string) (string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	req := &pb.LoginRequest{
-		Username: client.username,
-		Password: client.password,
+		Username: username,
+		Password: password,
 	}
 
 	res, err := client.service.Login(ctx, req)
@@ -41,5 +45,62 @@ func (client *AuthClient) Login() (string, error) {
 		return "", err
 	}
 
-	return res.AccessToken, nil
+	client.mutex.Lock()
+	client.refreshToken = res.GetRefreshToken()
+	client.mutex.Unlock()
+
+	return res.GetAccessToken(), nil
+}
+
+// RefreshToken gets a new access token with the refresh token of the login,
+// and keeps the refresh token replacing it
+func (client *AuthClient) RefreshToken() (string, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.refreshToken == "" {
+		return "", ErrNotLoggedIn
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &pb.RefreshTokenRequest{
+		RefreshToken: client.refreshToken,
+	}
+
+	res, err := client.service.RefreshToken(ctx, req)
+	if err != nil {
+		return "", err
+	}
+
+	client.refreshToken = res.GetRefreshToken()
+
+	return res.GetAccessToken(), nil
+}
+
+// Logout revokes the refresh token of the login
+func (client *AuthClient) Logout() error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.refreshToken == "" {
+		return ErrNotLoggedIn
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &pb.LogoutRequest{
+		RefreshToken: client.refreshToken,
+	}
+
+	_, err := client.service.Logout(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	client.refreshToken = ""
+
+	return nil
 }
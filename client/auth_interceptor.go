@@ -2,37 +2,42 @@ package client
 
 import (
 	"context"
+	"errors"
 	"log"
+	"sync"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 // AuthInterceptor is a client interceptor for authentication and authorization
 type AuthInterceptor struct {
 	authClient  *AuthClient
 	authMethods map[string]bool
+	mutex       sync.RWMutex
 	accessToken string
 }
 
-// NewAuthInterceptor creates a new auth interceptor
+// NewAuthInterceptor creates a new auth interceptor with the access token of a login of authClient,
+// the access token is refreshed with the refresh token of the login every refreshDuration
 func NewAuthInterceptor(
 	authClient *AuthClient,
 	authMethods map[string]bool,
+	accessToken string,
 	refreshDuration time.Duration,
-) (*AuthInterceptor, error) {
+) *AuthInterceptor {
 	interceptor := &AuthInterceptor{
 		authClient:  authClient,
 		authMethods: authMethods,
+		accessToken: accessToken,
 	}
 
-	err := interceptor.scheduleRefreshToken(refreshDuration)
-	if err != nil {
-		return nil, err
-	}
+	go interceptor.updateTokenPeriodically(refreshDuration)
 
-	return interceptor, nil
+	return interceptor
 }
 
 // Unary returns a client interceptor function to authenticate and authorize unary RPC
@@ -75,24 +80,15 @@ func (interceptor *AuthInterceptor) Stream() grpc.StreamClientInterceptor {
 	}
 }
 
-func (interceptor *AuthInterceptor) scheduleRefreshToken(refreshDuration time.Duration) error {
-	err := interceptor.refreshToken()
-	if err != nil {
-		return err
-	}
-
-	go interceptor.updateTokenPeriodically(refreshDuration)
-
-	return nil
-}
-
 func (interceptor *AuthInterceptor) refreshToken() error {
-	accessToken, err := interceptor.authClient.Login()
+	accessToken, err := interceptor.authClient.RefreshToken()
 	if err != nil {
 		return err
 	}
 
+	interceptor.mutex.Lock()
 	interceptor.accessToken = accessToken
+	interceptor.mutex.Unlock()
 	log.Printf("Access token has been refreshed: %v", accessToken)
 
 	return nil
@@ -103,7 +99,14 @@ func (interceptor *AuthInterceptor) updateTokenPeriodically(refreshDuration time
 	for {
 		time.Sleep(wait)
 		err := interceptor.refreshToken()
+		if errors.Is(err, ErrNotLoggedIn) || status.Code(err) == codes.Unauthenticated {
+			// the login is over, a new one is needed
+			log.Printf("Stop refreshing access token: %v", err)
+			return
+		}
 		if err != nil {
+			// the refresh token is kept when the response is lost, the server accepts it again
+			// shortly after its rotation as long as the token replacing it is unused
 			log.Printf("Cannot refresh access token: %v", err)
 			wait = time.Second
 			continue
@@ -121,5 +124,8 @@ func (interceptor *AuthInterceptor) updateTokenPeriodically(refreshDuration time
 }
 
 func (interceptor *AuthInterceptor) attachToken(ctx context.Context) context.Context {
+	interceptor.mutex.RLock()
+	defer interceptor.mutex.RUnlock()
+
 	return metadata.AppendToOutgoingContext(ctx, "authorization", interceptor.accessToken)
 }
@@ -3,6 +3,7 @@ package client
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"log"
@@ -14,6 +15,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 )
 
 // LaptopClient is a client to call laptop RPC services
@@ -58,17 +60,95 @@ func (client *LaptopClient) CreateLaptop(laptop *pb.Laptop) {
 	log.Printf("Created laptop with id: %s", res.Id)
 }
 
+// GetLaptop gets a laptop by ID
+func (client *LaptopClient) GetLaptop(laptopId string) (*pb.GetLaptopResponse, error) {
+	req := &pb.GetLaptopRequest{
+		Id: laptopId,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := client.service.GetLaptop(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get laptop: %w", err)
+	}
+
+	log.Printf("Got laptop with id: %s, rated %d times with average %.2f, images: %v",
+		res.GetLaptop().GetId(), res.GetRatedCount(), res.GetAverageScore(), res.GetImageIds())
+
+	return res, nil
+}
+
+// UpdateLaptop updates the fields of an existing laptop listed in paths, or all of them if paths is empty
+func (client *LaptopClient) UpdateLaptop(laptop *pb.Laptop, paths ...string) {
+	req := &pb.UpdateLaptopRequest{
+		Laptop:     laptop,
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: paths},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := client.service.UpdateLaptop(ctx, req)
+	if err != nil {
+		st, ok := status.FromError(err)
+		if ok && st.Code() == codes.NotFound {
+			log.Print("laptop not found")
+		} else {
+			log.Fatal("cannot update laptop:", err)
+		}
+		return
+	}
+
+	log.Printf("Updated laptop with id: %s", res.GetLaptop().GetId())
+}
+
+// DeleteLaptop deletes a laptop
+func (client *LaptopClient) DeleteLaptop(laptopId string) {
+	req := &pb.DeleteLaptopRequest{
+		Id: laptopId,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := client.service.DeleteLaptop(ctx, req)
+	if err != nil {
+		st, ok := status.FromError(err)
+		if ok && st.Code() == codes.NotFound {
+			log.Print("laptop not found")
+		} else {
+			log.Fatal("cannot delete laptop:", err)
+		}
+		return
+	}
+
+	log.Printf("Deleted laptop with id: %s", res.GetId())
+}
+
 // SearchLaptop searches for laptops
 func (client *LaptopClient) SearchLaptop(filter *pb.Filter) {
 	log.Print("searching filter: ", filter)
 
+	client.searchLaptop(&pb.SearchLaptopRequest{
+		Filter: filter,
+	})
+}
+
+// SearchLaptopByQuery searches for laptops with a free-text query
+func (client *LaptopClient) SearchLaptopByQuery(query string) {
+	log.Printf("searching query: %q", query)
+
+	client.searchLaptop(&pb.SearchLaptopRequest{
+		Query: query,
+	})
+}
+
+func (client *LaptopClient) searchLaptop(req *pb.SearchLaptopRequest) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	req := &pb.SearchLaptopRequest{
-		Filter: filter,
-	}
-
 	stream, err := client.service.SearchLaptop(ctx, req)
 	if err != nil {
 		log.Fatal("cannot search laptop:", err)
@@ -84,6 +164,11 @@ func (client *LaptopClient) SearchLaptop(filter *pb.Filter) {
 			log.Fatal("cannot receive stream:", err)
 		}
 
+		if res.GetNextPageToken() != "" {
+			log.Print("more laptops on the next page: ", res.GetNextPageToken())
+			return
+		}
+
 		laptop := res.GetLaptop()
 		log.Print("- found: ", laptop.GetId())
 		log.Print("  + brand: ", laptop.GetBrand())
@@ -95,6 +180,34 @@ func (client *LaptopClient) SearchLaptop(filter *pb.Filter) {
 	}
 }
 
+// WatchLaptops logs the changes of the laptops matching the filter until the stream ends
+func (client *LaptopClient) WatchLaptops(filter *pb.Filter, replay bool) error {
+	log.Print("watching filter: ", filter)
+
+	req := &pb.WatchLaptopsRequest{
+		Filter: filter,
+		Replay: replay,
+	}
+
+	stream, err := client.service.WatchLaptops(context.Background(), req)
+	if err != nil {
+		return fmt.Errorf("cannot watch laptops: %w", err)
+	}
+
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("cannot receive laptop event: %w", err)
+		}
+
+		laptop := res.GetLaptop()
+		log.Printf("- %v: %s %s %s, price: %.2f", res.GetType(), laptop.GetId(), laptop.GetBrand(), laptop.GetName(), laptop.GetPrice())
+	}
+}
+
 // UploadImage uploads an image to the laptop service
 func (client *LaptopClient) UploadImage(laptopId string, imagePath string) {
 	file, err := os.Open(imagePath)
@@ -157,6 +270,249 @@ func (client *LaptopClient) UploadImage(laptopId string, imagePath string) {
 	log.Printf("image uploaded with id: %s, size: %d", res.GetId(), res.GetSize())
 }
 
+// UploadImageResumable uploads an image through a resumable upload,
+// resuming it from the offset received by the server when the connection drops
+func (client *LaptopClient) UploadImageResumable(laptopId string, imagePath string) (string, error) {
+	imageData, err := os.ReadFile(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("cannot read image file: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	startRes, err := client.service.StartUpload(ctx, &pb.StartUploadRequest{LaptopId: laptopId})
+	if err != nil {
+		return "", fmt.Errorf("cannot start upload: %w", err)
+	}
+
+	uploadId := startRes.GetUploadId()
+	checksum := sha256.Sum256(imageData)
+
+	var res *pb.UploadImageResponse
+	for attempt := 1; ; attempt++ {
+		res, err = client.continueUpload(uploadId, imageData, checksum[:])
+		if err == nil || attempt == maxUploadAttempts || !isRetryable(err) {
+			break
+		}
+
+		log.Printf("upload %s interrupted, attempt %d: %v", uploadId, attempt, err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+	if err != nil {
+		return "", fmt.Errorf("cannot upload image: %w", err)
+	}
+
+	log.Printf("image uploaded with id: %s, size: %d", res.GetId(), res.GetSize())
+
+	return res.GetId(), nil
+}
+
+const maxUploadAttempts = 5
+
+// continueUpload sends the image data from the offset received by the server, then commits the upload
+func (client *LaptopClient) continueUpload(uploadId string, imageData []byte, checksum []byte) (*pb.UploadImageResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	statusRes, err := client.service.GetUploadStatus(ctx, &pb.GetUploadStatusRequest{UploadId: uploadId})
+	if err != nil {
+		return nil, err
+	}
+
+	offset := statusRes.GetOffset()
+	if offset > uint64(len(imageData)) {
+		return nil, fmt.Errorf("server received %d bytes of a %d bytes image", offset, len(imageData))
+	}
+
+	stream, err := client.service.UploadImage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// the error of a failed send is returned by CloseAndRecv
+	err = stream.Send(&pb.UploadImageRequest{
+		Data: &pb.UploadImageRequest_UploadId{UploadId: uploadId},
+	})
+	if err != nil {
+		return stream.CloseAndRecv()
+	}
+
+	for offset < uint64(len(imageData)) {
+		end := min(offset+1024, uint64(len(imageData)))
+
+		req := &pb.UploadImageRequest{
+			Data: &pb.UploadImageRequest_Chunk{
+				Chunk: &pb.UploadChunk{
+					Offset: offset,
+					Data:   imageData[offset:end],
+				},
+			},
+		}
+
+		err = stream.Send(req)
+		if err != nil {
+			return stream.CloseAndRecv()
+		}
+
+		offset = end
+	}
+
+	// a failed send ends the stream, whose error is returned by CloseAndRecv
+	_ = stream.Send(&pb.UploadImageRequest{
+		Data: &pb.UploadImageRequest_Commit{
+			Commit: &pb.UploadCommit{Sha256: checksum},
+		},
+	})
+
+	return stream.CloseAndRecv()
+}
+
+// isRetryable returns true if the error may be caused by a dropped connection
+func isRetryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+// ListImages lists the images of a laptop in display order
+func (client *LaptopClient) ListImages(laptopId string) ([]*pb.ImageMetadata, error) {
+	req := &pb.ListImagesRequest{
+		LaptopId: laptopId,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := client.service.ListImages(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list images: %w", err)
+	}
+
+	log.Printf("laptop %s has %d images", laptopId, len(res.GetImages()))
+
+	return res.GetImages(), nil
+}
+
+// DeleteImage deletes a laptop image
+func (client *LaptopClient) DeleteImage(imageId string) error {
+	req := &pb.DeleteImageRequest{
+		ImageId: imageId,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := client.service.DeleteImage(ctx, req)
+	if err != nil {
+		return fmt.Errorf("cannot delete image: %w", err)
+	}
+
+	log.Printf("Deleted image with id: %s", imageId)
+
+	return nil
+}
+
+// SetPrimaryImage makes an image the main image of its laptop and returns the laptop images
+func (client *LaptopClient) SetPrimaryImage(imageId string) ([]*pb.ImageMetadata, error) {
+	req := &pb.SetPrimaryImageRequest{
+		ImageId: imageId,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := client.service.SetPrimaryImage(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot set primary image: %w", err)
+	}
+
+	log.Printf("image %s is the primary image", imageId)
+
+	return res.GetImages(), nil
+}
+
+// ReorderImages changes the display order of the images of a laptop and returns them in that order
+func (client *LaptopClient) ReorderImages(laptopId string, imageIds []string) ([]*pb.ImageMetadata, error) {
+	req := &pb.ReorderImagesRequest{
+		LaptopId: laptopId,
+		ImageIds: imageIds,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := client.service.ReorderImages(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reorder images: %w", err)
+	}
+
+	log.Printf("reordered %d images of laptop %s", len(res.GetImages()), laptopId)
+
+	return res.GetImages(), nil
+}
+
+// DownloadImage downloads an image, or its variant if not empty,
+// into the folder and returns the path of the saved file
+func (client *LaptopClient) DownloadImage(imageId string, variant string, imageFolder string) (string, error) {
+	req := &pb.DownloadImageRequest{
+		ImageId: imageId,
+		Variant: variant,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.service.DownloadImage(ctx, req)
+	if err != nil {
+		return "", fmt.Errorf("cannot download image: %w", err)
+	}
+
+	res, err := stream.Recv()
+	if err != nil {
+		return "", fmt.Errorf("cannot receive image metadata: %w", err)
+	}
+
+	metadata := res.GetMetadata()
+	if metadata == nil {
+		return "", fmt.Errorf("image metadata is not the first message of the stream")
+	}
+
+	name := metadata.GetId()
+	if variant != "" {
+		name += "_" + variant
+	}
+
+	imagePath := filepath.Join(imageFolder, name+metadata.GetImageType())
+	file, err := os.Create(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("cannot create image file: %w", err)
+	}
+	defer file.Close()
+
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("cannot receive chunk data: %w", err)
+		}
+
+		_, err = file.Write(res.GetChunkData())
+		if err != nil {
+			return "", fmt.Errorf("cannot write image to file: %w", err)
+		}
+	}
+
+	log.Printf("image downloaded with id: %s, variant %q, size: %d, to %s", metadata.GetId(), variant, metadata.GetSize(), imagePath)
+
+	return imagePath, nil
+}
+
 // RateLaptop rates a laptop
 func (client *LaptopClient) RateLaptop(laptopIds []string, scores []float64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -182,6 +538,11 @@ func (client *LaptopClient) RateLaptop(laptopIds []string, scores []float64) err
 				return
 			}
 
+			if res.GetStatus().GetCode() != int32(codes.OK) {
+				log.Printf("cannot rate laptop %s: %s", res.GetLaptopId(), res.GetStatus().GetMessage())
+				continue
+			}
+
 			log.Printf("received response: %v", res)
 		}
 	}()
@@ -210,3 +571,63 @@ func (client *LaptopClient) RateLaptop(laptopIds []string, scores []float64) err
 
 	return err
 }
+
+// GetMyRatings lists the scores given to laptops by the logged in user
+func (client *LaptopClient) GetMyRatings() ([]*pb.MyRating, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := client.service.GetMyRatings(ctx, &pb.GetMyRatingsRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("cannot get my ratings: %w", err)
+	}
+
+	for _, rating := range res.GetRatings() {
+		log.Printf("rated laptop %s: score = %.2f", rating.GetLaptopId(), rating.GetScore())
+	}
+
+	return res.GetRatings(), nil
+}
+
+// GetRatingStats gets the statistics of the scores of a laptop, with its rating in each time window
+func (client *LaptopClient) GetRatingStats(laptopId string, windows []*pb.TimeWindow) (*pb.GetRatingStatsResponse, error) {
+	req := &pb.GetRatingStatsRequest{
+		LaptopId: laptopId,
+		Windows:  windows,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := client.service.GetRatingStats(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get rating stats: %w", err)
+	}
+
+	log.Printf("laptop %s is rated %d times, average = %.2f, median = %.2f", laptopId, res.GetRatedCount(), res.GetAverageScore(), res.GetMedianScore())
+
+	return res, nil
+}
+
+// TopRatedLaptops gets the best ranked laptops matching a filter, at most limit of them
+func (client *LaptopClient) TopRatedLaptops(filter *pb.Filter, limit uint32) ([]*pb.RankedLaptop, error) {
+	req := &pb.TopRatedLaptopsRequest{
+		Filter: filter,
+		Limit:  limit,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := client.service.TopRatedLaptops(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get top rated laptops: %w", err)
+	}
+
+	for i, ranked := range res.GetLaptops() {
+		log.Printf("#%d laptop %s: ranking score = %.2f, rated %d times, average = %.2f",
+			i+1, ranked.GetLaptop().GetId(), ranked.GetRankingScore(), ranked.GetRatedCount(), ranked.GetAverageScore())
+	}
+
+	return res.GetLaptops(), nil
+}
@@ -0,0 +1,136 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/warnshun/pcbook/pb"
+	"google.golang.org/grpc"
+)
+
+// ReviewClient is a client to call review RPC services
+type ReviewClient struct {
+	service pb.ReviewServiceClient
+}
+
+// NewReviewClient returns a new review client
+func NewReviewClient(cc *grpc.ClientConn) *ReviewClient {
+	service := pb.NewReviewServiceClient(cc)
+
+	return &ReviewClient{
+		service: service,
+	}
+}
+
+// SubmitReview writes the review of the logged in user for a laptop
+func (client *ReviewClient) SubmitReview(laptopId string, score float64, title string, body string) (*pb.Review, error) {
+	req := &pb.SubmitReviewRequest{
+		LaptopId: laptopId,
+		Score:    score,
+		Title:    title,
+		Body:     body,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := client.service.SubmitReview(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot submit review: %w", err)
+	}
+
+	log.Printf("submitted review %s, laptop %s is rated %d times, average = %.2f", res.GetReview().GetId(), laptopId, res.GetRatedCount(), res.GetAverageScore())
+
+	return res.GetReview(), nil
+}
+
+// ListReviews lists a page of the reviews of a laptop, the most recent first,
+// and returns the token of the next page, empty on the last page
+func (client *ReviewClient) ListReviews(laptopId string, pageSize uint32, pageToken string) ([]*pb.Review, string, error) {
+	req := &pb.ListReviewsRequest{
+		LaptopId:  laptopId,
+		PageSize:  pageSize,
+		PageToken: pageToken,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := client.service.ListReviews(ctx, req)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot list reviews: %w", err)
+	}
+
+	for _, review := range res.GetReviews() {
+		log.Printf("review %s by %s: %.2f - %s", review.GetId(), review.GetUsername(), review.GetScore(), review.GetTitle())
+	}
+
+	return res.GetReviews(), res.GetNextPageToken(), nil
+}
+
+// VoteReviewHelpful records whether the logged in user found a review helpful
+func (client *ReviewClient) VoteReviewHelpful(reviewId string, helpful bool) (uint32, error) {
+	req := &pb.VoteReviewHelpfulRequest{
+		ReviewId: reviewId,
+		Helpful:  helpful,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := client.service.VoteReviewHelpful(ctx, req)
+	if err != nil {
+		return 0, fmt.Errorf("cannot vote for review: %w", err)
+	}
+
+	log.Printf("review %s is helpful to %d users", reviewId, res.GetHelpfulCount())
+
+	return res.GetHelpfulCount(), nil
+}
+
+// ListPendingReviews lists a page of the reviews waiting for moderation, the most recent first,
+// only the flagged ones if flaggedOnly is true, and returns the token of the next page, empty on the last page
+func (client *ReviewClient) ListPendingReviews(flaggedOnly bool, pageSize uint32, pageToken string) ([]*pb.Review, string, error) {
+	req := &pb.ListPendingReviewsRequest{
+		PageSize:    pageSize,
+		PageToken:   pageToken,
+		FlaggedOnly: flaggedOnly,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := client.service.ListPendingReviews(ctx, req)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot list pending reviews: %w", err)
+	}
+
+	for _, review := range res.GetReviews() {
+		log.Printf("pending review %s by %s: %s, flags = %v", review.GetId(), review.GetUsername(), review.GetTitle(), review.GetFlags())
+	}
+
+	return res.GetReviews(), res.GetNextPageToken(), nil
+}
+
+// ModerateReview approves or rejects a review, a reason is required to reject it
+func (client *ReviewClient) ModerateReview(reviewId string, status pb.Review_Status, reason string) (*pb.Review, error) {
+	req := &pb.ModerateReviewRequest{
+		ReviewId: reviewId,
+		Status:   status,
+		Reason:   reason,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := client.service.ModerateReview(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot moderate review: %w", err)
+	}
+
+	log.Printf("review %s is %s, laptop %s is rated %d times, average = %.2f", reviewId, res.GetReview().GetStatus(), res.GetReview().GetLaptopId(), res.GetRatedCount(), res.GetAverageScore())
+
+	return res.GetReview(), nil
+}
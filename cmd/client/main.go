@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -12,15 +13,36 @@ import (
 
 	"github.com/warnshun/pcbook/client"
 	"github.com/warnshun/pcbook/pb"
+	"github.com/warnshun/pcbook/query"
 	"github.com/warnshun/pcbook/sample"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func testCreateLaptop(laptopClient *client.LaptopClient) {
 	laptopClient.CreateLaptop(sample.NewLaptop())
 }
 
+func testGetLaptop(laptopClient *client.LaptopClient) {
+	laptop := sample.NewLaptop()
+	laptopClient.CreateLaptop(laptop)
+
+	_, err := laptopClient.GetLaptop(laptop.GetId())
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func testUpdateLaptop(laptopClient *client.LaptopClient) {
+	laptop := sample.NewLaptop()
+	laptopClient.CreateLaptop(laptop)
+
+	laptop.Price = 999
+	laptopClient.UpdateLaptop(laptop, "price")
+	laptopClient.DeleteLaptop(laptop.GetId())
+}
+
 func testSearchLaptop(laptopClient *client.LaptopClient) {
 	for i := 0; i < 10; i++ {
 		laptopClient.CreateLaptop(sample.NewLaptop())
@@ -39,12 +61,107 @@ func testSearchLaptop(laptopClient *client.LaptopClient) {
 	laptopClient.SearchLaptop(filter)
 }
 
+func testSearchLaptopByQuery(laptopClient *client.LaptopClient) {
+	for i := 0; i < 10; i++ {
+		laptopClient.CreateLaptop(sample.NewLaptop())
+	}
+
+	laptopClient.SearchLaptopByQuery("brand:Apple,Dell ram>=8GB price<2500 gpu:nvidia panel:OLED")
+}
+
+// parseSearchQuery parses a search query into a filter,
+// showing where the query is invalid if it cannot be parsed
+func parseSearchQuery(searchQuery string) *pb.Filter {
+	filter, err := query.Parse(searchQuery)
+	if err != nil {
+		var queryErr *query.Error
+		if errors.As(err, &queryErr) {
+			fmt.Fprintf(os.Stderr, "%s\n%s^\n", searchQuery, strings.Repeat(" ", queryErr.Offset))
+			log.Fatalf("invalid query at offset %d: %s", queryErr.Offset, queryErr.Reason)
+		}
+		log.Fatal("cannot parse query:", err)
+	}
+
+	return filter
+}
+
+func testWatchLaptops(laptopClient *client.LaptopClient) {
+	go func() {
+		err := laptopClient.WatchLaptops(&pb.Filter{MaxPrice: 2500}, true)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		time.Sleep(time.Second)
+		laptopClient.CreateLaptop(sample.NewLaptop())
+	}
+}
+
 func testUploadImage(laptopClient *client.LaptopClient) {
 	laptop := sample.NewLaptop()
 	laptopClient.CreateLaptop(laptop)
 	laptopClient.UploadImage(laptop.GetId(), "tmp/laptop.jpg")
 }
 
+func testUploadImageResumable(laptopClient *client.LaptopClient) {
+	laptop := sample.NewLaptop()
+	laptopClient.CreateLaptop(laptop)
+
+	_, err := laptopClient.UploadImageResumable(laptop.GetId(), "tmp/laptop.jpg")
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func testDownloadImage(laptopClient *client.LaptopClient) {
+	laptop := sample.NewLaptop()
+	laptopClient.CreateLaptop(laptop)
+	laptopClient.UploadImage(laptop.GetId(), "tmp/laptop.jpg")
+
+	images, err := laptopClient.ListImages(laptop.GetId())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, image := range images {
+		for _, variant := range append([]string{""}, image.GetVariants()...) {
+			_, err := laptopClient.DownloadImage(image.GetId(), variant, os.TempDir())
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+}
+
+func testManageImages(laptopClient *client.LaptopClient) {
+	laptop := sample.NewLaptop()
+	laptopClient.CreateLaptop(laptop)
+	laptopClient.UploadImage(laptop.GetId(), "tmp/laptop.jpg")
+	laptopClient.UploadImage(laptop.GetId(), "tmp/laptop.jpg")
+
+	images, err := laptopClient.ListImages(laptop.GetId())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = laptopClient.ReorderImages(laptop.GetId(), []string{images[1].GetId(), images[0].GetId()})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = laptopClient.SetPrimaryImage(images[1].GetId())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = laptopClient.DeleteImage(images[0].GetId())
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
 func testRateLaptop(laptopClient *client.LaptopClient) {
 	n := 3
 	laptopIds := make([]string, n)
@@ -76,15 +193,79 @@ func testRateLaptop(laptopClient *client.LaptopClient) {
 		}
 	}
 
+	_, err := laptopClient.GetMyRatings()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the rating of the last day next to the overall rating
+	lastDay := &pb.TimeWindow{Start: timestamppb.New(time.Now().Add(-24 * time.Hour))}
+	for _, laptopId := range laptopIds {
+		_, err := laptopClient.GetRatingStats(laptopId, []*pb.TimeWindow{lastDay})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	_, err = laptopClient.TopRatedLaptops(&pb.Filter{}, 5)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func testReviewLaptop(laptopClient *client.LaptopClient, reviewClient *client.ReviewClient) {
+	laptop := sample.NewLaptop()
+	laptopClient.CreateLaptop(laptop)
+
+	review, err := reviewClient.SubmitReview(laptop.GetId(), sample.RandomLaptopScore(), "Great laptop", "Fast and light, the battery lasts all day.")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the reviews are only listed once approved
+	_, _, err = reviewClient.ListPendingReviews(false, 10, "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = reviewClient.ModerateReview(review.GetId(), pb.Review_APPROVED, "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pageToken := ""
+	for {
+		_, nextPageToken, err := reviewClient.ListReviews(laptop.GetId(), 10, pageToken)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if nextPageToken == "" {
+			break
+		}
+		pageToken = nextPageToken
+	}
 }
 
 func authMethods() map[string]bool {
 	const laptopServicePath = "/LaptopService/"
+	const reviewServicePath = "/ReviewService/"
 
 	return map[string]bool{
-		laptopServicePath + "CreateLaptop": true,
-		laptopServicePath + "UploadImage":  true,
-		laptopServicePath + "RateLaptop":   true,
+		laptopServicePath + "CreateLaptop":       true,
+		laptopServicePath + "UpdateLaptop":       true,
+		laptopServicePath + "DeleteLaptop":       true,
+		laptopServicePath + "StartUpload":        true,
+		laptopServicePath + "GetUploadStatus":    true,
+		laptopServicePath + "UploadImage":        true,
+		laptopServicePath + "DeleteImage":        true,
+		laptopServicePath + "SetPrimaryImage":    true,
+		laptopServicePath + "ReorderImages":      true,
+		laptopServicePath + "RateLaptop":         true,
+		laptopServicePath + "GetMyRatings":       true,
+		reviewServicePath + "SubmitReview":       true,
+		reviewServicePath + "VoteReviewHelpful":  true,
+		reviewServicePath + "ListPendingReviews": true,
+		reviewServicePath + "ModerateReview":     true,
 	}
 }
 
@@ -124,7 +305,14 @@ const (
 
 func main() {
 	serverAddress := flag.String("address", "", "The server address")
+	searchQuery := flag.String("query", "", `Search for the laptops matching a query like "brand:Apple ram>=8GB" instead of running the tests`)
 	flag.Parse()
+
+	var searchFilter *pb.Filter
+	if *searchQuery != "" {
+		searchFilter = parseSearchQuery(*searchQuery)
+	}
+
 	log.Printf("Dial server on %s", *serverAddress)
 
 	tlsCredentials, err := loadTLSCredentials()
@@ -138,11 +326,19 @@ func main() {
 	}
 	defer cc1.Close()
 
-	authClient := client.NewAuthClient(cc1, username, password)
-	interceptor, err := client.NewAuthInterceptor(authClient, authMethods(), refreshDuration)
+	authClient := client.NewAuthClient(cc1)
+	accessToken, err := authClient.Login(username, password)
 	if err != nil {
-		log.Fatal("cannot create auth interceptor:", err)
+		log.Fatal("cannot login:", err)
 	}
+	defer func() {
+		err := authClient.Logout()
+		if err != nil {
+			log.Print("cannot logout:", err)
+		}
+	}()
+
+	interceptor := client.NewAuthInterceptor(authClient, authMethods(), accessToken, refreshDuration)
 
 	cc2, err := grpc.Dial(
 		*serverAddress,
@@ -157,8 +353,21 @@ func main() {
 
 	laptopClient := client.NewLaptopClient(cc2)
 
+	if searchFilter != nil {
+		laptopClient.SearchLaptop(searchFilter)
+		return
+	}
+
 	// testCreateLaptop(laptopClient)
+	// testGetLaptop(laptopClient)
+	// testUpdateLaptop(laptopClient)
 	// testSearchLaptop(laptopClient)
+	// testSearchLaptopByQuery(laptopClient)
+	// testWatchLaptops(laptopClient)
 	// testUploadImage(laptopClient)
+	// testUploadImageResumable(laptopClient)
+	// testDownloadImage(laptopClient)
+	// testManageImages(laptopClient)
+	// testReviewLaptop(laptopClient, client.NewReviewClient(cc2))
 	testRateLaptop(laptopClient)
 }
@@ -6,8 +6,11 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"os"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/warnshun/pcbook/pb"
@@ -19,13 +22,50 @@ import (
 const (
 	secretKey     = "mySecretKey"
 	tokenDuration = 15 * time.Minute
+	// refreshTokenDuration is how long a login lasts without refreshing its access token
+	refreshTokenDuration = 7 * 24 * time.Hour
 )
 
+// variantName is the pattern of image variant names, they are part of the file names
+var variantName = regexp.MustCompile(`^[a-z0-9]+$`)
+
 func main() {
 	port := flag.Int("port", 0, "The port to run the server on")
+	ratingDB := flag.String("rating-db", "", "The SQLite database file to store ratings in, keep empty to store them in memory")
+	reviewDB := flag.String("review-db", "", "The SQLite database file to store reviews in, keep empty to store them in memory")
+	uploadDir := flag.String("upload-dir", "uploads", "The folder to keep the resumable image uploads in progress in")
+	laptopDB := flag.String("laptop-db", "", "The SQLite database file to store laptops in, keep empty to store them in memory")
+	imageTypes := flag.String("image-types", strings.Join(service.SupportedImageTypes(), ","), "The comma separated MIME types of the images that can be uploaded")
+	imageVariants := flag.String("image-variants", "thumbnail=160x160,small=480x480,medium=1024x1024", "The comma separated resized variants of the uploaded images, as name=WIDTHxHEIGHT")
+	maxImageSize := flag.Int64("max-image-size", service.MAX_IMAGE_SIZE, "The maximum size of the uploaded images in bytes")
+	maxImagePixels := flag.Int64("max-image-pixels", 0, "The maximum number of pixels of the images resized into variants, keep 0 for the default")
+	minScore := flag.Float64("min-score", service.MIN_LAPTOP_SCORE, "The minimum score of the laptop ratings")
+	maxScore := flag.Float64("max-score", service.MAX_LAPTOP_SCORE, "The maximum score of the laptop ratings")
+	priorScore := flag.Float64("prior-score", 0, "The prior score of the laptop rankings, the middle of the score range if not set")
+	priorWeight := flag.Float64("prior-weight", service.DEFAULT_PRIOR_WEIGHT, "The number of prior scores added to the scores of each laptop when ranking them")
+	bannedWords := flag.String("banned-words", "", "The comma separated words flagging the reviews containing them for moderation")
+	repairImages := flag.Bool("repair-images", false, "Delete the orphan files of the image folder and the images whose file is missing")
+	s3Endpoint := flag.String("s3-endpoint", "", "The URL of the S3-compatible object store to store images in, keep empty to store them on the disk")
+	s3Region := flag.String("s3-region", "us-east-1", "The region of the S3 bucket")
+	s3Bucket := flag.String("s3-bucket", "", "The S3 bucket to store images in")
+	s3PathStyle := flag.Bool("s3-path-style", false, "Address the S3 bucket in the URL path instead of the host name")
 	flag.Parse()
 	log.Printf("Starting server on port %d", *port)
 
+	if !isFinite(*minScore) || !isFinite(*maxScore) || *minScore >= *maxScore {
+		log.Fatalf("the score range %v to %v is invalid, the minimum score must be less than the maximum score", *minScore, *maxScore)
+	}
+
+	if !isFlagSet("prior-score") {
+		*priorScore = (*minScore + *maxScore) / 2
+	}
+	if !isFinite(*priorScore) || *priorScore < *minScore || *priorScore > *maxScore {
+		log.Fatalf("the prior score %v is not in the score range %v to %v", *priorScore, *minScore, *maxScore)
+	}
+	if !isFinite(*priorWeight) || *priorWeight < 0 {
+		log.Fatalf("the prior weight %v is invalid, it must be a positive number or 0", *priorWeight)
+	}
+
 	userStore := service.NewInMemoryUserStore()
 	err := seedUsers(userStore)
 	if err != nil {
@@ -33,13 +73,86 @@ func main() {
 	}
 
 	jwtManager := service.NewJWTManager(secretKey, tokenDuration)
-	authServer := service.NewAuthServer(userStore, jwtManager)
+	refreshTokenManager := service.NewRefreshTokenManager(service.NewInMemoryRefreshTokenStore(), refreshTokenDuration)
+	authServer := service.NewAuthServer(userStore, jwtManager, refreshTokenManager)
+
+	laptopStore, err := newLaptopStore(*laptopDB)
+	if err != nil {
+		log.Fatal("cannot create laptop store:", err)
+	}
+
+	variants, err := parseImageVariants(*imageVariants)
+	if err != nil {
+		log.Fatal("cannot parse image variants:", err)
+	}
 
-	laptopStore := service.NewInMemoryLaptopStore()
-	imageStore := service.NewDiskImageStore("img")
-	ratingStore := service.NewInMemoryRatingStore()
+	imageOptions := []service.ImageStoreOption{service.WithImageVariants(variants...)}
+	if *maxImagePixels < 0 {
+		log.Fatal("the maximum number of image pixels cannot be negative")
+	}
+	if *maxImagePixels > 0 {
+		imageOptions = append(imageOptions, service.WithMaxImagePixels(*maxImagePixels))
+	}
 
-	laptopServer := service.NewLaptopServer(laptopStore, imageStore, ratingStore)
+	var imageStore service.ImageStore
+	if *s3Endpoint != "" {
+		log.Printf("Storing images in S3 bucket %s at %s", *s3Bucket, *s3Endpoint)
+		imageStore, err = service.NewS3ImageStore(
+			service.S3Config{
+				Endpoint:        *s3Endpoint,
+				Region:          *s3Region,
+				Bucket:          *s3Bucket,
+				AccessKeyId:     os.Getenv("AWS_ACCESS_KEY_ID"),
+				SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+				PathStyle:       *s3PathStyle,
+			},
+			imageOptions...,
+		)
+	} else {
+		imageStore, err = newImageStore("img", imageOptions, *repairImages)
+	}
+	if err != nil {
+		log.Fatal("cannot create image store:", err)
+	}
+
+	ratingStore, err := newRatingStore(*ratingDB)
+	if err != nil {
+		log.Fatal("cannot create rating store:", err)
+	}
+
+	reviewStore, err := newReviewStore(*reviewDB)
+	if err != nil {
+		log.Fatal("cannot create review store:", err)
+	}
+
+	allowedImageTypes, err := parseImageTypes(*imageTypes)
+	if err != nil {
+		log.Fatal("cannot parse image types:", err)
+	}
+
+	uploadStore, err := service.NewDiskUploadStore(*uploadDir)
+	if err != nil {
+		log.Fatal("cannot create upload store:", err)
+	}
+
+	laptopServer := service.NewLaptopServer(
+		laptopStore,
+		imageStore,
+		ratingStore,
+		service.WithAllowedImageTypes(allowedImageTypes...),
+		service.WithMaxImageSize(*maxImageSize),
+		service.WithUploadStore(uploadStore),
+		service.WithScoreRange(*minScore, *maxScore),
+		service.WithRanker(service.NewBayesianRanker(ratingStore, *priorScore, *priorWeight)),
+	)
+
+	reviewServer := service.NewReviewServer(
+		reviewStore,
+		ratingStore,
+		laptopStore,
+		service.WithReviewScoreRange(*minScore, *maxScore),
+		service.WithBannedWords(strings.Split(*bannedWords, ",")...),
+	)
 
 	tlsCredentials, err := loadTLSCredentials()
 	if err != nil {
@@ -55,6 +168,7 @@ func main() {
 
 	pb.RegisterAuthServiceServer(grpcServer, authServer)
 	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
+	pb.RegisterReviewServiceServer(grpcServer, reviewServer)
 
 	address := fmt.Sprintf("0.0.0.0:%d", *port)
 	fmt.Printf("Starting server on %s", address)
@@ -69,6 +183,118 @@ func main() {
 	}
 }
 
+func newLaptopStore(laptopDB string) (service.LaptopStore, error) {
+	if laptopDB == "" {
+		return service.NewInMemoryLaptopStore(), nil
+	}
+
+	log.Printf("Storing laptops in SQLite database %s", laptopDB)
+	return service.NewSQLiteLaptopStore(laptopDB)
+}
+
+func newRatingStore(ratingDB string) (service.RatingStore, error) {
+	if ratingDB == "" {
+		return service.NewInMemoryRatingStore(), nil
+	}
+
+	log.Printf("Storing ratings in SQLite database %s", ratingDB)
+	return service.NewSQLiteRatingStore(ratingDB)
+}
+
+func newReviewStore(reviewDB string) (service.ReviewStore, error) {
+	if reviewDB == "" {
+		return service.NewInMemoryReviewStore(), nil
+	}
+
+	log.Printf("Storing reviews in SQLite database %s", reviewDB)
+	return service.NewSQLiteReviewStore(reviewDB)
+}
+
+// parseImageTypes parses a comma separated list of supported image MIME types
+func parseImageTypes(imageTypes string) ([]string, error) {
+	supported := make(map[string]bool)
+	for _, mimeType := range service.SupportedImageTypes() {
+		supported[mimeType] = true
+	}
+
+	var mimeTypes []string
+	for _, mimeType := range strings.Split(imageTypes, ",") {
+		mimeType = strings.TrimSpace(mimeType)
+		if !supported[mimeType] {
+			return nil, fmt.Errorf("%q is not one of %s", mimeType, strings.Join(service.SupportedImageTypes(), ", "))
+		}
+
+		mimeTypes = append(mimeTypes, mimeType)
+	}
+
+	return mimeTypes, nil
+}
+
+// parseImageVariants parses a comma separated list of name=WIDTHxHEIGHT variants
+func parseImageVariants(imageVariants string) ([]service.ImageVariant, error) {
+	var variants []service.ImageVariant
+	if imageVariants == "" {
+		return variants, nil
+	}
+
+	for _, text := range strings.Split(imageVariants, ",") {
+		variant := service.ImageVariant{}
+
+		name, size, ok := strings.Cut(strings.TrimSpace(text), "=")
+		if !ok || !variantName.MatchString(name) {
+			return nil, fmt.Errorf("%q is not a valid variant, such as thumbnail=160x160", text)
+		}
+
+		_, err := fmt.Sscanf(size, "%dx%d", &variant.MaxWidth, &variant.MaxHeight)
+		if err != nil || variant.MaxWidth <= 0 || variant.MaxHeight <= 0 {
+			return nil, fmt.Errorf("%q is not a valid variant size, such as 160x160", size)
+		}
+
+		variant.Name = name
+		variants = append(variants, variant)
+	}
+
+	return variants, nil
+}
+
+// newImageStore returns the image store of the folder,
+// reporting its inconsistencies or repairing them
+func newImageStore(imageFolder string, opts []service.ImageStoreOption, repair bool) (*service.DiskImageStore, error) {
+	imageStore, err := service.NewDiskImageStore(imageFolder, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	var report *service.ImageIndexReport
+	if repair {
+		report, err = imageStore.Repair()
+	} else {
+		report, err = imageStore.Check()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if report.Clean() {
+		return imageStore, nil
+	}
+
+	for _, orphan := range report.Orphans {
+		log.Printf("orphan image file: %s", orphan)
+	}
+	for _, image := range report.Dangling {
+		log.Printf("missing file of image %s of laptop %s", image.Id, image.LaptopId)
+	}
+
+	if repair {
+		log.Printf("repaired image folder: %d orphan files deleted, %d missing images removed", len(report.Orphans), len(report.Dangling))
+	} else {
+		log.Print("run with -repair-images to delete the orphan files and remove the missing images")
+	}
+
+	return imageStore, nil
+}
+
 func loadTLSCredentials() (credentials.TransportCredentials, error) {
 	// load server's certificate and private key
 	serverCert, err := tls.LoadX509KeyPair("cert/server-cert.pem", "cert/server-key.pem")
@@ -118,10 +344,40 @@ func createUser(userStore service.UserStore, username string, password string, r
 
 func accessibleRoles() map[string][]string {
 	const laptopServicePath = "/LaptopService/"
+	const reviewServicePath = "/ReviewService/"
 
 	return map[string][]string{
-		laptopServicePath + "CreateLaptop": {"admin"},
-		laptopServicePath + "UploadImage":  {"admin"},
-		laptopServicePath + "RateLaptop":   {"admin", "user"},
+		laptopServicePath + "CreateLaptop":       {"admin"},
+		laptopServicePath + "UpdateLaptop":       {"admin"},
+		laptopServicePath + "DeleteLaptop":       {"admin"},
+		laptopServicePath + "StartUpload":        {"admin"},
+		laptopServicePath + "GetUploadStatus":    {"admin"},
+		laptopServicePath + "UploadImage":        {"admin"},
+		laptopServicePath + "DeleteImage":        {"admin"},
+		laptopServicePath + "SetPrimaryImage":    {"admin"},
+		laptopServicePath + "ReorderImages":      {"admin"},
+		laptopServicePath + "RateLaptop":         {"admin", "user"},
+		laptopServicePath + "GetMyRatings":       {"admin", "user"},
+		reviewServicePath + "SubmitReview":       {"admin", "user"},
+		reviewServicePath + "VoteReviewHelpful":  {"admin", "user"},
+		reviewServicePath + "ListPendingReviews": {"admin"},
+		reviewServicePath + "ModerateReview":     {"admin"},
 	}
 }
+
+// isFlagSet tells whether the flag with the name is set on the command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+
+	return set
+}
+
+// isFinite returns true if x is neither infinite nor NaN
+func isFinite(x float64) bool {
+	return !math.IsNaN(x) && !math.IsInf(x, 0)
+}
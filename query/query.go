@@ -0,0 +1,483 @@
+// Package query parses free-text laptop search queries into filters.
+//
+// A query is a list of whitespace separated terms that must all match,
+// each term is a field, an operator and a value, for example:
+//
+//	brand:Apple,Dell ram>=16GB price<2000 gpu:nvidia panel:OLED
+//
+// The ":" operator means "is one of" for list fields, "is" for years and "at least"
+// for other numeric fields, "=" sets both bounds of a range, and "<", "<=", ">", ">="
+// set one bound of it.
+// Comma separated values of list fields match any of them.
+package query
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/warnshun/pcbook/pb"
+)
+
+// Error reports the term of a query that cannot be parsed
+type Error struct {
+	Offset int
+	Term   string
+	Reason string
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("invalid term %q at offset %d: %s", err.Term, err.Offset, err.Reason)
+}
+
+const kilogramsPerPound = 0.45359237
+
+// operators are ordered so that two-character operators are matched first
+var operators = []string{"<=", ">=", "<", ">", "=", ":"}
+
+type term struct {
+	offset int
+	text   string
+	field  string
+	op     string
+	value  string
+}
+
+type fieldParser func(filter *pb.Filter, t *term) error
+
+var fields = map[string]fieldParser{
+	"brand":        parseBrand,
+	"price":        parsePrice,
+	"year":         parseReleaseYear,
+	"release_year": parseReleaseYear,
+	"cores":        parseCpuCores,
+	"cpu_cores":    parseCpuCores,
+	"ghz":          parseCpuGhz,
+	"cpu_ghz":      parseCpuGhz,
+	"ram":          parseRam,
+	"gpu":          parseGpuBrand,
+	"gpu_memory":   parseGpuMemory,
+	"vram":         parseGpuMemory,
+	"storage":      parseStorage,
+	"ssd":          parseSsdOnly,
+	"screen":       parseScreenSize,
+	"resolution":   parseScreenResolution,
+	"panel":        parseScreenPanel,
+	"backlit":      parseBacklitKeyboard,
+	"weight":       parseWeight,
+}
+
+// Parse parses a query into a filter, an empty query matches every laptop
+func Parse(query string) (*pb.Filter, error) {
+	filter := &pb.Filter{}
+
+	for _, t := range split(query) {
+		err := t.parse()
+		if err != nil {
+			return nil, err
+		}
+
+		parse, ok := fields[t.field]
+		if !ok {
+			return nil, t.errorf("unknown field %q", t.field)
+		}
+
+		err = parse(filter, t)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return filter, nil
+}
+
+// split splits the query into terms, remembering where each of them starts
+func split(query string) []*term {
+	var terms []*term
+
+	start := -1
+	for i, r := range query + " " {
+		isSpace := r == ' ' || r == '\t' || r == '\n' || r == '\r'
+
+		if !isSpace && start < 0 {
+			start = i
+		}
+		if isSpace && start >= 0 {
+			terms = append(terms, &term{offset: start, text: query[start:i]})
+			start = -1
+		}
+	}
+
+	return terms
+}
+
+func (t *term) parse() error {
+	index := strings.IndexAny(t.text, "<>=:")
+	if index <= 0 {
+		return t.errorf("expected a field, an operator and a value")
+	}
+
+	t.field = strings.ToLower(t.text[:index])
+	for _, op := range operators {
+		if strings.HasPrefix(t.text[index:], op) {
+			t.op = op
+			break
+		}
+	}
+
+	t.value = t.text[index+len(t.op):]
+	if t.value == "" {
+		return t.errorf("missing value")
+	}
+
+	return nil
+}
+
+func (t *term) errorf(format string, args ...any) error {
+	return &Error{
+		Offset: t.offset,
+		Term:   t.text,
+		Reason: fmt.Sprintf(format, args...),
+	}
+}
+
+// requireOps checks that the term uses one of the given operators
+func (t *term) requireOps(ops ...string) error {
+	for _, op := range ops {
+		if t.op == op {
+			return nil
+		}
+	}
+
+	return t.errorf("field %q does not support operator %q, use one of %s", t.field, t.op, strings.Join(ops, " "))
+}
+
+func (t *term) list() []string {
+	return strings.Split(t.value, ",")
+}
+
+func (t *term) float() (float64, error) {
+	value, err := strconv.ParseFloat(t.value, 64)
+	if err != nil || value < 0 || math.IsInf(value, 0) || math.IsNaN(value) {
+		return 0, t.errorf("%q is not a valid number", t.value)
+	}
+
+	return value, nil
+}
+
+func (t *term) uint() (uint32, error) {
+	value, err := strconv.ParseUint(t.value, 10, 32)
+	if err != nil {
+		return 0, t.errorf("%q is not a valid whole number", t.value)
+	}
+
+	return uint32(value), nil
+}
+
+func (t *term) bool() (bool, error) {
+	value, err := strconv.ParseBool(t.value)
+	if err != nil {
+		return false, t.errorf("%q is not true or false", t.value)
+	}
+
+	return value, nil
+}
+
+// memoryUnits maps size suffixes to units and their size in bits as a power of 2
+var memoryUnits = []struct {
+	suffix string
+	unit   pb.Memory_Unit
+	shift  uint
+}{
+	{"TB", pb.Memory_TERABYTE, 43},
+	{"GB", pb.Memory_GIGABYTE, 33},
+	{"MB", pb.Memory_MEGABYTE, 23},
+	{"KB", pb.Memory_KILOBYTE, 13},
+	{"B", pb.Memory_BYTE, 3},
+}
+
+// memory parses sizes such as 16GB or 512mb,
+// a strict lower bound is one bit more than the parsed size
+func (t *term) memory() (*pb.Memory, error) {
+	upper := strings.ToUpper(t.value)
+
+	for _, unit := range memoryUnits {
+		if !strings.HasSuffix(upper, unit.suffix) {
+			continue
+		}
+
+		value, err := strconv.ParseUint(upper[:len(upper)-len(unit.suffix)], 10, 64)
+		if err != nil {
+			break
+		}
+		// the sizes are compared in bits
+		if value > math.MaxUint64>>unit.shift {
+			return nil, t.errorf("%q is too large", t.value)
+		}
+
+		if t.op == ">" {
+			return &pb.Memory{Value: value<<unit.shift + 1, Unit: pb.Memory_BIT}, nil
+		}
+
+		return &pb.Memory{Value: value, Unit: unit.unit}, nil
+	}
+
+	return nil, t.errorf("%q is not a valid size, such as 16GB", t.value)
+}
+
+// floatRange applies a float term to the min and max bounds of a range,
+// next returns the value following x towards y in the precision of the bounds.
+// A max bound of 0 means no limit in the filter, so the terms leaving no positive value are rejected
+func floatRange(t *term, min *float64, max *float64, next func(x float64, y float64) float64) error {
+	value, err := t.float()
+	if err != nil {
+		return err
+	}
+
+	switch t.op {
+	case "<":
+		*max = next(value, math.Inf(-1))
+	case "<=":
+		*max = value
+	case ">":
+		*min = next(value, math.Inf(1))
+	case ">=", ":":
+		*min = value
+	case "=":
+		*min = value
+		*max = value
+	}
+
+	if (t.op == "<" || t.op == "<=" || t.op == "=") && *max <= 0 {
+		return t.errorf("no value is %s %s", t.op, t.value)
+	}
+
+	return nil
+}
+
+// nextafter32 is math.Nextafter in the precision of the float32 bounds
+func nextafter32(x float64, y float64) float64 {
+	return float64(math.Nextafter32(float32(x), float32(y)))
+}
+
+func parseBrand(filter *pb.Filter, t *term) error {
+	if err := t.requireOps(":", "="); err != nil {
+		return err
+	}
+
+	filter.Brands = append(filter.Brands, t.list()...)
+	return nil
+}
+
+func parsePrice(filter *pb.Filter, t *term) error {
+	return floatRange(t, &filter.MinPrice, &filter.MaxPrice, math.Nextafter)
+}
+
+func parseReleaseYear(filter *pb.Filter, t *term) error {
+	year, err := t.uint()
+	if err != nil {
+		return err
+	}
+
+	switch t.op {
+	case "<":
+		if year == 0 {
+			return t.errorf("no year is before year 0")
+		}
+		filter.MaxReleaseYear = year - 1
+	case "<=":
+		filter.MaxReleaseYear = year
+	case ">":
+		filter.MinReleaseYear = year + 1
+	case ">=":
+		filter.MinReleaseYear = year
+	case ":", "=":
+		filter.MinReleaseYear = year
+		filter.MaxReleaseYear = year
+	}
+
+	return nil
+}
+
+func parseCpuCores(filter *pb.Filter, t *term) error {
+	if err := t.requireOps(":", ">=", ">"); err != nil {
+		return err
+	}
+
+	cores, err := t.uint()
+	if err != nil {
+		return err
+	}
+
+	if t.op == ">" {
+		cores++
+	}
+
+	filter.MinCpuCores = cores
+	return nil
+}
+
+func parseCpuGhz(filter *pb.Filter, t *term) error {
+	if err := t.requireOps(":", ">=", ">"); err != nil {
+		return err
+	}
+
+	var max float64
+	return floatRange(t, &filter.MinCpuGhz, &max, math.Nextafter)
+}
+
+func parseRam(filter *pb.Filter, t *term) error {
+	if err := t.requireOps(":", ">=", ">"); err != nil {
+		return err
+	}
+
+	memory, err := t.memory()
+	if err != nil {
+		return err
+	}
+
+	filter.MinRam = memory
+	return nil
+}
+
+func parseGpuBrand(filter *pb.Filter, t *term) error {
+	if err := t.requireOps(":", "="); err != nil {
+		return err
+	}
+
+	filter.GpuBrands = append(filter.GpuBrands, t.list()...)
+	return nil
+}
+
+func parseGpuMemory(filter *pb.Filter, t *term) error {
+	if err := t.requireOps(":", ">=", ">"); err != nil {
+		return err
+	}
+
+	memory, err := t.memory()
+	if err != nil {
+		return err
+	}
+
+	filter.MinGpuMemory = memory
+	return nil
+}
+
+func parseStorage(filter *pb.Filter, t *term) error {
+	if err := t.requireOps(":", ">=", ">"); err != nil {
+		return err
+	}
+
+	memory, err := t.memory()
+	if err != nil {
+		return err
+	}
+
+	filter.MinStorage = memory
+	return nil
+}
+
+func parseSsdOnly(filter *pb.Filter, t *term) error {
+	if err := t.requireOps(":", "="); err != nil {
+		return err
+	}
+
+	ssdOnly, err := t.bool()
+	if err != nil {
+		return err
+	}
+
+	filter.SsdOnly = ssdOnly
+	return nil
+}
+
+func parseScreenSize(filter *pb.Filter, t *term) error {
+	min := float64(filter.MinScreenSizeInch)
+	max := float64(filter.MaxScreenSizeInch)
+
+	err := floatRange(t, &min, &max, nextafter32)
+	if err != nil {
+		return err
+	}
+
+	filter.MinScreenSizeInch = float32(min)
+	filter.MaxScreenSizeInch = float32(max)
+	return nil
+}
+
+func parseScreenResolution(filter *pb.Filter, t *term) error {
+	if err := t.requireOps(":", ">="); err != nil {
+		return err
+	}
+
+	width, height, ok := strings.Cut(strings.ToLower(t.value), "x")
+	w, err1 := strconv.ParseUint(width, 10, 32)
+	h, err2 := strconv.ParseUint(height, 10, 32)
+	if !ok || err1 != nil || err2 != nil {
+		return t.errorf("%q is not a valid resolution, such as 1920x1080", t.value)
+	}
+
+	filter.MinScreenResolution = &pb.Screen_Resolution{
+		Width:  uint32(w),
+		Height: uint32(h),
+	}
+	return nil
+}
+
+func parseScreenPanel(filter *pb.Filter, t *term) error {
+	if err := t.requireOps(":", "="); err != nil {
+		return err
+	}
+
+	for _, name := range t.list() {
+		panel, ok := pb.Screen_Panel_value[strings.ToUpper(name)]
+		if !ok || panel == int32(pb.Screen_UNKNOWN) {
+			return t.errorf("unknown panel %q", name)
+		}
+
+		filter.ScreenPanels = append(filter.ScreenPanels, pb.Screen_Panel(panel))
+	}
+
+	return nil
+}
+
+func parseBacklitKeyboard(filter *pb.Filter, t *term) error {
+	if err := t.requireOps(":", "="); err != nil {
+		return err
+	}
+
+	backlit, err := t.bool()
+	if err != nil {
+		return err
+	}
+
+	filter.BacklitKeyboard = backlit
+	return nil
+}
+
+// parseWeight parses a maximum weight in kg, or in lb with the lb suffix
+func parseWeight(filter *pb.Filter, t *term) error {
+	if err := t.requireOps("<", "<="); err != nil {
+		return err
+	}
+
+	factor := 1.0
+	lower := strings.ToLower(t.value)
+	switch {
+	case strings.HasSuffix(lower, "kg"):
+		t.value = t.value[:len(t.value)-2]
+	case strings.HasSuffix(lower, "lb"):
+		t.value = t.value[:len(t.value)-2]
+		factor = kilogramsPerPound
+	}
+
+	var min float64
+	err := floatRange(t, &min, &filter.MaxWeightKg, math.Nextafter)
+	if err != nil {
+		return err
+	}
+
+	filter.MaxWeightKg *= factor
+	return nil
+}
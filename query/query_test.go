@@ -0,0 +1,143 @@
+package query_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/warnshun/pcbook/pb"
+	"github.com/warnshun/pcbook/query"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	weightLb := 4.4
+
+	testCases := []struct {
+		name   string
+		query  string
+		filter *pb.Filter
+	}{
+		{
+			name:   "empty",
+			query:  "  ",
+			filter: &pb.Filter{},
+		},
+		{
+			name:  "storefront",
+			query: "brand:Apple ram>=16GB price<=2000 gpu:nvidia panel:OLED",
+			filter: &pb.Filter{
+				Brands:       []string{"Apple"},
+				MinRam:       &pb.Memory{Value: 16, Unit: pb.Memory_GIGABYTE},
+				MaxPrice:     2000,
+				GpuBrands:    []string{"nvidia"},
+				ScreenPanels: []pb.Screen_Panel{pb.Screen_OLED},
+			},
+		},
+		{
+			name:  "lists_and_ranges",
+			query: "brand:Dell,HP price>=1000 year>2019 year<=2022 screen=15.6 cores>4 ghz:2.5",
+			filter: &pb.Filter{
+				Brands:            []string{"Dell", "HP"},
+				MinPrice:          1000,
+				MinReleaseYear:    2020,
+				MaxReleaseYear:    2022,
+				MinScreenSizeInch: 15.6,
+				MaxScreenSizeInch: 15.6,
+				MinCpuCores:       5,
+				MinCpuGhz:         2.5,
+			},
+		},
+		{
+			name:  "hardware",
+			query: "vram>=8gb storage:1TB ssd:true resolution>=1920x1080 backlit:true weight<=4.4lb",
+			filter: &pb.Filter{
+				MinGpuMemory:        &pb.Memory{Value: 8, Unit: pb.Memory_GIGABYTE},
+				MinStorage:          &pb.Memory{Value: 1, Unit: pb.Memory_TERABYTE},
+				SsdOnly:             true,
+				MinScreenResolution: &pb.Screen_Resolution{Width: 1920, Height: 1080},
+				BacklitKeyboard:     true,
+				MaxWeightKg:         weightLb * 0.45359237,
+			},
+		},
+		{
+			name:   "strict_memory",
+			query:  "ram>1KB",
+			filter: &pb.Filter{MinRam: &pb.Memory{Value: 8193, Unit: pb.Memory_BIT}},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			filter, err := query.Parse(tc.query)
+			require.NoError(t, err)
+			require.True(t, proto.Equal(tc.filter, filter), "got %v", filter)
+		})
+	}
+}
+
+func TestParseStrictBound(t *testing.T) {
+	t.Parallel()
+
+	filter, err := query.Parse("price<2000")
+	require.NoError(t, err)
+	require.Less(t, filter.GetMaxPrice(), 2000.0)
+	require.Greater(t, filter.GetMaxPrice(), 1999.99)
+
+	filter, err = query.Parse("screen<15.6")
+	require.NoError(t, err)
+	require.Less(t, filter.GetMaxScreenSizeInch(), float32(15.6))
+	require.Greater(t, filter.GetMaxScreenSizeInch(), float32(15.59))
+
+	filter, err = query.Parse("screen>15.6")
+	require.NoError(t, err)
+	require.Greater(t, filter.GetMinScreenSizeInch(), float32(15.6))
+	require.Less(t, filter.GetMinScreenSizeInch(), float32(15.61))
+}
+
+func TestParseError(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name   string
+		query  string
+		offset int
+		term   string
+	}{
+		{"unknown_field", "brand:Apple colour:red", 12, "colour:red"},
+		{"missing_operator", "ram>=8GB apple", 9, "apple"},
+		{"missing_value", "price<", 0, "price<"},
+		{"invalid_number", "ram>=8GB  price<cheap", 10, "price<cheap"},
+		{"invalid_size", "ram>=16", 0, "ram>=16"},
+		{"size_too_large", "price<2000 ram>4000000000TB", 11, "ram>4000000000TB"},
+		{"unsupported_operator", "cores<4", 0, "cores<4"},
+		{"unknown_panel", "panel:IPS,CRT", 0, "panel:IPS,CRT"},
+		{"invalid_resolution", "resolution>=fullhd", 0, "resolution>=fullhd"},
+		{"zero_max_price", "price<=0", 0, "price<=0"},
+		{"zero_price", "brand:Apple price=0", 12, "price=0"},
+		{"below_zero_price", "price<0", 0, "price<0"},
+		{"below_zero_weight", "weight<0", 0, "weight<0"},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			filter, err := query.Parse(tc.query)
+			require.Nil(t, filter)
+
+			var queryErr *query.Error
+			require.True(t, errors.As(err, &queryErr), "unexpected error: %v", err)
+			require.Equal(t, tc.offset, queryErr.Offset)
+			require.Equal(t, tc.term, queryErr.Term)
+		})
+	}
+}
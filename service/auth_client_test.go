@@ -0,0 +1,150 @@
+package service_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/warnshun/pcbook/pb"
+	"github.com/warnshun/pcbook/service"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestClientRefreshToken(t *testing.T) {
+	t.Parallel()
+
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	serverAddress := startTestAuthServer(t, jwtManager, time.Hour)
+	authClient := newTestAuthClient(t, serverAddress)
+
+	login, err := authClient.Login(context.Background(), &pb.LoginRequest{Username: "user1", Password: "secret"})
+	require.NoError(t, err)
+	require.NotEmpty(t, login.GetRefreshToken())
+
+	refreshed, err := authClient.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: login.GetRefreshToken()})
+	require.NoError(t, err)
+	require.NotEqual(t, login.GetRefreshToken(), refreshed.GetRefreshToken())
+
+	claims, err := jwtManager.Verify(refreshed.GetAccessToken())
+	require.NoError(t, err)
+	require.Equal(t, "user1", claims.Username)
+	require.Equal(t, "user", claims.Role)
+
+	refreshed, err = authClient.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: refreshed.GetRefreshToken()})
+	require.NoError(t, err)
+
+	// another login is not affected by the reuse of a token
+	other, err := authClient.Login(context.Background(), &pb.LoginRequest{Username: "user1", Password: "secret"})
+	require.NoError(t, err)
+
+	// using a rotated token again revokes the whole login
+	_, err = authClient.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: login.GetRefreshToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = authClient.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: refreshed.GetRefreshToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = authClient.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: other.GetRefreshToken()})
+	require.NoError(t, err)
+
+	_, err = authClient.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: "unknown"})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestClientRefreshTokenRetry(t *testing.T) {
+	t.Parallel()
+
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	serverAddress := startTestAuthServer(t, jwtManager, time.Hour)
+	authClient := newTestAuthClient(t, serverAddress)
+
+	login, err := authClient.Login(context.Background(), &pb.LoginRequest{Username: "user1", Password: "secret"})
+	require.NoError(t, err)
+
+	// the response of the first rotation is lost, so the client retries with the same token
+	_, err = authClient.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: login.GetRefreshToken()})
+	require.NoError(t, err)
+	retried, err := authClient.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: login.GetRefreshToken()})
+	require.NoError(t, err)
+
+	refreshed, err := authClient.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: retried.GetRefreshToken()})
+	require.NoError(t, err)
+	refreshed, err = authClient.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: refreshed.GetRefreshToken()})
+	require.NoError(t, err)
+
+	// once the replacing token is used, using the rotated token again revokes the whole login
+	_, err = authClient.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: retried.GetRefreshToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = authClient.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: refreshed.GetRefreshToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestClientRefreshTokenExpired(t *testing.T) {
+	t.Parallel()
+
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	serverAddress := startTestAuthServer(t, jwtManager, -time.Second)
+	authClient := newTestAuthClient(t, serverAddress)
+
+	login, err := authClient.Login(context.Background(), &pb.LoginRequest{Username: "user1", Password: "secret"})
+	require.NoError(t, err)
+
+	_, err = authClient.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: login.GetRefreshToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestClientLogout(t *testing.T) {
+	t.Parallel()
+
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	serverAddress := startTestAuthServer(t, jwtManager, time.Hour)
+	authClient := newTestAuthClient(t, serverAddress)
+
+	login, err := authClient.Login(context.Background(), &pb.LoginRequest{Username: "user1", Password: "secret"})
+	require.NoError(t, err)
+
+	refreshed, err := authClient.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: login.GetRefreshToken()})
+	require.NoError(t, err)
+
+	_, err = authClient.Logout(context.Background(), &pb.LogoutRequest{RefreshToken: refreshed.GetRefreshToken()})
+	require.NoError(t, err)
+
+	_, err = authClient.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: refreshed.GetRefreshToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = authClient.Logout(context.Background(), &pb.LogoutRequest{RefreshToken: "unknown"})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+// startTestAuthServer starts an auth server knowing user1 with the password "secret",
+// its refresh tokens are valid for refreshTokenDuration
+func startTestAuthServer(t *testing.T, jwtManager *service.JWTManager, refreshTokenDuration time.Duration) string {
+	userStore := service.NewInMemoryUserStore()
+	user, err := service.NewUser("user1", "secret", "user")
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(user))
+
+	refreshTokenManager := service.NewRefreshTokenManager(service.NewInMemoryRefreshTokenStore(), refreshTokenDuration)
+	authServer := service.NewAuthServer(userStore, jwtManager, refreshTokenManager)
+
+	grpcServer := grpc.NewServer()
+	pb.RegisterAuthServiceServer(grpcServer, authServer)
+	t.Cleanup(grpcServer.Stop)
+
+	listener, err := net.Listen("tcp", ":0") // random available port
+	require.NoError(t, err)
+
+	go grpcServer.Serve(listener)
+
+	return listener.Addr().String()
+}
+
+func newTestAuthClient(t *testing.T, serverAddress string) pb.AuthServiceClient {
+	conn, err := grpc.Dial(serverAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	return pb.NewAuthServiceClient(conn)
+}
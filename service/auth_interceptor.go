@@ -34,12 +34,12 @@ func (interceptor *AuthInterceptor) Unary() grpc.UnaryServerInterceptor {
 	) (any, error) {
 		log.Println(" --> Unary Interceptor: ", info.FullMethod)
 
-		err := interceptor.authorize(ctx, info.FullMethod)
+		claims, err := interceptor.authorize(ctx, info.FullMethod)
 		if err != nil {
 			return nil, err
 		}
 
-		return handler(ctx, req)
+		return handler(ContextWithClaims(ctx, claims), req)
 	}
 }
 
@@ -53,41 +53,84 @@ func (interceptor *AuthInterceptor) Stream() grpc.StreamServerInterceptor {
 	) error {
 		log.Println(" --> Stream Interceptor: ", info.FullMethod)
 
-		err := interceptor.authorize(stream.Context(), info.FullMethod)
+		claims, err := interceptor.authorize(stream.Context(), info.FullMethod)
 		if err != nil {
 			return err
 		}
 
-		return handler(srv, stream)
+		return handler(srv, &claimsServerStream{
+			ServerStream: stream,
+			ctx:          ContextWithClaims(stream.Context(), claims),
+		})
 	}
 }
 
-// authorize checks if the access token contained in the context is valid and authorizes the user
-func (interceptor *AuthInterceptor) authorize(ctx context.Context, fullMethod string) error {
+// claimsServerStream is a server stream whose context carries the claims of the user
+type claimsServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream *claimsServerStream) Context() context.Context {
+	return stream.ctx
+}
+
+// authorize checks if the access token contained in the context is valid and authorizes the user,
+// it returns the claims of the user, nil if the method is accessible to all roles and the user sent no valid access token
+func (interceptor *AuthInterceptor) authorize(ctx context.Context, fullMethod string) (*UserClaims, error) {
 	accessibleRoles, ok := interceptor.accessibleRoles[fullMethod]
 	if !ok {
 		// full method does not exist in the accessibleRoles map
-		// this means the method is accessible to all roles
-		return nil
+		// this means the method is accessible to all roles,
+		// the claims of a valid access token are still passed to it
+		accessToken, err := ExtractAccessToken(ctx)
+		if err != nil {
+			return nil, nil
+		}
+
+		claims, err := interceptor.jwtManager.Verify(accessToken)
+		if err != nil {
+			return nil, nil
+		}
+
+		return claims, nil
 	}
 
 	accessToken, err := ExtractAccessToken(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	claims, err := interceptor.jwtManager.Verify(accessToken)
 	if err != nil {
-		return status.Errorf(codes.Unauthenticated, "invalid access token: %v", err)
+		return nil, status.Errorf(codes.Unauthenticated, "invalid access token: %v", err)
 	}
 
 	for _, role := range accessibleRoles {
 		if role == claims.Role {
-			return nil
+			return claims, nil
 		}
 	}
 
-	return status.Errorf(codes.PermissionDenied, "no permission to access this RPC")
+	return nil, status.Errorf(codes.PermissionDenied, "no permission to access this RPC")
+}
+
+// claimsKey is the context key of the claims of the authorized user
+type claimsKey struct{}
+
+// ContextWithClaims returns a copy of ctx carrying the claims of the user, ctx itself if claims is nil
+func ContextWithClaims(ctx context.Context, claims *UserClaims) context.Context {
+	if claims == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// ClaimsFromContext returns the claims of the user authorized by the interceptor, nil if there are none
+func ClaimsFromContext(ctx context.Context) *UserClaims {
+	claims, _ := ctx.Value(claimsKey{}).(*UserClaims)
+	return claims
 }
 
 // ExtractAccessToken extracts the access token from the context
@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"errors"
 
 	"github.com/warnshun/pcbook/pb"
 	"google.golang.org/grpc/codes"
@@ -11,15 +12,17 @@ import (
 // AuthServer is an authentication server
 type AuthServer struct {
 	pb.UnimplementedAuthServiceServer
-	userStore  UserStore
-	jwtManager *JWTManager
+	userStore     UserStore
+	jwtManager    *JWTManager
+	refreshTokens *RefreshTokenManager
 }
 
 // NewAuthServer creates a new auth server
-func NewAuthServer(userStore UserStore, jwtManager *JWTManager) *AuthServer {
+func NewAuthServer(userStore UserStore, jwtManager *JWTManager, refreshTokens *RefreshTokenManager) *AuthServer {
 	return &AuthServer{
-		userStore:  userStore,
-		jwtManager: jwtManager,
+		userStore:     userStore,
+		jwtManager:    jwtManager,
+		refreshTokens: refreshTokens,
 	}
 }
 
@@ -39,9 +42,64 @@ func (s *AuthServer) Login(ctx context.Context, req *pb.LoginRequest) (*pb.Login
 		return nil, status.Errorf(codes.Internal, "cannot generate access token: %v", err)
 	}
 
+	refreshToken, err := s.refreshTokens.Issue(user.Username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot issue refresh token: %v", err)
+	}
+
 	res := &pb.LoginResponse{
-		AccessToken: token,
+		AccessToken:  token,
+		RefreshToken: refreshToken,
 	}
 
 	return res, nil
 }
+
+// RefreshToken is a unary RPC to get a new access token with a refresh token,
+// the refresh token is replaced by a new one
+func (s *AuthServer) RefreshToken(ctx context.Context, req *pb.RefreshTokenRequest) (*pb.RefreshTokenResponse, error) {
+	username, refreshToken, err := s.refreshTokens.Rotate(req.GetRefreshToken())
+	if errors.Is(err, ErrInvalidRefreshToken) {
+		return nil, status.Errorf(codes.Unauthenticated, "%v", err)
+	}
+	if errors.Is(err, ErrRefreshTokenReused) {
+		return nil, status.Errorf(codes.Unauthenticated, "%v, the login is revoked", err)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot rotate refresh token: %v", err)
+	}
+
+	user, err := s.userStore.Find(username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find user: %v", err)
+	}
+	if user == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "user %s not found", username)
+	}
+
+	token, err := s.jwtManager.Generate(user)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot generate access token: %v", err)
+	}
+
+	res := &pb.RefreshTokenResponse{
+		AccessToken:  token,
+		RefreshToken: refreshToken,
+	}
+
+	return res, nil
+}
+
+// Logout is a unary RPC to revoke a refresh token and all the tokens rotated from the same login,
+// the access tokens already issued stay valid until they expire
+func (s *AuthServer) Logout(ctx context.Context, req *pb.LogoutRequest) (*pb.LogoutResponse, error) {
+	err := s.refreshTokens.Revoke(req.GetRefreshToken())
+	if errors.Is(err, ErrInvalidRefreshToken) {
+		return nil, status.Errorf(codes.Unauthenticated, "%v", err)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot revoke refresh token: %v", err)
+	}
+
+	return &pb.LogoutResponse{}, nil
+}
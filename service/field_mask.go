@@ -0,0 +1,31 @@
+package service
+
+import (
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// applyFieldMask copies the fields listed in paths from src to dst,
+// fields that are unset in src are cleared in dst
+func applyFieldMask(dst proto.Message, src proto.Message, paths []string) {
+	for _, path := range paths {
+		copyField(dst.ProtoReflect(), src.ProtoReflect(), strings.Split(path, "."))
+	}
+}
+
+func copyField(dst protoreflect.Message, src protoreflect.Message, names []string) {
+	field := dst.Descriptor().Fields().ByName(protoreflect.Name(names[0]))
+
+	if len(names) == 1 {
+		if src.Has(field) {
+			dst.Set(field, src.Get(field))
+		} else {
+			dst.Clear(field)
+		}
+		return
+	}
+
+	copyField(dst.Mutable(field).Message(), src.Get(field).Message(), names[1:])
+}
@@ -0,0 +1,436 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+// imageIndex is the in-memory index of the images of a store and of their blobs,
+// it implements the ImageStore methods that only change the metadata of the images on top of an imageBackend
+type imageIndex struct {
+	mutex        sync.RWMutex
+	images       map[string]*ImageInfo
+	laptopImages map[string][]string
+	blobs        map[string]*imageBlob
+	// blobMutex serializes the changes of the images and of the references to the blobs,
+	// it is locked before mutex, which is only held while the maps change
+	blobMutex sync.Mutex
+	// checksumMutex serializes the creation and the removal of the files of the blobs with the same checksum,
+	// which happen without the blob lock. It is locked before blobMutex
+	checksumMutex keyedMutex
+	backend       imageBackend
+}
+
+// imageBackend stores the metadata and the blobs of the images of an imageIndex
+type imageBackend interface {
+	// writeImageMetadata saves the metadata of an image
+	writeImageMetadata(info *ImageInfo) error
+	// removeImageMetadata removes the metadata of an image
+	removeImageMetadata(imageId string) error
+	// removeBlob removes the data, the variants and the metadata of a blob
+	removeBlob(blob *imageBlob)
+}
+
+func (index *imageIndex) init(backend imageBackend) {
+	index.images = make(map[string]*ImageInfo)
+	index.laptopImages = make(map[string][]string)
+	index.blobs = make(map[string]*imageBlob)
+	index.backend = backend
+}
+
+// load indexes the images of a store in display order, then upload order,
+// blob returns the blob of an image
+func (index *imageIndex) load(images []*ImageInfo, blob func(info *ImageInfo) *imageBlob) {
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Position != images[j].Position {
+			return images[i].Position < images[j].Position
+		}
+		if images[i].UploadedAt.Equal(images[j].UploadedAt) {
+			return images[i].Id < images[j].Id
+		}
+		return images[i].UploadedAt.Before(images[j].UploadedAt)
+	})
+
+	for _, info := range images {
+		blob(info).refs++
+
+		index.images[info.Id] = info
+		index.laptopImages[info.LaptopId] = append(index.laptopImages[info.LaptopId], info.Id)
+	}
+
+	// a laptop has one primary image, the first one flagged if a change was interrupted,
+	// or its first image if none is flagged
+	for _, imageIds := range index.laptopImages {
+		primary := ""
+		for _, imageId := range imageIds {
+			if index.images[imageId].Primary && primary == "" {
+				primary = imageId
+			}
+		}
+		if primary == "" {
+			primary = imageIds[0]
+		}
+
+		for _, imageId := range imageIds {
+			index.images[imageId].Primary = imageId == primary
+		}
+	}
+}
+
+// findBlob returns the blob with the given checksum, nil if there is none
+func (index *imageIndex) findBlob(checksum string) *imageBlob {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	return index.blobs[checksum]
+}
+
+// addBlobRef adds a reference to a blob, replacing the blob indexed with the same checksum.
+// The caller must hold the blob lock
+func (index *imageIndex) addBlobRef(blob *imageBlob) *imageBlob {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	if current := index.blobs[blob.Checksum]; current != nil {
+		blob.refs = current.refs
+	}
+	blob.refs++
+	index.blobs[blob.Checksum] = blob
+
+	return blob
+}
+
+// releaseBlob removes a reference to a blob, and the blob from the index with the last one,
+// in which case it returns true and the caller removes its files with removeUnusedBlob.
+// The caller must hold the blob lock
+func (index *imageIndex) releaseBlob(blob *imageBlob) bool {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	blob.refs--
+	last := blob.refs <= 0
+	if last {
+		delete(index.blobs, blob.Checksum)
+	}
+
+	return last
+}
+
+// removeUnusedBlob removes the files of a released blob unless an image references its checksum again.
+// The caller must hold the lock of the checksum but not the blob lock, so that a slow removal blocks nothing else
+func (index *imageIndex) removeUnusedBlob(blob *imageBlob) {
+	if index.findBlob(blob.Checksum) == nil {
+		index.backend.removeBlob(blob)
+	}
+}
+
+// removeUnusedBlobs locks the checksum of each released blob and removes its files if it is still unused,
+// the caller must not hold the blob lock
+func (index *imageIndex) removeUnusedBlobs(blobs []*imageBlob) {
+	for _, blob := range blobs {
+		unlock := index.checksumMutex.Lock(blob.Checksum)
+		index.removeUnusedBlob(blob)
+		unlock()
+	}
+}
+
+// add saves the metadata of a new image of a laptop and indexes it,
+// the image comes last and is the primary image if it is the first one.
+// The caller must hold the blob lock and have added a reference to the blob of the image,
+// which is released if the image cannot be saved
+func (index *imageIndex) add(info *ImageInfo, blob *imageBlob) error {
+	// the same data is always detected as the same type
+	info.Type = blob.Type
+	info.MimeType = blob.MimeType
+
+	index.mutex.RLock()
+	if imageIds := index.laptopImages[info.LaptopId]; len(imageIds) > 0 {
+		info.Position = index.images[imageIds[len(imageIds)-1]].Position + 1
+	} else {
+		info.Primary = true
+	}
+	index.mutex.RUnlock()
+
+	err := index.backend.writeImageMetadata(info)
+	if err != nil {
+		index.releaseBlob(blob)
+		return err
+	}
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	index.images[info.Id] = info
+	index.laptopImages[info.LaptopId] = append(index.laptopImages[info.LaptopId], info.Id)
+
+	return nil
+}
+
+// view returns a copy of an image with the info of its blob, the caller must hold the lock
+func (index *imageIndex) view(info *ImageInfo) *ImageInfo {
+	other := *info
+
+	blob := index.blobs[info.Checksum]
+	other.Path = blob.Path
+	other.Width = blob.Width
+	other.Height = blob.Height
+
+	if blob.Variants != nil {
+		other.Variants = make(map[string]*ImageVariantInfo, len(blob.Variants))
+		for name, variant := range blob.Variants {
+			copied := *variant
+			other.Variants[name] = &copied
+		}
+	}
+
+	return &other
+}
+
+// Find finds an image by ID
+func (index *imageIndex) Find(imageId string) (*ImageInfo, error) {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	info := index.images[imageId]
+	if info == nil {
+		return nil, nil
+	}
+
+	return index.view(info), nil
+}
+
+// ListByLaptop lists the images of a laptop in display order
+func (index *imageIndex) ListByLaptop(laptopId string) ([]*ImageInfo, error) {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	imageIds := index.laptopImages[laptopId]
+	images := make([]*ImageInfo, 0, len(imageIds))
+	for _, imageId := range imageIds {
+		images = append(images, index.view(index.images[imageId]))
+	}
+
+	return images, nil
+}
+
+// Delete deletes an image, and its blob if no other image has the same data
+func (index *imageIndex) Delete(imageId string) error {
+	index.blobMutex.Lock()
+	released, err := index.delete(imageId)
+	index.blobMutex.Unlock()
+
+	if released != nil {
+		index.removeUnusedBlobs([]*imageBlob{released})
+	}
+
+	return err
+}
+
+// delete deletes an image and returns its blob if it was the last image referencing it,
+// for the caller to remove once it releases the blob lock, which it must hold
+func (index *imageIndex) delete(imageId string) (*imageBlob, error) {
+	index.mutex.RLock()
+	info := index.images[imageId]
+	index.mutex.RUnlock()
+
+	if info == nil {
+		return nil, ErrNotFound
+	}
+
+	err := index.backend.removeImageMetadata(imageId)
+	if err != nil {
+		return nil, err
+	}
+
+	index.mutex.Lock()
+	index.remove(imageId)
+	blob := index.blobs[info.Checksum]
+	imageIds := index.laptopImages[info.LaptopId]
+	index.mutex.Unlock()
+
+	var released *imageBlob
+	if index.releaseBlob(blob) {
+		released = blob
+	}
+
+	// the image was deleted even if the next primary image cannot be saved,
+	// it is chosen again on startup
+	if info.Primary && len(imageIds) > 0 {
+		err := index.updateImage(imageIds[0], func(next *ImageInfo) {
+			next.Primary = true
+		})
+		if err != nil {
+			log.Printf("cannot make image %s primary: %v", imageIds[0], err)
+		}
+	}
+
+	return released, nil
+}
+
+// DeleteByLaptop deletes all the images of a laptop
+func (index *imageIndex) DeleteByLaptop(laptopId string) error {
+	var released []*imageBlob
+	defer func() {
+		index.removeUnusedBlobs(released)
+	}()
+
+	index.blobMutex.Lock()
+	defer index.blobMutex.Unlock()
+
+	// the primary image is deleted last so that no other image becomes primary
+	var imageIds []string
+	primary := ""
+	index.mutex.RLock()
+	for _, imageId := range index.laptopImages[laptopId] {
+		if index.images[imageId].Primary {
+			primary = imageId
+		} else {
+			imageIds = append(imageIds, imageId)
+		}
+	}
+	index.mutex.RUnlock()
+
+	if primary != "" {
+		imageIds = append(imageIds, primary)
+	}
+
+	for _, imageId := range imageIds {
+		blob, err := index.delete(imageId)
+		if err != nil {
+			return err
+		}
+		if blob != nil {
+			released = append(released, blob)
+		}
+	}
+
+	return nil
+}
+
+// SetPrimary makes an image the primary image of its laptop
+func (index *imageIndex) SetPrimary(imageId string) error {
+	index.blobMutex.Lock()
+	defer index.blobMutex.Unlock()
+
+	index.mutex.RLock()
+	info := index.images[imageId]
+	var imageIds []string
+	if info != nil {
+		imageIds = append(imageIds, index.laptopImages[info.LaptopId]...)
+	}
+	index.mutex.RUnlock()
+
+	if info == nil {
+		return ErrNotFound
+	}
+
+	// the new primary image is saved first, the first one flagged is kept on startup
+	err := index.updateImage(imageId, func(primary *ImageInfo) {
+		primary.Primary = true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range imageIds {
+		if id == imageId {
+			continue
+		}
+
+		err := index.updateImage(id, func(other *ImageInfo) {
+			other.Primary = false
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reorder changes the display order of the images of a laptop,
+// imageIds must list all of them
+func (index *imageIndex) Reorder(laptopId string, imageIds []string) error {
+	index.blobMutex.Lock()
+	defer index.blobMutex.Unlock()
+
+	index.mutex.RLock()
+	current := index.laptopImages[laptopId]
+	index.mutex.RUnlock()
+
+	if len(imageIds) != len(current) {
+		return fmt.Errorf("%w: got %d images instead of %d", ErrInvalidImageOrder, len(imageIds), len(current))
+	}
+
+	listed := make(map[string]bool)
+	for _, imageId := range current {
+		listed[imageId] = false
+	}
+	for _, imageId := range imageIds {
+		seen, ok := listed[imageId]
+		if !ok || seen {
+			return fmt.Errorf("%w: unexpected image %s", ErrInvalidImageOrder, imageId)
+		}
+		listed[imageId] = true
+	}
+
+	for position, imageId := range imageIds {
+		err := index.updateImage(imageId, func(info *ImageInfo) {
+			info.Position = position
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	index.laptopImages[laptopId] = append([]string(nil), imageIds...)
+
+	return nil
+}
+
+// updateImage changes an image and saves its metadata, the caller must hold the blob lock
+func (index *imageIndex) updateImage(imageId string, update func(info *ImageInfo)) error {
+	index.mutex.RLock()
+	info := *index.images[imageId]
+	index.mutex.RUnlock()
+
+	update(&info)
+
+	err := index.backend.writeImageMetadata(&info)
+	if err != nil {
+		return err
+	}
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	index.images[imageId] = &info
+
+	return nil
+}
+
+// remove removes an image from the index, the caller must hold the lock
+func (index *imageIndex) remove(imageId string) {
+	info := index.images[imageId]
+	if info == nil {
+		return
+	}
+
+	delete(index.images, imageId)
+
+	imageIds := index.laptopImages[info.LaptopId]
+	for i, id := range imageIds {
+		if id == imageId {
+			index.laptopImages[info.LaptopId] = append(imageIds[:i], imageIds[i+1:]...)
+			break
+		}
+	}
+	if len(index.laptopImages[info.LaptopId]) == 0 {
+		delete(index.laptopImages, info.LaptopId)
+	}
+}
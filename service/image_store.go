@@ -1,69 +1,658 @@
 package service
 
 import (
-	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
-	"sync"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+// ErrInvalidImageOrder error
+var ErrInvalidImageOrder = errors.New("image order must list every image of the laptop once")
+
+// imageMetadataSuffix is the suffix of the files storing the metadata of the images and blobs
+const imageMetadataSuffix = ".meta.json"
+
 // ImageStore is an interface for store laptop images
 type ImageStore interface {
-	// Save saves the laptop images
-	Save(laptopId string, imageType string, imageData bytes.Buffer) (string, error)
+	// Save saves the laptop image of the given MIME type read from imageData
+	Save(laptopId string, mimeType string, imageData io.Reader) (string, error)
+	// Find finds an image by ID
+	Find(imageId string) (*ImageInfo, error)
+	// ListByLaptop lists the images of a laptop in display order
+	ListByLaptop(laptopId string) ([]*ImageInfo, error)
+	// Open opens the data of an image, or of one of its variants, for reading
+	Open(imageId string, variant string) (io.ReadCloser, error)
+	// Delete deletes an image
+	Delete(imageId string) error
+	// DeleteByLaptop deletes all the images of a laptop
+	DeleteByLaptop(laptopId string) error
+	// SetPrimary makes an image the primary image of its laptop
+	SetPrimary(imageId string) error
+	// Reorder changes the display order of the images of a laptop
+	Reorder(laptopId string, imageIds []string) error
 }
 
-// DiskImageStore stores images on the disk and its info in memory
+// DiskImageStore stores images on the disk, each with a metadata file
+// from which its info is loaded in memory on startup.
+// The data of the images is stored once per content in blob files named by their checksum,
+// which are removed when the last image referencing them is deleted
 type DiskImageStore struct {
-	mutex       sync.RWMutex
+	imageIndex
 	imageFolder string
-	images      map[string]*ImageInfo
+	resizer     *imageResizer
+}
+
+// ImageStoreOption configures an image store
+type ImageStoreOption func(options *imageStoreOptions)
+
+type imageStoreOptions struct {
+	variants  []ImageVariant
+	maxPixels int64
+}
+
+// WithImageVariants sets the resized variants generated for each saved image,
+// DefaultImageVariants are generated otherwise
+func WithImageVariants(variants ...ImageVariant) ImageStoreOption {
+	return func(options *imageStoreOptions) {
+		options.variants = variants
+	}
+}
+
+// WithMaxImagePixels sets the maximum number of pixels of the images decoded to generate their variants,
+// the larger images get no variants. It must be positive, the default is 16 million pixels
+func WithMaxImagePixels(maxPixels int64) ImageStoreOption {
+	return func(options *imageStoreOptions) {
+		options.maxPixels = maxPixels
+	}
+}
+
+func newImageStoreOptions(opts []ImageStoreOption) *imageStoreOptions {
+	options := &imageStoreOptions{
+		variants:  DefaultImageVariants,
+		maxPixels: maxImagePixels,
+	}
+
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	return options
 }
 
 // ImageInfo contains information about the laptop image
 type ImageInfo struct {
-	LaptopId string
-	Type     string
-	Path     string
+	Id         string    `json:"id"`
+	LaptopId   string    `json:"laptop_id"`
+	Type       string    `json:"type"`
+	MimeType   string    `json:"mime_type"`
+	Size       int64     `json:"size"`
+	Checksum   string    `json:"checksum"`
+	UploadedAt time.Time `json:"uploaded_at"`
+	// Position is the rank of the image in the display order of the laptop images
+	Position int `json:"position"`
+	// Primary is true for the main image of the laptop, the first one unless another is chosen
+	Primary bool `json:"primary"`
+	// Path, Width, Height and Variants are those of the blob of the image
+	Path     string                       `json:"-"`
+	Width    int                          `json:"-"`
+	Height   int                          `json:"-"`
+	Variants map[string]*ImageVariantInfo `json:"-"`
+}
+
+// ImageVariantInfo contains information about a resized copy of a laptop image
+type ImageVariantInfo struct {
+	Type     string `json:"type"`
+	MimeType string `json:"mime_type"`
+	Path     string `json:"-"`
+	Size     int64  `json:"size"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+}
+
+// imageBlob is the data of the images with the same checksum
+type imageBlob struct {
+	Checksum string                       `json:"checksum"`
+	Type     string                       `json:"type"`
+	MimeType string                       `json:"mime_type"`
+	Size     int64                        `json:"size"`
+	Width    int                          `json:"width,omitempty"`
+	Height   int                          `json:"height,omitempty"`
+	Variants map[string]*ImageVariantInfo `json:"variants,omitempty"`
+	Path     string                       `json:"-"`
+	// refs is the number of images referencing the blob
+	refs int
 }
 
-// NewDiskImageStore returns a new DiskImageStore
-func NewDiskImageStore(imageFolder string) *DiskImageStore {
-	return &DiskImageStore{
+// files returns the names of the files of the blob in the blob folder
+func (blob *imageBlob) files() []string {
+	files := []string{filepath.Base(blob.Path), blob.Checksum + imageMetadataSuffix}
+	for _, variant := range blob.Variants {
+		files = append(files, filepath.Base(variant.Path))
+	}
+
+	return files
+}
+
+// ImageIndexReport lists the inconsistencies between the image folder and its index
+type ImageIndexReport struct {
+	// Orphans are the files of the folder that belong to no indexed image,
+	// relative to the folder
+	Orphans []string
+	// Dangling are the indexed images whose file is missing
+	Dangling []*ImageInfo
+}
+
+// Clean returns true if nothing is inconsistent
+func (report *ImageIndexReport) Clean() bool {
+	return len(report.Orphans) == 0 && len(report.Dangling) == 0
+}
+
+// NewDiskImageStore returns a new DiskImageStore,
+// rebuilding the index of the images already saved in the folder
+func NewDiskImageStore(imageFolder string, opts ...ImageStoreOption) (*DiskImageStore, error) {
+	store := &DiskImageStore{
 		imageFolder: imageFolder,
-		images:      make(map[string]*ImageInfo),
+		resizer:     newImageResizer(newImageStoreOptions(opts)),
+	}
+	store.init(store)
+
+	err := os.MkdirAll(store.blobFolder(), 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create image folder: %w", err)
+	}
+
+	// remove the images whose save was interrupted
+	err = os.RemoveAll(store.tempFolder())
+	if err != nil {
+		return nil, fmt.Errorf("cannot clean temporary image folder: %w", err)
+	}
+
+	err = os.Mkdir(store.tempFolder(), 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create temporary image folder: %w", err)
+	}
+
+	err = store.loadBlobs()
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.loadImages()
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// readMetadata reads the JSON metadata files of a folder, the unreadable ones are skipped
+// so that the store still starts, they are orphans removed by Repair
+func readMetadata(folder string, read func(data []byte) error) error {
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return fmt.Errorf("cannot read image folder: %w", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), imageMetadataSuffix) {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(folder, entry.Name()))
+		if err != nil {
+			log.Printf("skipping image metadata %s: cannot read it: %v", entry.Name(), err)
+			continue
+		}
+
+		err = read(data)
+		if err != nil {
+			log.Printf("skipping image metadata %s: cannot parse it: %v", entry.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// loadBlobs reads the metadata files of the blob folder
+func (s *DiskImageStore) loadBlobs() error {
+	return readMetadata(s.blobFolder(), func(data []byte) error {
+		blob := &imageBlob{}
+		err := json.Unmarshal(data, blob)
+		if err != nil {
+			return err
+		}
+
+		s.setBlobPaths(blob)
+		s.blobs[blob.Checksum] = blob
+		return nil
+	})
+}
+
+// loadImages reads the metadata files of the images into the index
+func (s *DiskImageStore) loadImages() error {
+	var images []*ImageInfo
+	err := readMetadata(s.imageFolder, func(data []byte) error {
+		info := &ImageInfo{}
+		err := json.Unmarshal(data, info)
+		if err != nil {
+			return err
+		}
+
+		images = append(images, info)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
+
+	s.load(images, func(info *ImageInfo) *imageBlob {
+		blob := s.blobs[info.Checksum]
+		if blob == nil {
+			// the blob of an image always has metadata unless the folder was changed by hand,
+			// the image is indexed without files and reported as dangling by Check
+			log.Printf("no metadata for the blob of image %s", info.Id)
+			blob = &imageBlob{
+				Checksum: info.Checksum,
+				Type:     info.Type,
+				MimeType: info.MimeType,
+				Size:     info.Size,
+			}
+			s.setBlobPaths(blob)
+			s.blobs[blob.Checksum] = blob
+		}
+
+		return blob
+	})
+
+	return nil
 }
 
-// Save saves a new laptop image to the store
-func (s *DiskImageStore) Save(laptopId string, imageType string, imageData bytes.Buffer) (string, error) {
+// blobFolder is the folder of the blob files
+func (s *DiskImageStore) blobFolder() string {
+	return filepath.Join(s.imageFolder, "blobs")
+}
+
+// tempFolder is the folder of the images being saved, it is emptied on startup
+func (s *DiskImageStore) tempFolder() string {
+	return filepath.Join(s.imageFolder, ".tmp")
+}
+
+func (s *DiskImageStore) setBlobPaths(blob *imageBlob) {
+	blob.Path = fmt.Sprintf("%s/%s%s", s.blobFolder(), blob.Checksum, blob.Type)
+	for name, variant := range blob.Variants {
+		variant.Path = fmt.Sprintf("%s/%s_%s%s", s.blobFolder(), blob.Checksum, name, variant.Type)
+	}
+}
+
+func (s *DiskImageStore) metadataPath(imageId string) string {
+	return fmt.Sprintf("%s/%s%s", s.imageFolder, imageId, imageMetadataSuffix)
+}
+
+func (s *DiskImageStore) blobMetadataPath(checksum string) string {
+	return fmt.Sprintf("%s/%s%s", s.blobFolder(), checksum, imageMetadataSuffix)
+}
+
+// Save saves a new laptop image read from imageData to the store,
+// the data is streamed to a temporary file renamed once complete, so that a failed save leaves nothing behind.
+// The file extension is that of the MIME type so that nothing from the client ends up in the path
+func (s *DiskImageStore) Save(laptopId string, mimeType string, imageData io.Reader) (string, error) {
+	imageType, err := imageExtension(mimeType)
+	if err != nil {
+		return "", err
+	}
+
 	imageId, err := uuid.NewRandom()
 	if err != nil {
 		return "", fmt.Errorf("cannot generate image id: %w", err)
 	}
 
-	imagePath := fmt.Sprintf("%s/%s%s", s.imageFolder, imageId, imageType)
-
-	file, err := os.Create(imagePath)
+	file, err := os.CreateTemp(s.tempFolder(), "image-*")
 	if err != nil {
 		return "", fmt.Errorf("cannot create image file: %w", err)
 	}
+	defer os.Remove(file.Name())
+	defer file.Close()
 
-	_, err = imageData.WriteTo(file)
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), imageData)
 	if err != nil {
 		return "", fmt.Errorf("cannot write image to file: %w", err)
 	}
 
+	err = file.Close()
+	if err != nil {
+		return "", fmt.Errorf("cannot write image to file: %w", err)
+	}
+
+	info := &ImageInfo{
+		Id:         imageId.String(),
+		LaptopId:   laptopId,
+		Type:       imageType,
+		MimeType:   mimeType,
+		Size:       size,
+		Checksum:   hex.EncodeToString(hash.Sum(nil)),
+		UploadedAt: time.Now().UTC(),
+	}
+
+	// the variants of a new blob are generated before taking the blob lock, in a folder of their own,
+	// and the lock of the checksum keeps its files from being removed until the blob is indexed
+	stagingFolder, err := os.MkdirTemp(s.tempFolder(), "blob-*")
+	if err != nil {
+		return "", fmt.Errorf("cannot create image folder: %w", err)
+	}
+	defer os.RemoveAll(stagingFolder)
+
+	unlock := s.checksumMutex.Lock(info.Checksum)
+	defer unlock()
+
+	var staged *imageBlob
+	if blob := s.findBlob(info.Checksum); blob == nil || !fileExists(blob.Path) {
+		staged = s.stageBlob(info, file.Name(), stagingFolder)
+	}
+
+	s.blobMutex.Lock()
+	blob, err := s.addBlob(info, file.Name(), staged, stagingFolder)
+	if err == nil {
+		err = s.add(info, blob)
+	}
+	s.blobMutex.Unlock()
+
+	if err != nil {
+		// the blob is released if the image cannot be saved
+		if blob != nil {
+			s.removeUnusedBlob(blob)
+		}
+		return "", err
+	}
+
+	return info.Id, nil
+}
+
+// stageBlob returns a new blob of the image data written in dataPath, with its variants saved in stagingFolder
+func (s *DiskImageStore) stageBlob(info *ImageInfo, dataPath string, stagingFolder string) *imageBlob {
+	blob := &imageBlob{
+		Checksum: info.Checksum,
+		Type:     info.Type,
+		MimeType: info.MimeType,
+		Size:     info.Size,
+	}
+	s.saveVariants(blob, dataPath, stagingFolder)
+
+	return blob
+}
+
+// addBlob adds a reference to the blob of the image data written in dataPath,
+// creating the blob from staged if no image has the same data yet, or from a blob staged now if staged is nil.
+// The caller must hold the blob lock
+func (s *DiskImageStore) addBlob(info *ImageInfo, dataPath string, staged *imageBlob, stagingFolder string) (*imageBlob, error) {
+	blob := s.findBlob(info.Checksum)
+
+	// a blob without file is that of a missing image, its file is created again
+	if blob == nil || !fileExists(blob.Path) {
+		// the blob was removed since it was looked up
+		if staged == nil {
+			staged = s.stageBlob(info, dataPath, stagingFolder)
+		}
+		blob = staged
+
+		err := s.moveBlob(blob, dataPath)
+		if err != nil {
+			s.removeBlob(blob)
+			return nil, err
+		}
+
+		err = s.writeMetadata(s.blobMetadataPath(blob.Checksum), blob)
+		if err != nil {
+			s.removeBlob(blob)
+			return nil, err
+		}
+	}
+
+	return s.addBlobRef(blob), nil
+}
+
+// moveBlob moves the image data written in dataPath and the staged variants of a blob to the blob folder,
+// the variants that cannot be moved are dropped
+func (s *DiskImageStore) moveBlob(blob *imageBlob, dataPath string) error {
+	stagedPaths := make(map[string]string, len(blob.Variants))
+	for name, variant := range blob.Variants {
+		stagedPaths[name] = variant.Path
+	}
+	s.setBlobPaths(blob)
+
+	err := os.Rename(dataPath, blob.Path)
+	if err != nil {
+		return fmt.Errorf("cannot move image file: %w", err)
+	}
+
+	for name, variant := range blob.Variants {
+		err := os.Rename(stagedPaths[name], variant.Path)
+		if err != nil {
+			log.Printf("cannot move %s variant of blob %s: %v", name, blob.Checksum, err)
+			delete(blob.Variants, name)
+		}
+	}
+
+	return nil
+}
+
+// removeBlob removes the files of a blob, the caller must hold the lock of its checksum
+func (s *DiskImageStore) removeBlob(blob *imageBlob) {
+	for _, file := range blob.files() {
+		err := os.Remove(filepath.Join(s.blobFolder(), file))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("cannot remove file of blob %s: %v", blob.Checksum, err)
+		}
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// saveVariants saves the resized variants of a blob from the image data in dataPath to folder
+func (s *DiskImageStore) saveVariants(blob *imageBlob, dataPath string, folder string) {
+	s.resizer.resizeVariants(blob, dataPath, func(name string, variant *ImageVariantInfo, data []byte) (string, error) {
+		variantPath := fmt.Sprintf("%s/%s_%s%s", folder, blob.Checksum, name, variant.Type)
+		err := os.WriteFile(variantPath, data, 0o644)
+		if err != nil {
+			os.Remove(variantPath)
+			return "", err
+		}
+
+		return variantPath, nil
+	})
+}
+
+// writeMetadata writes a metadata file,
+// through a temporary file so that a crash never leaves it half written
+func (s *DiskImageStore) writeMetadata(metadataPath string, metadata any) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("cannot marshal image metadata: %w", err)
+	}
+
+	tempPath := metadataPath + ".tmp"
+
+	err = os.WriteFile(tempPath, data, 0o644)
+	if err != nil {
+		return fmt.Errorf("cannot write image metadata: %w", err)
+	}
+
+	err = os.Rename(tempPath, metadataPath)
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("cannot write image metadata: %w", err)
+	}
+
+	return nil
+}
+
+// writeImageMetadata saves the metadata file of an image
+func (s *DiskImageStore) writeImageMetadata(info *ImageInfo) error {
+	return s.writeMetadata(s.metadataPath(info.Id), info)
+}
+
+// removeImageMetadata removes the metadata file of an image
+func (s *DiskImageStore) removeImageMetadata(imageId string) error {
+	err := os.Remove(s.metadataPath(imageId))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("cannot remove image metadata: %w", err)
+	}
+
+	return nil
+}
+
+// Open opens the data of an image for reading, or of its variant if not empty
+func (s *DiskImageStore) Open(imageId string, variant string) (io.ReadCloser, error) {
+	info, err := s.Find(imageId)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, ErrNotFound
+	}
+
+	path := info.Path
+	if variant != "" {
+		variantInfo := info.Variants[variant]
+		if variantInfo == nil {
+			return nil, ErrNotFound
+		}
+		path = variantInfo.Path
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open image file: %w", err)
+	}
+
+	return file, nil
+}
+
+// Check compares the image folder with the index
+func (s *DiskImageStore) Check() (*ImageIndexReport, error) {
+	s.blobMutex.Lock()
+	defer s.blobMutex.Unlock()
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.check()
+}
+
+// Repair deletes the orphan files of the image folder and removes the dangling images from the index,
+// it returns what was repaired
+func (s *DiskImageStore) Repair() (*ImageIndexReport, error) {
+	var released []*imageBlob
+	defer func() {
+		s.removeUnusedBlobs(released)
+	}()
+
+	s.blobMutex.Lock()
+	defer s.blobMutex.Unlock()
+
+	s.mutex.RLock()
+	report, err := s.check()
+	s.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, orphan := range report.Orphans {
+		err := os.Remove(filepath.Join(s.imageFolder, orphan))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("cannot remove orphan file: %w", err)
+		}
+	}
+
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	for checksum, blob := range s.blobs {
+		if blob.refs <= 0 {
+			delete(s.blobs, checksum)
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, info := range report.Dangling {
+		blob, err := s.delete(info.Id)
+		if err != nil {
+			return nil, err
+		}
+		if blob != nil {
+			released = append(released, blob)
+		}
+	}
+
+	return report, nil
+}
+
+// check lists the orphans and dangling images, the caller must hold the locks
+func (s *DiskImageStore) check() (*ImageIndexReport, error) {
+	report := &ImageIndexReport{}
+
+	// the image folder only contains the metadata of the indexed images,
+	// the metadata that could not be loaded is an orphan too
+	entries, err := os.ReadDir(s.imageFolder)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read image folder: %w", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
 
-	s.images[imageId.String()] = &ImageInfo{
-		LaptopId: laptopId,
-		Type:     imageType,
-		Path:     imagePath,
+		imageId, ok := strings.CutSuffix(entry.Name(), imageMetadataSuffix)
+		if !ok || s.images[imageId] == nil {
+			report.Orphans = append(report.Orphans, entry.Name())
+		}
 	}
 
-	return imageId.String(), nil
+	indexed := make(map[string]bool)
+	for _, blob := range s.blobs {
+		if blob.refs > 0 {
+			for _, file := range blob.files() {
+				indexed[file] = true
+			}
+		}
+	}
+
+	entries, err = os.ReadDir(s.blobFolder())
+	if err != nil {
+		return nil, fmt.Errorf("cannot read blob folder: %w", err)
+	}
+
+	files := make(map[string]bool)
+	for _, entry := range entries {
+		files[entry.Name()] = true
+
+		if !indexed[entry.Name()] {
+			report.Orphans = append(report.Orphans, filepath.Join(filepath.Base(s.blobFolder()), entry.Name()))
+		}
+	}
+
+	for _, info := range s.images {
+		if !files[filepath.Base(s.blobs[info.Checksum].Path)] {
+			report.Dangling = append(report.Dangling, s.view(info))
+		}
+	}
+
+	sort.Slice(report.Dangling, func(i, j int) bool {
+		return report.Dangling[i].Id < report.Dangling[j].Id
+	})
+
+	return report, nil
 }
@@ -0,0 +1,375 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// s3ImagePrefix is the prefix of the keys of the image metadata objects
+	s3ImagePrefix = "images/"
+	// s3BlobPrefix is the prefix of the keys of the blob objects
+	s3BlobPrefix = "blobs/"
+	// s3MetadataTimeout bounds the requests on the metadata objects and the deletes,
+	// which are sent while holding the blob lock or on startup
+	s3MetadataTimeout = s3ResponseTimeout
+)
+
+// S3ImageStore stores images in a bucket of an S3-compatible object store,
+// laid out like the folder of DiskImageStore: each image has a metadata object,
+// and the data of the images is stored once per content in blob objects named by their checksum.
+// The index of the images is loaded in memory on startup, so the bucket must not be shared with another store
+type S3ImageStore struct {
+	imageIndex
+	client  *s3Client
+	resizer *imageResizer
+}
+
+// NewS3ImageStore returns a new S3ImageStore,
+// rebuilding the index of the images already saved in the bucket
+func NewS3ImageStore(config S3Config, opts ...ImageStoreOption) (*S3ImageStore, error) {
+	client, err := newS3Client(config)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &S3ImageStore{
+		client:  client,
+		resizer: newImageResizer(newImageStoreOptions(opts)),
+	}
+	store.init(store)
+
+	err = store.loadBlobs()
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.loadImages()
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// readObjectMetadata reads the JSON metadata objects whose key starts with prefix, the unreadable ones are skipped
+func (s *S3ImageStore) readObjectMetadata(prefix string, read func(data []byte) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s3MetadataTimeout)
+	keys, err := s.client.listObjects(ctx, prefix)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("cannot list image objects: %w", err)
+	}
+
+	for _, key := range keys {
+		if !strings.HasSuffix(key, imageMetadataSuffix) {
+			continue
+		}
+
+		// an unreadable or corrupt object is skipped so that the store still starts
+		data, err := s.getMetadata(key)
+		if err != nil {
+			log.Printf("skipping image metadata %s: cannot read it: %v", key, err)
+			continue
+		}
+
+		err = read(data)
+		if err != nil {
+			log.Printf("skipping image metadata %s: cannot parse it: %v", key, err)
+		}
+	}
+
+	return nil
+}
+
+// loadBlobs reads the metadata objects of the blobs
+func (s *S3ImageStore) loadBlobs() error {
+	return s.readObjectMetadata(s3BlobPrefix, func(data []byte) error {
+		blob := &imageBlob{}
+		err := json.Unmarshal(data, blob)
+		if err != nil {
+			return err
+		}
+
+		s.setBlobKeys(blob)
+		s.blobs[blob.Checksum] = blob
+		return nil
+	})
+}
+
+// loadImages reads the metadata objects of the images into the index,
+// and removes the blobs of the saves that were interrupted
+func (s *S3ImageStore) loadImages() error {
+	var images []*ImageInfo
+	err := s.readObjectMetadata(s3ImagePrefix, func(data []byte) error {
+		info := &ImageInfo{}
+		err := json.Unmarshal(data, info)
+		if err != nil {
+			return err
+		}
+
+		images = append(images, info)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.load(images, func(info *ImageInfo) *imageBlob {
+		blob := s.blobs[info.Checksum]
+		if blob == nil {
+			// the blob of an image always has metadata unless the bucket was changed by hand,
+			// the image is kept in case its data is still there
+			log.Printf("no metadata for the blob of image %s", info.Id)
+			blob = &imageBlob{
+				Checksum: info.Checksum,
+				Type:     info.Type,
+				MimeType: info.MimeType,
+				Size:     info.Size,
+			}
+			s.setBlobKeys(blob)
+			s.blobs[blob.Checksum] = blob
+		}
+
+		return blob
+	})
+
+	for checksum, blob := range s.blobs {
+		if blob.refs == 0 {
+			delete(s.blobs, checksum)
+			s.removeBlob(blob)
+		}
+	}
+
+	return nil
+}
+
+// getMetadata downloads a metadata object
+func (s *S3ImageStore) getMetadata(key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s3MetadataTimeout)
+	defer cancel()
+
+	return s.client.getBytes(ctx, key)
+}
+
+// putMetadata uploads a metadata object
+func (s *S3ImageStore) putMetadata(key string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s3MetadataTimeout)
+	defer cancel()
+
+	return s.client.putBytes(ctx, key, data, "application/json")
+}
+
+// deleteObject deletes an object
+func (s *S3ImageStore) deleteObject(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s3MetadataTimeout)
+	defer cancel()
+
+	return s.client.deleteObject(ctx, key)
+}
+
+func (s *S3ImageStore) setBlobKeys(blob *imageBlob) {
+	blob.Path = s3BlobPrefix + blob.Checksum + blob.Type
+	for name, variant := range blob.Variants {
+		variant.Path = fmt.Sprintf("%s%s_%s%s", s3BlobPrefix, blob.Checksum, name, variant.Type)
+	}
+}
+
+func imageMetadataKey(imageId string) string {
+	return s3ImagePrefix + imageId + imageMetadataSuffix
+}
+
+func blobMetadataKey(checksum string) string {
+	return s3BlobPrefix + checksum + imageMetadataSuffix
+}
+
+// Save saves a new laptop image read from imageData to the bucket,
+// the data is first written to a temporary file to compute its checksum and generate its variants
+func (s *S3ImageStore) Save(laptopId string, mimeType string, imageData io.Reader) (string, error) {
+	imageType, err := imageExtension(mimeType)
+	if err != nil {
+		return "", err
+	}
+
+	imageId, err := uuid.NewRandom()
+	if err != nil {
+		return "", fmt.Errorf("cannot generate image id: %w", err)
+	}
+
+	file, err := os.CreateTemp("", "image-*")
+	if err != nil {
+		return "", fmt.Errorf("cannot create image file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), imageData)
+	if err != nil {
+		return "", fmt.Errorf("cannot write image to file: %w", err)
+	}
+
+	info := &ImageInfo{
+		Id:         imageId.String(),
+		LaptopId:   laptopId,
+		Type:       imageType,
+		MimeType:   mimeType,
+		Size:       size,
+		Checksum:   hex.EncodeToString(hash.Sum(nil)),
+		UploadedAt: time.Now().UTC(),
+	}
+
+	// the objects of a new blob are uploaded before taking the blob lock,
+	// and the lock of the checksum keeps them from being deleted until the blob is indexed
+	unlock := s.checksumMutex.Lock(info.Checksum)
+	defer unlock()
+
+	blob := s.findBlob(info.Checksum)
+	if blob == nil {
+		blob = s.newBlob(info)
+		err = s.uploadBlob(blob, file)
+		if err != nil {
+			s.removeBlob(blob)
+			return "", err
+		}
+	}
+
+	s.blobMutex.Lock()
+	// the blob may have been indexed meanwhile by a save of an image that did not exist yet
+	if indexed := s.findBlob(info.Checksum); indexed != nil {
+		blob = indexed
+	}
+	err = s.add(info, s.addBlobRef(blob))
+	s.blobMutex.Unlock()
+
+	if err != nil {
+		// the blob is released if the image cannot be saved
+		s.removeUnusedBlob(blob)
+		return "", err
+	}
+
+	return info.Id, nil
+}
+
+// newBlob returns a new blob with the image data of info
+func (s *S3ImageStore) newBlob(info *ImageInfo) *imageBlob {
+	blob := &imageBlob{
+		Checksum: info.Checksum,
+		Type:     info.Type,
+		MimeType: info.MimeType,
+		Size:     info.Size,
+	}
+	s.setBlobKeys(blob)
+
+	return blob
+}
+
+// uploadBlob uploads the image data of a new blob from file, then its variants and its metadata.
+// The objects uploaded are left for the caller to remove if it fails
+func (s *S3ImageStore) uploadBlob(blob *imageBlob, file *os.File) error {
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("cannot read image file: %w", err)
+	}
+
+	// the data transfers are only bounded by the timeouts of the HTTP client
+	ctx := context.Background()
+	err = s.client.putObject(ctx, blob.Path, file, blob.Size, blob.Checksum, blob.MimeType)
+	if err != nil {
+		return fmt.Errorf("cannot upload image: %w", err)
+	}
+
+	s.resizer.resizeVariants(blob, file.Name(), func(name string, variant *ImageVariantInfo, data []byte) (string, error) {
+		key := fmt.Sprintf("%s%s_%s%s", s3BlobPrefix, blob.Checksum, name, variant.Type)
+		return key, s.client.putBytes(ctx, key, data, variant.MimeType)
+	})
+
+	data, err := json.Marshal(blob)
+	if err != nil {
+		return fmt.Errorf("cannot marshal image metadata: %w", err)
+	}
+
+	err = s.putMetadata(blobMetadataKey(blob.Checksum), data)
+	if err != nil {
+		return fmt.Errorf("cannot upload image metadata: %w", err)
+	}
+
+	return nil
+}
+
+// writeImageMetadata uploads the metadata object of an image
+func (s *S3ImageStore) writeImageMetadata(info *ImageInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("cannot marshal image metadata: %w", err)
+	}
+
+	err = s.putMetadata(imageMetadataKey(info.Id), data)
+	if err != nil {
+		return fmt.Errorf("cannot upload image metadata: %w", err)
+	}
+
+	return nil
+}
+
+// removeImageMetadata deletes the metadata object of an image
+func (s *S3ImageStore) removeImageMetadata(imageId string) error {
+	err := s.deleteObject(imageMetadataKey(imageId))
+	if err != nil {
+		return fmt.Errorf("cannot delete image metadata: %w", err)
+	}
+
+	return nil
+}
+
+// removeBlob deletes the objects of a blob, the caller must hold the lock of its checksum
+func (s *S3ImageStore) removeBlob(blob *imageBlob) {
+	keys := []string{blob.Path, blobMetadataKey(blob.Checksum)}
+	for _, variant := range blob.Variants {
+		keys = append(keys, variant.Path)
+	}
+
+	for _, key := range keys {
+		err := s.deleteObject(key)
+		if err != nil {
+			log.Printf("cannot delete object of blob %s: %v", blob.Checksum, err)
+		}
+	}
+}
+
+// Open opens the data of an image for reading, or of its variant if not empty
+func (s *S3ImageStore) Open(imageId string, variant string) (io.ReadCloser, error) {
+	info, err := s.Find(imageId)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, ErrNotFound
+	}
+
+	key := info.Path
+	if variant != "" {
+		variantInfo := info.Variants[variant]
+		if variantInfo == nil {
+			return nil, ErrNotFound
+		}
+		key = variantInfo.Path
+	}
+
+	body, err := s.client.getObject(context.Background(), key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot download image: %w", err)
+	}
+
+	return body, nil
+}
@@ -0,0 +1,490 @@
+package service_test
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+	"github.com/warnshun/pcbook/service"
+)
+
+func TestDiskImageStoreReopen(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+
+	store, err := service.NewDiskImageStore(imageFolder)
+	require.NoError(t, err)
+
+	laptopId := "laptop"
+	first, err := store.Save(laptopId, "image/jpeg", bytes.NewBufferString("first"))
+	require.NoError(t, err)
+	second, err := store.Save(laptopId, "image/png", bytes.NewBufferString("second image"))
+	require.NoError(t, err)
+	other, err := store.Save("other", "image/jpeg", bytes.NewBufferString("other"))
+	require.NoError(t, err)
+
+	images, err := store.ListByLaptop(laptopId)
+	require.NoError(t, err)
+
+	reopened, err := service.NewDiskImageStore(imageFolder)
+	require.NoError(t, err)
+
+	reloaded, err := reopened.ListByLaptop(laptopId)
+	require.NoError(t, err)
+	require.Equal(t, []string{first, second}, []string{reloaded[0].Id, reloaded[1].Id})
+	for i := range images {
+		require.Equal(t, images[i].Path, reloaded[i].Path)
+		require.Equal(t, images[i].Type, reloaded[i].Type)
+		require.Equal(t, images[i].Size, reloaded[i].Size)
+		require.Equal(t, images[i].Checksum, reloaded[i].Checksum)
+		require.True(t, images[i].UploadedAt.Equal(reloaded[i].UploadedAt))
+	}
+	require.EqualValues(t, len("second image"), reloaded[1].Size)
+	require.Len(t, reloaded[0].Checksum, 64)
+
+	info, err := reopened.Find(other)
+	require.NoError(t, err)
+	require.Equal(t, "other", info.LaptopId)
+
+	report, err := reopened.Check()
+	require.NoError(t, err)
+	require.True(t, report.Clean())
+}
+
+func TestDiskImageStoreRepair(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+
+	store, err := service.NewDiskImageStore(imageFolder)
+	require.NoError(t, err)
+
+	kept, err := store.Save("laptop", "image/jpeg", bytes.NewBufferString("kept"))
+	require.NoError(t, err)
+	missing, err := store.Save("laptop", "image/jpeg", bytes.NewBufferString("missing"))
+	require.NoError(t, err)
+	missingInfo, err := store.Find(missing)
+	require.NoError(t, err)
+
+	// an image file without metadata, and metadata without an image file
+	orphan := "4ea8b5a3-b4a8-4b8e-9b0a-1d6e0c0f5f0e.jpg"
+	require.NoError(t, os.WriteFile(filepath.Join(imageFolder, orphan), []byte("orphan"), 0o644))
+	require.NoError(t, os.Remove(missingInfo.Path))
+
+	store, err = service.NewDiskImageStore(imageFolder)
+	require.NoError(t, err)
+
+	report, err := store.Check()
+	require.NoError(t, err)
+	require.False(t, report.Clean())
+	require.Equal(t, []string{orphan}, report.Orphans)
+	require.Len(t, report.Dangling, 1)
+	require.Equal(t, missing, report.Dangling[0].Id)
+
+	report, err = store.Repair()
+	require.NoError(t, err)
+	require.Equal(t, []string{orphan}, report.Orphans)
+	require.NoFileExists(t, filepath.Join(imageFolder, orphan))
+
+	images, err := store.ListByLaptop("laptop")
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	require.Equal(t, kept, images[0].Id)
+
+	store, err = service.NewDiskImageStore(imageFolder)
+	require.NoError(t, err)
+
+	report, err = store.Check()
+	require.NoError(t, err)
+	require.True(t, report.Clean())
+
+	info, err := store.Find(missing)
+	require.NoError(t, err)
+	require.Nil(t, info)
+}
+
+func TestDiskImageStoreCorruptMetadata(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+
+	store, err := service.NewDiskImageStore(imageFolder)
+	require.NoError(t, err)
+
+	imageId, err := store.Save("laptop", "image/jpeg", bytes.NewBufferString("image"))
+	require.NoError(t, err)
+
+	// a truncated metadata file does not prevent the store from starting
+	corrupt := "4ea8b5a3-b4a8-4b8e-9b0a-1d6e0c0f5f0e.meta.json"
+	require.NoError(t, os.WriteFile(filepath.Join(imageFolder, corrupt), []byte(`{"id": "4ea8`), 0o644))
+
+	store, err = service.NewDiskImageStore(imageFolder)
+	require.NoError(t, err)
+
+	info, err := store.Find(imageId)
+	require.NoError(t, err)
+	require.NotNil(t, info)
+
+	report, err := store.Check()
+	require.NoError(t, err)
+	require.Equal(t, []string{corrupt}, report.Orphans)
+	require.Empty(t, report.Dangling)
+
+	_, err = store.Repair()
+	require.NoError(t, err)
+	require.NoFileExists(t, filepath.Join(imageFolder, corrupt))
+
+	report, err = store.Check()
+	require.NoError(t, err)
+	require.True(t, report.Clean())
+}
+
+func TestDiskImageStoreUnsupportedType(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+
+	store, err := service.NewDiskImageStore(imageFolder)
+	require.NoError(t, err)
+
+	for _, mimeType := range []string{"text/plain", "/../../etc/passwd", ""} {
+		_, err = store.Save("laptop", mimeType, bytes.NewBufferString("image"))
+		require.ErrorIs(t, err, service.ErrUnsupportedImageType)
+	}
+
+	requireNoFiles(t, imageFolder)
+}
+
+func TestDiskImageStoreSaveError(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+
+	store, err := service.NewDiskImageStore(imageFolder)
+	require.NoError(t, err)
+
+	// the data read before the error is not kept
+	readErr := errors.New("connection lost")
+	imageData := io.MultiReader(bytes.NewBufferString("partial image"), iotest.ErrReader(readErr))
+
+	_, err = store.Save("laptop", "image/jpeg", imageData)
+	require.ErrorIs(t, err, readErr)
+
+	images, err := store.ListByLaptop("laptop")
+	require.NoError(t, err)
+	require.Empty(t, images)
+
+	requireNoFiles(t, imageFolder)
+}
+
+// requireNoFiles checks that the folder and its sub-folders contain no files
+func requireNoFiles(t *testing.T, folder string) {
+	err := filepath.WalkDir(folder, func(path string, entry fs.DirEntry, err error) error {
+		require.NoError(t, err)
+		require.True(t, entry.IsDir(), "unexpected file %s", path)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestDiskImageStoreVariants(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+	variants := []service.ImageVariant{
+		{Name: "thumbnail", MaxWidth: 100, MaxHeight: 100},
+		{Name: "large", MaxWidth: 1000, MaxHeight: 1000},
+	}
+
+	store, err := service.NewDiskImageStore(imageFolder, service.WithImageVariants(variants...))
+	require.NoError(t, err)
+
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for x := 0; x < 400; x++ {
+		for y := 0; y < 200; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+
+	imageData := bytes.Buffer{}
+	require.NoError(t, png.Encode(&imageData, img))
+
+	imageId, err := store.Save("laptop", "image/png", &imageData)
+	require.NoError(t, err)
+
+	// webp images cannot be decoded, they are kept without variants
+	webpId, err := store.Save("laptop", "image/webp", bytes.NewBufferString("RIFF\x00\x00\x00\x00WEBPVP8 "))
+	require.NoError(t, err)
+
+	requireVariants := func(store *service.DiskImageStore) {
+		info, err := store.Find(imageId)
+		require.NoError(t, err)
+		require.Equal(t, 400, info.Width)
+		require.Equal(t, 200, info.Height)
+		require.Len(t, info.Variants, 2)
+
+		sizes := map[string]image.Point{
+			"thumbnail": image.Pt(100, 50),
+			"large":     image.Pt(400, 200),
+		}
+		for name, size := range sizes {
+			variant := info.Variants[name]
+			require.Equal(t, "image/png", variant.MimeType)
+			require.Equal(t, size, image.Pt(variant.Width, variant.Height))
+
+			file, err := store.Open(imageId, name)
+			require.NoError(t, err)
+
+			resized, err := png.Decode(file)
+			require.NoError(t, err)
+			require.NoError(t, file.Close())
+			require.Equal(t, size, resized.Bounds().Size())
+		}
+
+		_, err = store.Open(imageId, "unknown")
+		require.ErrorIs(t, err, service.ErrNotFound)
+
+		webp, err := store.Find(webpId)
+		require.NoError(t, err)
+		require.Empty(t, webp.Variants)
+	}
+
+	requireVariants(store)
+
+	reopened, err := service.NewDiskImageStore(imageFolder, service.WithImageVariants(variants...))
+	require.NoError(t, err)
+	requireVariants(reopened)
+
+	report, err := reopened.Check()
+	require.NoError(t, err)
+	require.True(t, report.Clean())
+
+	// the variants of a missing image are removed with it
+	info, err := reopened.Find(imageId)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(info.Path))
+
+	report, err = reopened.Repair()
+	require.NoError(t, err)
+	require.Len(t, report.Dangling, 1)
+	require.NoFileExists(t, info.Variants["thumbnail"].Path)
+	require.NoFileExists(t, info.Variants["large"].Path)
+}
+
+func TestDiskImageStoreMaxImagePixels(t *testing.T) {
+	t.Parallel()
+
+	store, err := service.NewDiskImageStore(t.TempDir(), service.WithMaxImagePixels(400*200-1))
+	require.NoError(t, err)
+
+	imageData := bytes.Buffer{}
+	require.NoError(t, png.Encode(&imageData, image.NewRGBA(image.Rect(0, 0, 400, 200))))
+
+	// the images with too many pixels are not decoded, but their size is still known
+	imageId, err := store.Save("laptop", "image/png", &imageData)
+	require.NoError(t, err)
+
+	info, err := store.Find(imageId)
+	require.NoError(t, err)
+	require.Empty(t, info.Variants)
+	require.Equal(t, 400, info.Width)
+	require.Equal(t, 200, info.Height)
+}
+
+func TestDiskImageStoreDedup(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+
+	store, err := service.NewDiskImageStore(imageFolder)
+	require.NoError(t, err)
+
+	imageData, err := os.ReadFile("../tmp/laptop.jpg")
+	require.NoError(t, err)
+
+	first, err := store.Save("laptop1", "image/jpeg", bytes.NewReader(imageData))
+	require.NoError(t, err)
+	second, err := store.Save("laptop2", "image/jpeg", bytes.NewReader(imageData))
+	require.NoError(t, err)
+	require.NotEqual(t, first, second)
+
+	firstInfo, err := store.Find(first)
+	require.NoError(t, err)
+	secondInfo, err := store.Find(second)
+	require.NoError(t, err)
+	require.Equal(t, "laptop2", secondInfo.LaptopId)
+	require.Equal(t, firstInfo.Path, secondInfo.Path)
+	require.NotEmpty(t, firstInfo.Variants)
+
+	// the references are counted again on startup
+	store, err = service.NewDiskImageStore(imageFolder)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Delete(first))
+	require.ErrorIs(t, store.Delete(first), service.ErrNotFound)
+	require.FileExists(t, firstInfo.Path)
+
+	file, err := store.Open(second, "thumbnail")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	report, err := store.Check()
+	require.NoError(t, err)
+	require.True(t, report.Clean())
+
+	require.NoError(t, store.Delete(second))
+	requireNoFiles(t, imageFolder)
+}
+
+func TestDiskImageStoreConcurrentDedup(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+
+	store, err := service.NewDiskImageStore(imageFolder)
+	require.NoError(t, err)
+
+	imageData, err := os.ReadFile("../tmp/laptop.jpg")
+	require.NoError(t, err)
+
+	// the saves of the same data generate their variants concurrently, only one blob is kept
+	const n = 4
+	imageIds := make(chan string, n)
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			imageId, err := store.Save("laptop", "image/jpeg", bytes.NewReader(imageData))
+			imageIds <- imageId
+			errs <- err
+		}()
+	}
+
+	var infos []*service.ImageInfo
+	for i := 0; i < n; i++ {
+		require.NoError(t, <-errs)
+
+		info, err := store.Find(<-imageIds)
+		require.NoError(t, err)
+		infos = append(infos, info)
+	}
+
+	for _, info := range infos {
+		require.Equal(t, infos[0].Path, info.Path)
+		require.NotEmpty(t, info.Variants)
+		for _, variant := range info.Variants {
+			require.FileExists(t, variant.Path)
+		}
+	}
+
+	report, err := store.Check()
+	require.NoError(t, err)
+	require.True(t, report.Clean())
+
+	for _, info := range infos {
+		require.NoError(t, store.Delete(info.Id))
+	}
+	requireNoFiles(t, imageFolder)
+}
+
+func TestDiskImageStoreMissingBlobMetadata(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+
+	// an image whose blob has no metadata, like one saved before blobs with its file named by its ID
+	imageId := "4ea8b5a3-b4a8-4b8e-9b0a-1d6e0c0f5f0e"
+	require.NoError(t, os.WriteFile(filepath.Join(imageFolder, imageId+".jpg"), []byte("legacy"), 0o644))
+	metadata := `{"id":"` + imageId + `","laptop_id":"laptop","type":".jpg","mime_type":"image/jpeg","size":6,` +
+		`"checksum":"c49fea7425fa7f8699897a97c159c6690267d9003bb78c53fafa8fc15c325d84"}`
+	require.NoError(t, os.WriteFile(filepath.Join(imageFolder, imageId+".meta.json"), []byte(metadata), 0o644))
+
+	store, err := service.NewDiskImageStore(imageFolder)
+	require.NoError(t, err)
+
+	info, err := store.Find(imageId)
+	require.NoError(t, err)
+	require.NotNil(t, info)
+
+	report, err := store.Check()
+	require.NoError(t, err)
+	require.Equal(t, []string{imageId + ".jpg"}, report.Orphans)
+	require.Len(t, report.Dangling, 1)
+	require.Equal(t, imageId, report.Dangling[0].Id)
+
+	_, err = store.Repair()
+	require.NoError(t, err)
+
+	info, err = store.Find(imageId)
+	require.NoError(t, err)
+	require.Nil(t, info)
+	requireNoFiles(t, imageFolder)
+}
+
+func TestDiskImageStoreOrder(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+
+	store, err := service.NewDiskImageStore(imageFolder)
+	require.NoError(t, err)
+
+	var imageIds []string
+	for _, data := range []string{"first", "second", "third"} {
+		imageId, err := store.Save("laptop", "image/jpeg", bytes.NewBufferString(data))
+		require.NoError(t, err)
+		imageIds = append(imageIds, imageId)
+	}
+
+	requireOrder := func(store *service.DiskImageStore, imageIds []string, primary string) {
+		images, err := store.ListByLaptop("laptop")
+		require.NoError(t, err)
+		require.Len(t, images, len(imageIds))
+		for i, image := range images {
+			require.Equal(t, imageIds[i], image.Id)
+			require.Equal(t, primary == image.Id, image.Primary)
+		}
+	}
+
+	// the first image is the primary image until another is chosen
+	requireOrder(store, imageIds, imageIds[0])
+
+	reordered := []string{imageIds[2], imageIds[0], imageIds[1]}
+	require.NoError(t, store.Reorder("laptop", reordered))
+	require.NoError(t, store.SetPrimary(imageIds[1]))
+	requireOrder(store, reordered, imageIds[1])
+
+	for _, invalid := range [][]string{
+		{imageIds[0], imageIds[1]},
+		{imageIds[0], imageIds[1], imageIds[1]},
+		{imageIds[0], imageIds[1], "unknown"},
+	} {
+		require.ErrorIs(t, store.Reorder("laptop", invalid), service.ErrInvalidImageOrder)
+	}
+	require.ErrorIs(t, store.SetPrimary("unknown"), service.ErrNotFound)
+
+	store, err = service.NewDiskImageStore(imageFolder)
+	require.NoError(t, err)
+	requireOrder(store, reordered, imageIds[1])
+
+	// the first image left becomes primary when the primary image is deleted
+	require.NoError(t, store.Delete(imageIds[1]))
+	requireOrder(store, reordered[:2], imageIds[2])
+
+	store, err = service.NewDiskImageStore(imageFolder)
+	require.NoError(t, err)
+	requireOrder(store, reordered[:2], imageIds[2])
+
+	require.NoError(t, store.DeleteByLaptop("laptop"))
+	requireOrder(store, nil, "")
+	requireNoFiles(t, imageFolder)
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+)
+
+// ErrUnsupportedImageType error
+var ErrUnsupportedImageType = errors.New("unsupported image type")
+
+// imageSniffLen is the number of leading bytes needed to detect the type of an image
+const imageSniffLen = 512
+
+// imageExtensions maps the supported image MIME types to the extension of their files
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+	"image/gif":  ".gif",
+}
+
+// SupportedImageTypes returns the MIME types of the images that can be stored
+func SupportedImageTypes() []string {
+	mimeTypes := make([]string, 0, len(imageExtensions))
+	for mimeType := range imageExtensions {
+		mimeTypes = append(mimeTypes, mimeType)
+	}
+
+	sort.Strings(mimeTypes)
+	return mimeTypes
+}
+
+// detectImageType returns the MIME type of an image from its leading bytes,
+// whatever the client claims it to be
+func detectImageType(data []byte) string {
+	return http.DetectContentType(data)
+}
+
+// imageExtension returns the file extension of an image MIME type
+func imageExtension(mimeType string) (string, error) {
+	extension, ok := imageExtensions[mimeType]
+	if !ok {
+		return "", ErrUnsupportedImageType
+	}
+
+	return extension, nil
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+
+	"github.com/warnshun/pcbook/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// chunkReader reads the image data sent in the chunks of an UploadImage stream,
+// failing with a status error as soon as the image is larger than maxSize
+type chunkReader struct {
+	stream  pb.LaptopService_UploadImageServer
+	maxSize int64
+	size    int64
+	chunk   []byte
+}
+
+func (reader *chunkReader) Read(p []byte) (int, error) {
+	for len(reader.chunk) == 0 {
+		if err := contextError(reader.stream.Context()); err != nil {
+			return 0, err
+		}
+
+		req, err := reader.stream.Recv()
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, status.Errorf(codes.Unknown, "cannot receive chunk data: %v", err)
+		}
+
+		reader.chunk = req.GetChunkData()
+		reader.size += int64(len(reader.chunk))
+		if reader.size > reader.maxSize {
+			return 0, status.Errorf(codes.InvalidArgument, "image is too large: %d > %d", reader.size, reader.maxSize)
+		}
+	}
+
+	n := copy(p, reader.chunk)
+	reader.chunk = reader.chunk[n:]
+
+	return n, nil
+}
+
+// checksumReader fails with a status error at the end of the data if its SHA-256 is not the expected one
+type checksumReader struct {
+	reader   io.Reader
+	hash     hash.Hash
+	expected []byte
+	size     int64
+}
+
+func newChecksumReader(reader io.Reader, expected []byte) *checksumReader {
+	return &checksumReader{
+		reader:   reader,
+		hash:     sha256.New(),
+		expected: expected,
+	}
+}
+
+func (reader *checksumReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	reader.hash.Write(p[:n])
+	reader.size += int64(n)
+
+	if err == io.EOF && !bytes.Equal(reader.hash.Sum(nil), reader.expected) {
+		return n, status.Error(codes.DataLoss, "checksum of the image does not match")
+	}
+
+	return n, err
+}
+
+// saveImage detects the type of the image read from imageData and saves it to the store,
+// the image is rejected before it is read further if its type is not allowed
+func (s *LaptopServer) saveImage(laptopId string, imageData io.Reader) (string, string, error) {
+	reader := bufio.NewReaderSize(imageData, imageSniffLen)
+
+	head, err := reader.Peek(imageSniffLen)
+	if err != nil && err != io.EOF {
+		return "", "", imageSaveError(err)
+	}
+
+	mimeType, err := s.checkImageType(head)
+	if err != nil {
+		return "", "", err
+	}
+
+	imageId, err := s.imageStore.Save(laptopId, mimeType, reader)
+	if err != nil {
+		return "", "", imageSaveError(err)
+	}
+
+	return imageId, mimeType, nil
+}
+
+// imageSaveError returns the status errors of the image readers as they are,
+// the other errors come from the store
+func imageSaveError(err error) error {
+	var statusErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &statusErr) {
+		return statusErr.GRPCStatus().Err()
+	}
+
+	return status.Errorf(codes.Internal, "cannot save image to the store: %v", err)
+}
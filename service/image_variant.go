@@ -0,0 +1,245 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"os"
+
+	// register the GIF decoder
+	_ "image/gif"
+)
+
+// ImageVariant is a resized copy of the uploaded images,
+// they are scaled down to fit in its bounds while keeping their aspect ratio
+type ImageVariant struct {
+	Name      string
+	MaxWidth  int
+	MaxHeight int
+}
+
+// DefaultImageVariants are the variants generated when none are configured
+var DefaultImageVariants = []ImageVariant{
+	{Name: "thumbnail", MaxWidth: 160, MaxHeight: 160},
+	{Name: "small", MaxWidth: 480, MaxHeight: 480},
+	{Name: "medium", MaxWidth: 1024, MaxHeight: 1024},
+}
+
+const variantJPEGQuality = 85
+
+// resizedImage is an encoded variant of an image
+type resizedImage struct {
+	data     []byte
+	mimeType string
+	width    int
+	height   int
+}
+
+const (
+	// maxImagePixels is the default maximum number of pixels of the images decoded to generate their variants,
+	// the decoded pixels are held in memory so the larger images get no variants
+	maxImagePixels = 16_000_000
+	// maxConcurrentResizes is the number of images an image store decodes at the same time,
+	// which with maxImagePixels bounds the memory taken by the variant generation
+	maxConcurrentResizes = 4
+)
+
+// imageResizer generates the variants of the images saved to an image store
+type imageResizer struct {
+	variants  []ImageVariant
+	maxPixels int64
+	// slots is the semaphore limiting the images decoded at the same time
+	slots chan struct{}
+}
+
+func newImageResizer(options *imageStoreOptions) *imageResizer {
+	return &imageResizer{
+		variants:  options.variants,
+		maxPixels: options.maxPixels,
+		slots:     make(chan struct{}, maxConcurrentResizes),
+	}
+}
+
+// decodeImage decodes the image file of one of the standard formats,
+// WebP images cannot be decoded so they get no variants.
+// The size of the image is read from its header first, and returned even when it has more than maxPixels pixels
+func decodeImage(imagePath string, maxPixels int64) (image.Image, image.Config, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return nil, image.Config{}, fmt.Errorf("cannot open image file: %w", err)
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(bufio.NewReader(file))
+	if err != nil {
+		return nil, image.Config{}, fmt.Errorf("cannot decode image: %w", err)
+	}
+
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, config, fmt.Errorf("image size %dx%d is invalid", config.Width, config.Height)
+	}
+	if int64(config.Width)*int64(config.Height) > maxPixels {
+		return nil, config, fmt.Errorf("image size %dx%d is more than %d pixels", config.Width, config.Height, maxPixels)
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, config, fmt.Errorf("cannot read image file: %w", err)
+	}
+
+	img, _, err := image.Decode(bufio.NewReader(file))
+	if err != nil {
+		return nil, config, fmt.Errorf("cannot decode image: %w", err)
+	}
+
+	return img, config, nil
+}
+
+// resizeVariants generates the variants of a blob from its image file,
+// save saves the data of a variant and returns its path.
+// The blob is kept without the variants that cannot be generated.
+// It waits for one of the slots of the resizer, which it holds until all the variants are saved
+func (resizer *imageResizer) resizeVariants(blob *imageBlob, imagePath string, save func(name string, variant *ImageVariantInfo, data []byte) (string, error)) {
+	resizer.slots <- struct{}{}
+	defer func() {
+		<-resizer.slots
+	}()
+
+	img, config, err := decodeImage(imagePath, resizer.maxPixels)
+	if config.Width > 0 && config.Height > 0 {
+		blob.Width = config.Width
+		blob.Height = config.Height
+	}
+	if err != nil {
+		log.Printf("no variants for blob %s: %v", blob.Checksum, err)
+		return
+	}
+
+	blob.Width = img.Bounds().Dx()
+	blob.Height = img.Bounds().Dy()
+
+	for _, variant := range resizer.variants {
+		resized, err := variant.resize(img, blob.MimeType)
+		if err != nil {
+			log.Printf("no %s variant for blob %s: %v", variant.Name, blob.Checksum, err)
+			continue
+		}
+
+		imageType, err := imageExtension(resized.mimeType)
+		if err != nil {
+			log.Printf("no %s variant for blob %s: %v", variant.Name, blob.Checksum, err)
+			continue
+		}
+
+		variantInfo := &ImageVariantInfo{
+			Type:     imageType,
+			MimeType: resized.mimeType,
+			Size:     int64(len(resized.data)),
+			Width:    resized.width,
+			Height:   resized.height,
+		}
+
+		variantInfo.Path, err = save(variant.Name, variantInfo, resized.data)
+		if err != nil {
+			log.Printf("cannot save %s variant of blob %s: %v", variant.Name, blob.Checksum, err)
+			continue
+		}
+
+		if blob.Variants == nil {
+			blob.Variants = make(map[string]*ImageVariantInfo)
+		}
+		blob.Variants[variant.Name] = variantInfo
+	}
+}
+
+// resize scales the image down to fit in the variant bounds and encodes it,
+// JPEG images stay JPEG and the others become PNG to keep their transparency
+func (variant ImageVariant) resize(img image.Image, mimeType string) (*resizedImage, error) {
+	width, height := fitInBounds(img.Bounds().Dx(), img.Bounds().Dy(), variant.MaxWidth, variant.MaxHeight)
+	resized := scaleDown(img, width, height)
+
+	buffer := bytes.Buffer{}
+	resizedType := "image/png"
+
+	var err error
+	if mimeType == "image/jpeg" {
+		resizedType = mimeType
+		err = jpeg.Encode(&buffer, resized, &jpeg.Options{Quality: variantJPEGQuality})
+	} else {
+		err = png.Encode(&buffer, resized)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode %s variant: %w", variant.Name, err)
+	}
+
+	return &resizedImage{
+		data:     buffer.Bytes(),
+		mimeType: resizedType,
+		width:    width,
+		height:   height,
+	}, nil
+}
+
+// fitInBounds returns the size of an image scaled down to fit in the bounds,
+// images already fitting keep their size
+func fitInBounds(width int, height int, maxWidth int, maxHeight int) (int, int) {
+	scale := math.Min(float64(maxWidth)/float64(width), float64(maxHeight)/float64(height))
+	if scale >= 1 {
+		return width, height
+	}
+
+	return max(1, int(math.Round(float64(width)*scale))), max(1, int(math.Round(float64(height)*scale)))
+}
+
+// scaleDown resizes the image by averaging the source pixels covered by each resized pixel,
+// the source rows covered by a resized row are converted to RGBA one band at a time
+func scaleDown(img image.Image, width int, height int) *image.RGBA {
+	bounds := img.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	// a resized row covers at most this many source rows
+	maxBandHeight := (srcHeight+height-1)/height + 1
+	buffer := image.NewRGBA(image.Rect(0, 0, srcWidth, maxBandHeight))
+
+	for y := 0; y < height; y++ {
+		y0 := y * srcHeight / height
+		y1 := max(y0+1, (y+1)*srcHeight/height)
+
+		band := buffer.SubImage(image.Rect(0, 0, srcWidth, y1-y0)).(*image.RGBA)
+		draw.Draw(band, band.Bounds(), img, image.Pt(bounds.Min.X, bounds.Min.Y+y0), draw.Src)
+
+		for x := 0; x < width; x++ {
+			x0 := x * srcWidth / width
+			x1 := max(x0+1, (x+1)*srcWidth/width)
+
+			var r, g, b, a, n uint64
+			for sy := 0; sy < y1-y0; sy++ {
+				row := band.Pix[sy*band.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					pixel := row[sx*4 : sx*4+4]
+					r += uint64(pixel[0])
+					g += uint64(pixel[1])
+					b += uint64(pixel[2])
+					a += uint64(pixel[3])
+					n++
+				}
+			}
+
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+
+	return dst
+}
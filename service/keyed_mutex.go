@@ -0,0 +1,45 @@
+package service
+
+import "sync"
+
+// keyedMutex serializes the work done for the same key while the work for other keys goes on,
+// the mutex of a key is released once nobody holds or waits for it
+type keyedMutex struct {
+	mutex sync.Mutex
+	locks map[string]*keyedLock
+}
+
+// keyedLock is the mutex of a key together with the number of its holders and waiters
+type keyedLock struct {
+	mutex sync.Mutex
+	users int
+}
+
+// Lock locks the mutex of the key and returns the function unlocking it
+func (m *keyedMutex) Lock(key string) func() {
+	m.mutex.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*keyedLock)
+	}
+
+	lock := m.locks[key]
+	if lock == nil {
+		lock = &keyedLock{}
+		m.locks[key] = lock
+	}
+	lock.users++
+	m.mutex.Unlock()
+
+	lock.mutex.Lock()
+
+	return func() {
+		lock.mutex.Unlock()
+
+		m.mutex.Lock()
+		lock.users--
+		if lock.users == 0 {
+			delete(m.locks, key)
+		}
+		m.mutex.Unlock()
+	}
+}
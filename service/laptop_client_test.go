@@ -2,13 +2,18 @@ package service_test
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"fmt"
+	"image/jpeg"
 	"io"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/warnshun/pcbook/pb"
@@ -16,7 +21,12 @@ import (
 	"github.com/warnshun/pcbook/serializer"
 	"github.com/warnshun/pcbook/service"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func TestClientCreateLaptop(t *testing.T) {
@@ -47,6 +57,43 @@ func TestClientCreateLaptop(t *testing.T) {
 
 }
 
+func TestClientGetLaptop(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore, err := service.NewDiskImageStore(t.TempDir())
+	require.NoError(t, err)
+	ratingStore := service.NewInMemoryRatingStore()
+
+	laptop := sample.NewLaptop()
+	err = laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	imageId, err := imageStore.Save(laptop.GetId(), "image/jpeg", bytes.NewBufferString("image"))
+	require.NoError(t, err)
+
+	_, err = ratingStore.Add(laptop.GetId(), "user1", 6)
+	require.NoError(t, err)
+	_, err = ratingStore.Add(laptop.GetId(), "user2", 9)
+	require.NoError(t, err)
+
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, ratingStore)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	res, err := laptopClient.GetLaptop(context.Background(), &pb.GetLaptopRequest{Id: laptop.GetId()})
+	require.NoError(t, err)
+	requireSameLaptop(t, laptop, res.GetLaptop())
+	require.EqualValues(t, 2, res.GetRatedCount())
+	require.Equal(t, 7.5, res.GetAverageScore())
+	require.Equal(t, []string{imageId}, res.GetImageIds())
+
+	_, err = laptopClient.GetLaptop(context.Background(), &pb.GetLaptopRequest{Id: sample.NewLaptop().GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = laptopClient.GetLaptop(context.Background(), &pb.GetLaptopRequest{Id: "invalid-uuid"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
 func TestClientSearchLaptop(t *testing.T) {
 	t.Parallel()
 
@@ -69,7 +116,7 @@ func TestClientSearchLaptop(t *testing.T) {
 		case 1:
 			laptop.Cpu.NumberCores = 2
 		case 2:
-			laptop.Cpu.MinGhz = 2.0
+			laptop.Cpu.MinGhz = 1.8
 		case 3:
 			laptop.Ram = &pb.Memory{Value: 4096, Unit: pb.Memory_MEGABYTE}
 		case 4:
@@ -117,16 +164,230 @@ func TestClientSearchLaptop(t *testing.T) {
 	require.Equal(t, len(expectedIds), found)
 }
 
+func TestClientSearchLaptopPagination(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	prices := []float64{1800, 2500, 1500, 2200, 1800, 3000, 2000}
+	for _, price := range prices {
+		laptop := sample.NewLaptop()
+		laptop.Price = price
+		err := laptopStore.Save(laptop)
+		require.NoError(t, err)
+	}
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	searchPage := func(pageToken string) ([]*pb.Laptop, string) {
+		req := &pb.SearchLaptopRequest{
+			Filter:     &pb.Filter{MaxPrice: 2500},
+			PageSize:   2,
+			PageToken:  pageToken,
+			SortBy:     pb.SearchLaptopRequest_PRICE,
+			Descending: true,
+		}
+		stream, err := laptopClient.SearchLaptop(context.Background(), req)
+		require.NoError(t, err)
+
+		var laptops []*pb.Laptop
+		nextPageToken := ""
+		for {
+			res, err := stream.Recv()
+			if err == io.EOF {
+				return laptops, nextPageToken
+			}
+			require.NoError(t, err)
+
+			if res.GetNextPageToken() != "" {
+				nextPageToken = res.GetNextPageToken()
+				continue
+			}
+			laptops = append(laptops, res.GetLaptop())
+		}
+	}
+
+	var found []float64
+	pageToken := ""
+	for pages := 1; ; pages++ {
+		laptops, nextPageToken := searchPage(pageToken)
+		for _, laptop := range laptops {
+			found = append(found, laptop.GetPrice())
+		}
+
+		if nextPageToken == "" {
+			require.Equal(t, 3, pages)
+			break
+		}
+		require.Len(t, laptops, 2)
+		pageToken = nextPageToken
+	}
+
+	require.Equal(t, []float64{2500, 2200, 2000, 1800, 1800, 1500}, found)
+
+	req := &pb.SearchLaptopRequest{PageToken: "invalid-token"}
+	stream, err := laptopClient.SearchLaptop(context.Background(), req)
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestClientSearchLaptopByQuery(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	expectedIds := make(map[string]bool)
+
+	for i := 0; i < 4; i++ {
+		laptop := sample.NewLaptop()
+		laptop.Brand = "Dell"
+		laptop.Ram = &pb.Memory{Value: 16, Unit: pb.Memory_GIGABYTE}
+
+		switch i {
+		case 0:
+			laptop.Brand = "Apple"
+		case 1:
+			laptop.Ram = &pb.Memory{Value: 8, Unit: pb.Memory_GIGABYTE}
+		default:
+			expectedIds[laptop.Id] = true
+		}
+
+		err := laptopStore.Save(laptop)
+		require.NoError(t, err)
+	}
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	req := &pb.SearchLaptopRequest{Query: "brand:dell ram>=16GB"}
+	stream, err := laptopClient.SearchLaptop(context.Background(), req)
+	require.NoError(t, err)
+
+	found := 0
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+
+		require.NoError(t, err)
+		require.Contains(t, expectedIds, res.GetLaptop().GetId())
+
+		found += 1
+	}
+	require.Equal(t, len(expectedIds), found)
+
+	req = &pb.SearchLaptopRequest{Query: "brand:dell ram>=lots"}
+	stream, err = laptopClient.SearchLaptop(context.Background(), req)
+	require.NoError(t, err)
+
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), `"ram>=lots" at offset 11`)
+}
+
+func TestClientSearchLaptopInvalidFilter(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	err := laptopStore.Save(sample.NewLaptop())
+	require.NoError(t, err)
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	// the indexes and the scan of the laptops would not agree on the laptops within such bounds
+	filters := []*pb.Filter{
+		{MaxPrice: math.NaN()},
+		{MinPrice: math.Inf(-1)},
+		{MinCpuGhz: math.Inf(1)},
+		{MaxScreenSizeInch: float32(math.NaN())},
+		{MaxWeightKg: math.Inf(1)},
+	}
+
+	for _, filter := range filters {
+		stream, err := laptopClient.SearchLaptop(context.Background(), &pb.SearchLaptopRequest{Filter: filter})
+		require.NoError(t, err)
+
+		_, err = stream.Recv()
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+}
+
+func TestClientWatchLaptops(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+
+	existing := sample.NewLaptop()
+	existing.Price = 1500
+	err := laptopStore.Save(existing)
+	require.NoError(t, err)
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req := &pb.WatchLaptopsRequest{
+		Filter: &pb.Filter{MaxPrice: 2000},
+		Replay: true,
+	}
+	stream, err := laptopClient.WatchLaptops(ctx, req)
+	require.NoError(t, err)
+
+	requireEvent := func(eventType pb.WatchLaptopsResponse_EventType, laptopId string) {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, eventType, res.GetType())
+		require.Equal(t, laptopId, res.GetLaptop().GetId())
+	}
+
+	// once the replay is received, the server is subscribed to the changes
+	requireEvent(pb.WatchLaptopsResponse_EXISTING, existing.Id)
+
+	expensive := sample.NewLaptop()
+	expensive.Price = 2500
+	require.NoError(t, laptopStore.Save(expensive))
+
+	created := sample.NewLaptop()
+	created.Price = 1800
+	require.NoError(t, laptopStore.Save(created))
+	requireEvent(pb.WatchLaptopsResponse_CREATED, created.Id)
+
+	// an update moving a laptop out of the filter is sent as a removal
+	created.Price = 2200
+	require.NoError(t, laptopStore.Update(created))
+	requireEvent(pb.WatchLaptopsResponse_REMOVED, created.Id)
+
+	// and an update moving a laptop into the filter as a creation
+	expensive.Price = 1900
+	require.NoError(t, laptopStore.Update(expensive))
+	requireEvent(pb.WatchLaptopsResponse_CREATED, expensive.Id)
+
+	expensive.Price = 1950
+	require.NoError(t, laptopStore.Update(expensive))
+	requireEvent(pb.WatchLaptopsResponse_UPDATED, expensive.Id)
+
+	require.NoError(t, laptopStore.Delete(expensive.Id))
+	requireEvent(pb.WatchLaptopsResponse_DELETED, expensive.Id)
+	require.NoError(t, laptopStore.Delete(existing.Id))
+	requireEvent(pb.WatchLaptopsResponse_DELETED, existing.Id)
+}
+
 func TestClientUploadImage(t *testing.T) {
 	t.Parallel()
 
 	testImageFolder := "../tmp"
+	imageFolder := t.TempDir()
 
 	laptopStore := service.NewInMemoryLaptopStore()
-	imageStore := service.NewDiskImageStore(testImageFolder)
+	imageStore, err := service.NewDiskImageStore(imageFolder)
+	require.NoError(t, err)
 
 	laptop := sample.NewLaptop()
-	err := laptopStore.Save(laptop)
+	err = laptopStore.Save(laptop)
 	require.NoError(t, err)
 
 	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil)
@@ -181,9 +442,454 @@ func TestClientUploadImage(t *testing.T) {
 	require.NotZero(t, res.GetId())
 	require.EqualValues(t, size, res.GetSize())
 
-	savedImagePath := fmt.Sprintf("%s/%s%s", testImageFolder, res.GetId(), imageType)
-	require.FileExists(t, savedImagePath)
-	require.NoError(t, os.Remove(savedImagePath))
+	info, err := imageStore.Find(res.GetId())
+	require.NoError(t, err)
+	require.Equal(t, imageType, info.Type)
+	require.FileExists(t, info.Path)
+}
+
+func TestClientUploadImageType(t *testing.T) {
+	t.Parallel()
+
+	jpeg, err := os.ReadFile("../tmp/laptop.jpg")
+	require.NoError(t, err)
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 1000)...)
+
+	testCases := []struct {
+		name      string
+		allowed   []string
+		maxSize   int64
+		imageType string
+		data      []byte
+		code      codes.Code
+		saved     string
+	}{
+		{
+			name:      "jpeg_named_png",
+			imageType: ".png",
+			data:      jpeg,
+			code:      codes.OK,
+			saved:     ".jpg",
+		},
+		{
+			name:      "png_with_path",
+			imageType: "/../../laptop.sh",
+			data:      png,
+			code:      codes.OK,
+			saved:     ".png",
+		},
+		{
+			name:      "text",
+			imageType: ".jpg",
+			data:      []byte("#!/bin/sh\necho hello\n"),
+			code:      codes.InvalidArgument,
+		},
+		{
+			name:      "too_large",
+			maxSize:   1000,
+			imageType: ".jpg",
+			data:      jpeg,
+			code:      codes.InvalidArgument,
+		},
+		{
+			name:      "not_allowed",
+			allowed:   []string{"image/png"},
+			imageType: ".jpg",
+			data:      jpeg,
+			code:      codes.InvalidArgument,
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			laptopStore := service.NewInMemoryLaptopStore()
+			imageStore, err := service.NewDiskImageStore(t.TempDir())
+			require.NoError(t, err)
+
+			laptop := sample.NewLaptop()
+			err = laptopStore.Save(laptop)
+			require.NoError(t, err)
+
+			var opts []service.LaptopServerOption
+			if tc.allowed != nil {
+				opts = append(opts, service.WithAllowedImageTypes(tc.allowed...))
+			}
+			if tc.maxSize > 0 {
+				opts = append(opts, service.WithMaxImageSize(tc.maxSize))
+			}
+
+			serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil, opts...)
+			laptopClient := newTestLaptopClient(t, serverAddress)
+
+			res, err := uploadTestImage(laptopClient, laptop.GetId(), tc.imageType, tc.data)
+			require.Equal(t, tc.code, status.Code(err))
+			if tc.code != codes.OK {
+				images, err := imageStore.ListByLaptop(laptop.GetId())
+				require.NoError(t, err)
+				require.Empty(t, images)
+				return
+			}
+
+			info, err := imageStore.Find(res.GetId())
+			require.NoError(t, err)
+			require.Equal(t, tc.saved, info.Type)
+			require.Equal(t, fmt.Sprintf("%s/%s%s", filepath.Dir(info.Path), info.Checksum, tc.saved), info.Path)
+		})
+	}
+}
+
+func TestClientUploadImageResumable(t *testing.T) {
+	t.Parallel()
+
+	diskUploadStore, err := service.NewDiskUploadStore(t.TempDir())
+	require.NoError(t, err)
+
+	uploadStores := map[string]service.UploadStore{
+		"memory": service.NewInMemoryUploadStore(),
+		"disk":   diskUploadStore,
+	}
+
+	for name, uploadStore := range uploadStores {
+		uploadStore := uploadStore
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			testClientUploadImageResumable(t, uploadStore)
+		})
+	}
+}
+
+func testClientUploadImageResumable(t *testing.T, uploadStore service.UploadStore) {
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore, err := service.NewDiskImageStore(t.TempDir())
+	require.NoError(t, err)
+
+	laptop := sample.NewLaptop()
+	err = laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	imageData, err := os.ReadFile("../tmp/laptop.jpg")
+	require.NoError(t, err)
+	checksum := sha256.Sum256(imageData)
+
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil, service.WithUploadStore(uploadStore))
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	startUpload := func() string {
+		res, err := laptopClient.StartUpload(context.Background(), &pb.StartUploadRequest{LaptopId: laptop.GetId()})
+		require.NoError(t, err)
+		require.NotEmpty(t, res.GetUploadId())
+		return res.GetUploadId()
+	}
+
+	uploadId := startUpload()
+
+	// the first stream ends before the commit
+	half := uint64(len(imageData) / 2)
+	res, err := sendTestUpload(laptopClient, uploadId, imageData, 0, half, nil)
+	require.NoError(t, err)
+	require.Empty(t, res.GetId())
+	require.Equal(t, half, res.GetOffset())
+
+	statusRes, err := laptopClient.GetUploadStatus(context.Background(), &pb.GetUploadStatusRequest{UploadId: uploadId})
+	require.NoError(t, err)
+	require.Equal(t, half, statusRes.GetOffset())
+
+	// chunks already received may be sent again
+	res, err = sendTestUpload(laptopClient, uploadId, imageData, half-100, uint64(len(imageData)), checksum[:])
+	require.NoError(t, err)
+	require.NotEmpty(t, res.GetId())
+	require.EqualValues(t, len(imageData), res.GetSize())
+
+	file, err := imageStore.Open(res.GetId(), "")
+	require.NoError(t, err)
+	defer file.Close()
+
+	saved, err := io.ReadAll(file)
+	require.NoError(t, err)
+	require.Equal(t, imageData, saved)
+
+	_, err = laptopClient.GetUploadStatus(context.Background(), &pb.GetUploadStatusRequest{UploadId: uploadId})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// chunks cannot leave a gap
+	uploadId = startUpload()
+	_, err = sendTestUpload(laptopClient, uploadId, imageData, 10, half, nil)
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	// a corrupted upload is dropped
+	corrupted := append([]byte{}, imageData...)
+	corrupted[len(corrupted)-1]++
+	_, err = sendTestUpload(laptopClient, uploadId, corrupted, 0, uint64(len(corrupted)), checksum[:])
+	require.Equal(t, codes.DataLoss, status.Code(err))
+
+	_, err = laptopClient.GetUploadStatus(context.Background(), &pb.GetUploadStatusRequest{UploadId: uploadId})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = sendTestUpload(laptopClient, "unknown", imageData, 0, half, nil)
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// an offset overflowing the end of its chunk is rejected
+	uploadId = startUpload()
+	stream, err := laptopClient.UploadImage(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.UploadImageRequest{Data: &pb.UploadImageRequest_UploadId{UploadId: uploadId}}))
+	chunk := &pb.UploadChunk{Offset: math.MaxUint64 - 10, Data: imageData[:100]}
+	require.NoError(t, stream.Send(&pb.UploadImageRequest{Data: &pb.UploadImageRequest_Chunk{Chunk: chunk}}))
+	_, err = stream.CloseAndRecv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// the upload of a laptop deleted before the commit is dropped
+	_, err = sendTestUpload(laptopClient, uploadId, imageData, 0, uint64(len(imageData)), nil)
+	require.NoError(t, err)
+	require.NoError(t, laptopStore.Delete(laptop.GetId()))
+
+	_, err = sendTestUpload(laptopClient, uploadId, imageData, 0, 0, checksum[:])
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = laptopClient.GetUploadStatus(context.Background(), &pb.GetUploadStatusRequest{UploadId: uploadId})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = laptopClient.StartUpload(context.Background(), &pb.StartUploadRequest{LaptopId: "unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+// sendTestUpload sends the data from start to end of a resumable upload in chunks of 1 kilobyte,
+// then commits the upload if the checksum is not nil
+func sendTestUpload(laptopClient pb.LaptopServiceClient, uploadId string, data []byte, start uint64, end uint64, checksum []byte) (*pb.UploadImageResponse, error) {
+	stream, err := laptopClient.UploadImage(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	reqs := []*pb.UploadImageRequest{
+		{Data: &pb.UploadImageRequest_UploadId{UploadId: uploadId}},
+	}
+	for offset := start; offset < end; offset += 1024 {
+		chunk := &pb.UploadChunk{
+			Offset: offset,
+			Data:   data[offset:min(offset+1024, end)],
+		}
+		reqs = append(reqs, &pb.UploadImageRequest{Data: &pb.UploadImageRequest_Chunk{Chunk: chunk}})
+	}
+	if checksum != nil {
+		reqs = append(reqs, &pb.UploadImageRequest{Data: &pb.UploadImageRequest_Commit{Commit: &pb.UploadCommit{Sha256: checksum}}})
+	}
+
+	for _, req := range reqs {
+		// the server may have rejected the upload already, its error is returned by CloseAndRecv
+		if stream.Send(req) != nil {
+			break
+		}
+	}
+
+	return stream.CloseAndRecv()
+}
+
+// uploadTestImage uploads the image data in chunks of 1 kilobyte
+func uploadTestImage(laptopClient pb.LaptopServiceClient, laptopId string, imageType string, data []byte) (*pb.UploadImageResponse, error) {
+	stream, err := laptopClient.UploadImage(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	req := &pb.UploadImageRequest{
+		Data: &pb.UploadImageRequest_Info{
+			Info: &pb.ImageInfo{
+				LaptopId:  laptopId,
+				ImageType: imageType,
+			},
+		},
+	}
+
+	err = stream.Send(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for len(data) > 0 {
+		n := min(len(data), 1024)
+
+		req := &pb.UploadImageRequest{
+			Data: &pb.UploadImageRequest_ChunkData{
+				ChunkData: data[:n],
+			},
+		}
+
+		// the server may have rejected the image already, its error is returned by CloseAndRecv
+		if stream.Send(req) != nil {
+			break
+		}
+
+		data = data[n:]
+	}
+
+	return stream.CloseAndRecv()
+}
+
+func TestClientDownloadImage(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore, err := service.NewDiskImageStore(t.TempDir())
+	require.NoError(t, err)
+
+	laptop := sample.NewLaptop()
+	err = laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	imageData, err := os.ReadFile("../tmp/laptop.jpg")
+	require.NoError(t, err)
+
+	imageId, err := imageStore.Save(laptop.GetId(), "image/jpeg", bytes.NewReader(imageData))
+	require.NoError(t, err)
+
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	listRes, err := laptopClient.ListImages(context.Background(), &pb.ListImagesRequest{LaptopId: laptop.GetId()})
+	require.NoError(t, err)
+	require.Len(t, listRes.GetImages(), 1)
+
+	metadata := listRes.GetImages()[0]
+	require.Equal(t, imageId, metadata.GetId())
+	require.Equal(t, laptop.GetId(), metadata.GetLaptopId())
+	require.Equal(t, ".jpg", metadata.GetImageType())
+	require.Equal(t, "image/jpeg", metadata.GetMimeType())
+	require.EqualValues(t, len(imageData), metadata.GetSize())
+
+	stream, err := laptopClient.DownloadImage(context.Background(), &pb.DownloadImageRequest{ImageId: imageId})
+	require.NoError(t, err)
+
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.True(t, proto.Equal(metadata, res.GetMetadata()))
+
+	downloaded := bytes.Buffer{}
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		downloaded.Write(res.GetChunkData())
+	}
+	require.Equal(t, imageData, downloaded.Bytes())
+
+	require.Equal(t, []string{"medium", "small", "thumbnail"}, metadata.GetVariants())
+
+	stream, err = laptopClient.DownloadImage(context.Background(), &pb.DownloadImageRequest{ImageId: imageId, Variant: "thumbnail"})
+	require.NoError(t, err)
+
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "thumbnail", res.GetMetadata().GetVariant())
+	require.Equal(t, "image/jpeg", res.GetMetadata().GetMimeType())
+
+	thumbnail := bytes.Buffer{}
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		thumbnail.Write(res.GetChunkData())
+	}
+	require.EqualValues(t, thumbnail.Len(), res.GetMetadata().GetSize())
+
+	thumbnailImage, err := jpeg.Decode(&thumbnail)
+	require.NoError(t, err)
+	require.LessOrEqual(t, thumbnailImage.Bounds().Dx(), 160)
+	require.LessOrEqual(t, thumbnailImage.Bounds().Dy(), 160)
+	require.EqualValues(t, thumbnailImage.Bounds().Dx(), res.GetMetadata().GetWidth())
+
+	stream, err = laptopClient.DownloadImage(context.Background(), &pb.DownloadImageRequest{ImageId: imageId, Variant: "unknown"})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	stream, err = laptopClient.DownloadImage(context.Background(), &pb.DownloadImageRequest{ImageId: "unknown"})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = laptopClient.ListImages(context.Background(), &pb.ListImagesRequest{LaptopId: "unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestClientManageImages(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore, err := service.NewDiskImageStore(t.TempDir())
+	require.NoError(t, err)
+	ratingStore := service.NewInMemoryRatingStore()
+
+	laptop := sample.NewLaptop()
+	err = laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	var imageIds []string
+	for _, data := range []string{"first", "second"} {
+		imageId, err := imageStore.Save(laptop.GetId(), "image/jpeg", bytes.NewBufferString(data))
+		require.NoError(t, err)
+		imageIds = append(imageIds, imageId)
+	}
+
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, ratingStore)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	requireImages := func(images []*pb.ImageMetadata, imageIds []string, primary string) {
+		require.Len(t, images, len(imageIds))
+		for i, image := range images {
+			require.Equal(t, imageIds[i], image.GetId())
+			require.Equal(t, primary == image.GetId(), image.GetPrimary())
+		}
+	}
+
+	getRes, err := laptopClient.GetLaptop(context.Background(), &pb.GetLaptopRequest{Id: laptop.GetId()})
+	require.NoError(t, err)
+	requireImages(getRes.GetImages(), imageIds, imageIds[0])
+
+	reordered := []string{imageIds[1], imageIds[0]}
+	reorderRes, err := laptopClient.ReorderImages(context.Background(), &pb.ReorderImagesRequest{LaptopId: laptop.GetId(), ImageIds: reordered})
+	require.NoError(t, err)
+	requireImages(reorderRes.GetImages(), reordered, imageIds[0])
+
+	primaryRes, err := laptopClient.SetPrimaryImage(context.Background(), &pb.SetPrimaryImageRequest{ImageId: imageIds[1]})
+	require.NoError(t, err)
+	requireImages(primaryRes.GetImages(), reordered, imageIds[1])
+
+	getRes, err = laptopClient.GetLaptop(context.Background(), &pb.GetLaptopRequest{Id: laptop.GetId()})
+	require.NoError(t, err)
+	require.Equal(t, reordered, getRes.GetImageIds())
+	requireImages(getRes.GetImages(), reordered, imageIds[1])
+
+	_, err = laptopClient.ReorderImages(context.Background(), &pb.ReorderImagesRequest{LaptopId: laptop.GetId(), ImageIds: imageIds[:1]})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = laptopClient.ReorderImages(context.Background(), &pb.ReorderImagesRequest{LaptopId: sample.NewLaptop().GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	deleteRes, err := laptopClient.DeleteImage(context.Background(), &pb.DeleteImageRequest{ImageId: imageIds[1]})
+	require.NoError(t, err)
+	require.Equal(t, imageIds[1], deleteRes.GetImageId())
+
+	listRes, err := laptopClient.ListImages(context.Background(), &pb.ListImagesRequest{LaptopId: laptop.GetId()})
+	require.NoError(t, err)
+	requireImages(listRes.GetImages(), imageIds[:1], imageIds[0])
+
+	_, err = laptopClient.DeleteImage(context.Background(), &pb.DeleteImageRequest{ImageId: imageIds[1]})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = laptopClient.SetPrimaryImage(context.Background(), &pb.SetPrimaryImageRequest{ImageId: imageIds[1]})
+	require.Equal(t, codes.NotFound, status.Code(err))
 }
 
 func TestClientRateLaptop(t *testing.T) {
@@ -191,50 +897,390 @@ func TestClientRateLaptop(t *testing.T) {
 
 	laptopStore := service.NewInMemoryLaptopStore()
 	rateStore := service.NewInMemoryRatingStore()
+	jwtManager := service.NewJWTManager("secret", time.Minute)
 
 	laptop := sample.NewLaptop()
 	err := laptopStore.Save(laptop)
 	require.NoError(t, err)
 
-	serverAddress := startTestLaptopServer(t, laptopStore, nil, rateStore)
+	serverAddress := startTestAuthLaptopServer(t, laptopStore, rateStore, jwtManager)
 	laptopClient := newTestLaptopClient(t, serverAddress)
 
+	// rating again replaces the previous score of the user
+	user1 := newTestUserContext(t, jwtManager, "user1")
+	responses := rateTestLaptop(t, user1, laptopClient, laptop.GetId(), []float64{4, 7})
+	require.Len(t, responses, 2)
+	require.Equal(t, int32(codes.OK), responses[0].GetStatus().GetCode())
+	require.Equal(t, uint32(1), responses[0].GetRatedCount())
+	require.Equal(t, 4.0, responses[0].GetAverageScore())
+	require.Equal(t, uint32(1), responses[1].GetRatedCount())
+	require.Equal(t, 7.0, responses[1].GetAverageScore())
+
+	user2 := newTestUserContext(t, jwtManager, "user2")
+	responses = rateTestLaptop(t, user2, laptopClient, laptop.GetId(), []float64{10})
+	require.Len(t, responses, 1)
+	require.Equal(t, laptop.GetId(), responses[0].GetLaptopId())
+	require.Equal(t, uint32(2), responses[0].GetRatedCount())
+	require.Equal(t, 8.5, responses[0].GetAverageScore())
+
+	responses = rateTestLaptop(t, user1, laptopClient, laptop.GetId(), []float64{1})
+	require.Equal(t, uint32(2), responses[0].GetRatedCount())
+	require.Equal(t, 5.5, responses[0].GetAverageScore())
+
+	// an anonymous user cannot rate
 	stream, err := laptopClient.RateLaptop(context.Background())
 	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestClientRateLaptopInvalid(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	rateStore := service.NewInMemoryRatingStore()
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	serverAddress := startTestAuthLaptopServer(t, laptopStore, rateStore, jwtManager, service.WithScoreRange(0, 5))
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	testCases := []struct {
+		laptopId string
+		score    float64
+		code     codes.Code
+		count    uint32
+		average  float64
+	}{
+		{laptopId: laptop.GetId(), score: -1, code: codes.InvalidArgument},
+		{laptopId: laptop.GetId(), score: math.NaN(), code: codes.InvalidArgument},
+		{laptopId: laptop.GetId(), score: math.Inf(1), code: codes.InvalidArgument},
+		{laptopId: laptop.GetId(), score: 6, code: codes.InvalidArgument},
+		{laptopId: "unknown", score: 3, code: codes.NotFound},
+		{laptopId: laptop.GetId(), score: 0, code: codes.OK, count: 1, average: 0},
+		{laptopId: laptop.GetId(), score: 5, code: codes.OK, count: 1, average: 5},
+	}
+
+	ctx := newTestUserContext(t, jwtManager, "user1")
+	stream, err := laptopClient.RateLaptop(ctx)
+	require.NoError(t, err)
 
-	stores := []float64{4, 7, 10}
-	averages := []float64{4, 5.5, 7}
+	// the invalid requests are reported and the stream goes on
+	for _, tc := range testCases {
+		err := stream.Send(&pb.RateLaptopRequest{
+			LaptopId: tc.laptopId,
+			Score:    tc.score,
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, stream.CloseSend())
 
-	n := len(stores)
-	for i := 0; i < n; i++ {
-		req := &pb.RateLaptopRequest{
-			LaptopId: laptop.GetId(),
-			Score:    stores[i],
+	for _, tc := range testCases {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+
+		require.Equal(t, tc.laptopId, res.GetLaptopId())
+		require.Equal(t, int32(tc.code), res.GetStatus().GetCode())
+		require.Equal(t, tc.count, res.GetRatedCount())
+		require.Equal(t, tc.average, res.GetAverageScore())
+		if tc.code != codes.OK {
+			require.NotEmpty(t, res.GetStatus().GetMessage())
 		}
+	}
+
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+}
 
-		err := stream.Send(req)
+func TestClientGetMyRatings(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	rateStore := service.NewInMemoryRatingStore()
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+
+	laptop1 := sample.NewLaptop()
+	err := laptopStore.Save(laptop1)
+	require.NoError(t, err)
+	laptop2 := sample.NewLaptop()
+	err = laptopStore.Save(laptop2)
+	require.NoError(t, err)
+
+	serverAddress := startTestAuthLaptopServer(t, laptopStore, rateStore, jwtManager)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	user1 := newTestUserContext(t, jwtManager, "user1")
+	rateTestLaptop(t, user1, laptopClient, laptop1.GetId(), []float64{3})
+	rateTestLaptop(t, user1, laptopClient, laptop2.GetId(), []float64{8})
+	rateTestLaptop(t, user1, laptopClient, laptop1.GetId(), []float64{6})
+
+	user2 := newTestUserContext(t, jwtManager, "user2")
+	rateTestLaptop(t, user2, laptopClient, laptop1.GetId(), []float64{9})
+
+	res, err := laptopClient.GetMyRatings(user1, &pb.GetMyRatingsRequest{})
+	require.NoError(t, err)
+	require.Len(t, res.GetRatings(), 2)
+	require.Equal(t, laptop2.GetId(), res.GetRatings()[0].GetLaptopId())
+	require.Equal(t, 8.0, res.GetRatings()[0].GetScore())
+	require.Equal(t, laptop1.GetId(), res.GetRatings()[1].GetLaptopId())
+	require.Equal(t, 6.0, res.GetRatings()[1].GetScore())
+	require.False(t, res.GetRatings()[1].GetRatedAt().AsTime().Before(res.GetRatings()[0].GetRatedAt().AsTime()))
+
+	res, err = laptopClient.GetMyRatings(newTestUserContext(t, jwtManager, "user3"), &pb.GetMyRatingsRequest{})
+	require.NoError(t, err)
+	require.Empty(t, res.GetRatings())
+
+	_, err = laptopClient.GetMyRatings(context.Background(), &pb.GetMyRatingsRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestClientGetRatingStats(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	rateStore := service.NewInMemoryRatingStore()
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	serverAddress := startTestAuthLaptopServer(t, laptopStore, rateStore, jwtManager, service.WithScoreRange(0, 5))
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	start := time.Now()
+	rateTestLaptop(t, newTestUserContext(t, jwtManager, "user1"), laptopClient, laptop.GetId(), []float64{1})
+	rateTestLaptop(t, newTestUserContext(t, jwtManager, "user2"), laptopClient, laptop.GetId(), []float64{2})
+	middle := time.Now()
+	rateTestLaptop(t, newTestUserContext(t, jwtManager, "user1"), laptopClient, laptop.GetId(), []float64{5})
+	rateTestLaptop(t, newTestUserContext(t, jwtManager, "user3"), laptopClient, laptop.GetId(), []float64{4.5})
+
+	windows := []*pb.TimeWindow{
+		{Start: timestamppb.New(start), End: timestamppb.New(middle)},
+		{Start: timestamppb.New(middle)},
+		{End: timestamppb.New(start)},
+	}
+	res, err := laptopClient.GetRatingStats(context.Background(), &pb.GetRatingStatsRequest{
+		LaptopId: laptop.GetId(),
+		Windows:  windows,
+	})
+	require.NoError(t, err)
+
+	// the current scores are 5, 2 and 4.5
+	require.Equal(t, laptop.GetId(), res.GetLaptopId())
+	require.Equal(t, uint32(3), res.GetRatedCount())
+	require.InDelta(t, 11.5/3, res.GetAverageScore(), 1e-9)
+	require.Equal(t, 4.5, res.GetMedianScore())
+
+	require.Len(t, res.GetHistogram(), 5)
+	for i, count := range []uint32{0, 0, 1, 0, 2} {
+		require.Equal(t, float64(i), res.GetHistogram()[i].GetMinScore())
+		require.Equal(t, float64(i+1), res.GetHistogram()[i].GetMaxScore())
+		require.Equal(t, count, res.GetHistogram()[i].GetCount())
+	}
+
+	require.Len(t, res.GetWindows(), 3)
+	require.Equal(t, uint32(2), res.GetWindows()[0].GetRatedCount())
+	require.Equal(t, 1.5, res.GetWindows()[0].GetAverageScore())
+	require.Equal(t, uint32(2), res.GetWindows()[1].GetRatedCount())
+	require.Equal(t, 4.75, res.GetWindows()[1].GetAverageScore())
+	require.True(t, proto.Equal(windows[1], res.GetWindows()[1].GetWindow()))
+	require.Equal(t, uint32(0), res.GetWindows()[2].GetRatedCount())
+	require.Equal(t, 0.0, res.GetWindows()[2].GetAverageScore())
+
+	_, err = laptopClient.GetRatingStats(context.Background(), &pb.GetRatingStatsRequest{
+		LaptopId: laptop.GetId(),
+		Windows:  []*pb.TimeWindow{{Start: timestamppb.New(middle), End: timestamppb.New(start)}},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = laptopClient.GetRatingStats(context.Background(), &pb.GetRatingStatsRequest{LaptopId: "unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestClientGetRatingStatsWideRange(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	rateStore := service.NewInMemoryRatingStore()
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	serverAddress := startTestAuthLaptopServer(t, laptopStore, rateStore, jwtManager, service.WithScoreRange(0, 1e9))
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	rateTestLaptop(t, newTestUserContext(t, jwtManager, "user1"), laptopClient, laptop.GetId(), []float64{0})
+	rateTestLaptop(t, newTestUserContext(t, jwtManager, "user2"), laptopClient, laptop.GetId(), []float64{1e9})
+
+	res, err := laptopClient.GetRatingStats(context.Background(), &pb.GetRatingStatsRequest{LaptopId: laptop.GetId()})
+	require.NoError(t, err)
+
+	// the histogram of a wide range has a bounded number of buckets covering the range
+	histogram := res.GetHistogram()
+	require.Len(t, histogram, 100)
+	require.Equal(t, 0.0, histogram[0].GetMinScore())
+	require.Equal(t, 1e7, histogram[0].GetMaxScore())
+	require.Equal(t, uint32(1), histogram[0].GetCount())
+	require.Equal(t, 1e9, histogram[99].GetMaxScore())
+	require.Equal(t, uint32(1), histogram[99].GetCount())
+}
+
+// rateTestLaptop rates a laptop with the scores in one stream and returns the responses
+func rateTestLaptop(t *testing.T, ctx context.Context, laptopClient pb.LaptopServiceClient, laptopId string, scores []float64) []*pb.RateLaptopResponse {
+	stream, err := laptopClient.RateLaptop(ctx)
+	require.NoError(t, err)
+
+	for _, score := range scores {
+		err := stream.Send(&pb.RateLaptopRequest{
+			LaptopId: laptopId,
+			Score:    score,
+		})
 		require.NoError(t, err)
 	}
 
 	err = stream.CloseSend()
 	require.NoError(t, err)
 
-	for idx := 0; ; idx++ {
+	var responses []*pb.RateLaptopResponse
+	for {
 		res, err := stream.Recv()
 		if err == io.EOF {
-			require.Equal(t, n, idx)
-			return
+			return responses
 		}
+		require.NoError(t, err)
+
+		responses = append(responses, res)
+	}
+}
 
+func TestClientTopRatedLaptops(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	ratingStore := service.NewInMemoryRatingStore()
+
+	newRatedLaptop := func(price float64, scores ...float64) *pb.Laptop {
+		laptop := sample.NewLaptop()
+		laptop.Price = price
+		err := laptopStore.Save(laptop)
 		require.NoError(t, err)
-		require.Equal(t, laptop.GetId(), res.GetLaptopId())
-		require.Equal(t, uint32(idx+1), res.GetRatedCount())
-		require.Equal(t, averages[idx], res.GetAverageScore())
+
+		for i, score := range scores {
+			_, err := ratingStore.Add(laptop.GetId(), fmt.Sprintf("user%d", i), score)
+			require.NoError(t, err)
+		}
+
+		return laptop
+	}
+
+	// 30 scores of 10 and 20 scores of 9 average 9.6
+	var manyScores []float64
+	for i := 0; i < 50; i++ {
+		manyScores = append(manyScores, 10-float64(i/30))
+	}
+
+	single := newRatedLaptop(1000, 10)
+	many := newRatedLaptop(1000, manyScores...)
+	low := newRatedLaptop(1000, 2, 2, 2)
+	newRatedLaptop(1000)
+	newRatedLaptop(5000, manyScores...)
+
+	filter := &pb.Filter{MaxPrice: 3000}
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, ratingStore)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	res, err := laptopClient.TopRatedLaptops(context.Background(), &pb.TopRatedLaptopsRequest{Filter: filter})
+	require.NoError(t, err)
+	require.Len(t, res.GetLaptops(), 3)
+
+	// the prior is 10 scores of 5.5, in the middle of the default score range
+	expected := []struct {
+		laptop       *pb.Laptop
+		ratedCount   uint32
+		averageScore float64
+		rankingScore float64
+	}{
+		{laptop: many, ratedCount: 50, averageScore: 9.6, rankingScore: (55 + 480) / 60.0},
+		{laptop: single, ratedCount: 1, averageScore: 10, rankingScore: (55 + 10) / 11.0},
+		{laptop: low, ratedCount: 3, averageScore: 2, rankingScore: (55 + 6) / 13.0},
 	}
+	for i, ranked := range res.GetLaptops() {
+		require.Equal(t, expected[i].laptop.GetId(), ranked.GetLaptop().GetId())
+		require.Equal(t, expected[i].ratedCount, ranked.GetRatedCount())
+		require.InDelta(t, expected[i].averageScore, ranked.GetAverageScore(), 1e-9)
+		require.InDelta(t, expected[i].rankingScore, ranked.GetRankingScore(), 1e-9)
+	}
+
+	res, err = laptopClient.TopRatedLaptops(context.Background(), &pb.TopRatedLaptopsRequest{Filter: filter, Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, res.GetLaptops(), 1)
+	require.Equal(t, many.GetId(), res.GetLaptops()[0].GetLaptop().GetId())
+
+	_, err = laptopClient.TopRatedLaptops(context.Background(), &pb.TopRatedLaptopsRequest{Limit: service.MAX_TOP_RATED_LIMIT + 1})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// without a prior the ranking is the raw average
+	ranker := service.NewBayesianRanker(ratingStore, 0, 0)
+	serverAddress = startTestLaptopServer(t, laptopStore, nil, ratingStore, service.WithRanker(ranker))
+	laptopClient = newTestLaptopClient(t, serverAddress)
+
+	res, err = laptopClient.TopRatedLaptops(context.Background(), &pb.TopRatedLaptopsRequest{Filter: filter})
+	require.NoError(t, err)
+	require.Len(t, res.GetLaptops(), 3)
+	require.Equal(t, single.GetId(), res.GetLaptops()[0].GetLaptop().GetId())
+	require.Equal(t, 10.0, res.GetLaptops()[0].GetRankingScore())
+	require.Equal(t, many.GetId(), res.GetLaptops()[1].GetLaptop().GetId())
 }
 
-func startTestLaptopServer(t *testing.T, laptopStore *service.InMemoryLaptopStore, imageStore *service.DiskImageStore, ratingStore *service.InMemoryRatingStore) string {
-	laptopServer := service.NewLaptopServer(laptopStore, imageStore, ratingStore)
+func TestBayesianRankerScore(t *testing.T) {
+	t.Parallel()
+
+	ranker := service.NewBayesianRanker(service.NewInMemoryRatingStore(), 5, 10)
+
+	testCases := []struct {
+		name   string
+		rating *service.Rating
+		score  float64
+	}{
+		{
+			name:   "zero count",
+			rating: &service.Rating{},
+			score:  5,
+		},
+		{
+			name:   "prior dominates",
+			rating: &service.Rating{Count: 1, Sum: 10},
+			score:  60.0 / 11,
+		},
+		{
+			name:   "many ratings",
+			rating: &service.Rating{Count: 990, Sum: 9900},
+			score:  9950.0 / 1000,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			require.InDelta(t, tc.score, ranker.Score(tc.rating), 1e-9)
+		})
+	}
+
+	// without a prior, a laptop without ratings gets the prior score
+	require.Equal(t, 5.0, service.NewBayesianRanker(nil, 5, 0).Score(&service.Rating{}))
+}
+
+func startTestLaptopServer(t *testing.T, laptopStore *service.InMemoryLaptopStore, imageStore service.ImageStore, ratingStore *service.InMemoryRatingStore, opts ...service.LaptopServerOption) string {
+	laptopServer := service.NewLaptopServer(laptopStore, imageStore, ratingStore, opts...)
 
 	grpcServer := grpc.NewServer()
 	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
@@ -247,6 +1293,47 @@ func startTestLaptopServer(t *testing.T, laptopStore *service.InMemoryLaptopStor
 	return listener.Addr().String()
 }
 
+// startTestAuthLaptopServer starts a laptop server behind the auth interceptor,
+// the ratings require the user role
+func startTestAuthLaptopServer(t *testing.T, laptopStore *service.InMemoryLaptopStore, ratingStore *service.InMemoryRatingStore, jwtManager *service.JWTManager, opts ...service.LaptopServerOption) string {
+	laptopServer := service.NewLaptopServer(laptopStore, nil, ratingStore, opts...)
+
+	const laptopServicePath = "/LaptopService/"
+	interceptor := service.NewAuthInterceptor(jwtManager, map[string][]string{
+		laptopServicePath + "RateLaptop":   {"admin", "user"},
+		laptopServicePath + "GetMyRatings": {"admin", "user"},
+	})
+
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(interceptor.Unary()),
+		grpc.StreamInterceptor(interceptor.Stream()),
+	)
+	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
+	t.Cleanup(grpcServer.Stop)
+
+	listener, err := net.Listen("tcp", ":0") // random available port
+	require.NoError(t, err)
+
+	go grpcServer.Serve(listener)
+
+	return listener.Addr().String()
+}
+
+// newTestUserContext returns a context carrying the access token of a user
+func newTestUserContext(t *testing.T, jwtManager *service.JWTManager, username string) context.Context {
+	return newTestRoleContext(t, jwtManager, username, "user")
+}
+
+func newTestRoleContext(t *testing.T, jwtManager *service.JWTManager, username string, role string) context.Context {
+	user, err := service.NewUser(username, "secret", role)
+	require.NoError(t, err)
+
+	accessToken, err := jwtManager.Generate(user)
+	require.NoError(t, err)
+
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", accessToken)
+}
+
 func newTestLaptopClient(t *testing.T, serverAddress string) pb.LaptopServiceClient {
 	conn, err := grpc.Dial(serverAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	require.NoError(t, err)
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"math"
+	"sort"
+
+	"github.com/warnshun/pcbook/pb"
+)
+
+// laptopIndex keeps laptop IDs sorted by a numeric key,
+// so that a search can skip the laptops out of the filter bounds
+type laptopIndex struct {
+	key    func(laptop *pb.Laptop) float64
+	bounds func(filter *pb.Filter) (min float64, max float64)
+	// entries are sorted by key then ID, pending entries are merged in before the next search
+	entries []indexEntry
+	pending []indexEntry
+}
+
+type indexEntry struct {
+	key float64
+	id  string
+}
+
+func (entry indexEntry) less(other indexEntry) bool {
+	if entry.key == other.key {
+		return entry.id < other.id
+	}
+	return entry.key < other.key
+}
+
+// newLaptopIndexes returns the indexes of the filter criteria that narrow a search the most
+func newLaptopIndexes() []*laptopIndex {
+	unbounded := math.Inf(1)
+
+	return []*laptopIndex{
+		{
+			key: func(laptop *pb.Laptop) float64 { return laptop.GetPrice() },
+			bounds: func(filter *pb.Filter) (float64, float64) {
+				if filter.GetMaxPrice() > 0 {
+					return filter.GetMinPrice(), filter.GetMaxPrice()
+				}
+				return filter.GetMinPrice(), unbounded
+			},
+		},
+		{
+			key: func(laptop *pb.Laptop) float64 { return float64(laptop.GetCpu().GetNumberCores()) },
+			bounds: func(filter *pb.Filter) (float64, float64) {
+				return float64(filter.GetMinCpuCores()), unbounded
+			},
+		},
+		{
+			key: func(laptop *pb.Laptop) float64 { return laptop.GetCpu().GetMinGhz() },
+			bounds: func(filter *pb.Filter) (float64, float64) {
+				return filter.GetMinCpuGhz(), unbounded
+			},
+		},
+		{
+			key: func(laptop *pb.Laptop) float64 { return float64(toBit(laptop.GetRam())) },
+			bounds: func(filter *pb.Filter) (float64, float64) {
+				return float64(toBit(filter.GetMinRam())), unbounded
+			},
+		},
+	}
+}
+
+// Add adds the laptop to the index
+func (index *laptopIndex) Add(laptop *pb.Laptop) {
+	index.pending = append(index.pending, indexEntry{key: index.key(laptop), id: laptop.GetId()})
+}
+
+// Remove removes the laptop from the index, it must be the same as the one that was added
+func (index *laptopIndex) Remove(laptop *pb.Laptop) {
+	entry := indexEntry{key: index.key(laptop), id: laptop.GetId()}
+
+	for i := range index.pending {
+		if index.pending[i] == entry {
+			index.pending = append(index.pending[:i], index.pending[i+1:]...)
+			return
+		}
+	}
+
+	i := sort.Search(len(index.entries), func(i int) bool {
+		return !index.entries[i].less(entry)
+	})
+	if i < len(index.entries) && index.entries[i] == entry {
+		index.entries = append(index.entries[:i], index.entries[i+1:]...)
+	}
+}
+
+// Dirty returns true if some entries must be merged before the index can be searched
+func (index *laptopIndex) Dirty() bool {
+	return len(index.pending) > 0
+}
+
+// Merge sorts the pending entries into the index
+func (index *laptopIndex) Merge() {
+	if len(index.pending) == 0 {
+		return
+	}
+
+	sort.Slice(index.pending, func(i, j int) bool {
+		return index.pending[i].less(index.pending[j])
+	})
+
+	merged := make([]indexEntry, 0, len(index.entries)+len(index.pending))
+	i, j := 0, 0
+	for i < len(index.entries) && j < len(index.pending) {
+		if index.entries[i].less(index.pending[j]) {
+			merged = append(merged, index.entries[i])
+			i++
+		} else {
+			merged = append(merged, index.pending[j])
+			j++
+		}
+	}
+	merged = append(merged, index.entries[i:]...)
+	merged = append(merged, index.pending[j:]...)
+
+	index.entries = merged
+	index.pending = nil
+}
+
+// Range returns the entries within the filter bounds of the index
+func (index *laptopIndex) Range(filter *pb.Filter) []indexEntry {
+	min, max := index.bounds(filter)
+
+	start := sort.Search(len(index.entries), func(i int) bool {
+		return index.entries[i].key >= min
+	})
+	end := sort.Search(len(index.entries), func(i int) bool {
+		return index.entries[i].key > max
+	})
+	if end < start {
+		end = start
+	}
+
+	return index.entries[start:end]
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/warnshun/pcbook/pb"
+	"github.com/warnshun/pcbook/sample"
+)
+
+var indexedFilters = []*pb.Filter{
+	{},
+	{MaxPrice: 1600},
+	{MinPrice: 2000, MaxPrice: 2200, MinCpuCores: 6},
+	{MinCpuGhz: 4.5, MinRam: &pb.Memory{Value: 12, Unit: pb.Memory_GIGABYTE}},
+	{MaxPrice: 2500, MinCpuCores: 4, MinCpuGhz: 2, MinRam: &pb.Memory{Value: 8, Unit: pb.Memory_GIGABYTE}},
+	{Brands: []string{"Apple"}, MinCpuCores: 8},
+}
+
+func TestInMemoryLaptopStoreIndexedSearch(t *testing.T) {
+	t.Parallel()
+
+	store := NewInMemoryLaptopStore()
+	laptops := make([]*pb.Laptop, 0, 500)
+	for i := 0; i < 500; i++ {
+		laptop := sample.NewLaptop()
+		require.NoError(t, store.Save(laptop))
+		laptops = append(laptops, laptop)
+
+		// search in between to merge some of the laptops before the others
+		if i == 250 {
+			requireSameAsScan(t, store, indexedFilters[1])
+		}
+	}
+
+	for i, laptop := range laptops[:100] {
+		if i%2 == 0 {
+			require.NoError(t, store.Delete(laptop.Id))
+			continue
+		}
+
+		laptop.Price = 1550
+		laptop.Cpu.NumberCores = 8
+		require.NoError(t, store.Update(laptop))
+	}
+
+	for _, filter := range indexedFilters {
+		requireSameAsScan(t, store, filter)
+	}
+}
+
+func requireSameAsScan(t *testing.T, store *InMemoryLaptopStore, filter *pb.Filter) {
+	var indexed []string
+	err := store.Search(context.Background(), filter, func(laptop *pb.Laptop) error {
+		indexed = append(indexed, laptop.Id)
+		return nil
+	})
+	require.NoError(t, err)
+
+	var scanned []string
+	err = scanSearch(store, filter, func(laptop *pb.Laptop) error {
+		scanned = append(scanned, laptop.Id)
+		return nil
+	})
+	require.NoError(t, err)
+
+	sort.Strings(indexed)
+	sort.Strings(scanned)
+	require.Equal(t, scanned, indexed, "filter: %v", filter)
+}
+
+// scanSearch is the search without indexes, checking every laptop of the store
+func scanSearch(store *InMemoryLaptopStore, filter *pb.Filter, found func(laptop *pb.Laptop) error) error {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	for _, laptop := range store.data {
+		if isQualified(filter, laptop) {
+			err := found(deepCopy(laptop))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func BenchmarkInMemoryLaptopStoreSearch(b *testing.B) {
+	filters := []struct {
+		name   string
+		filter *pb.Filter
+	}{
+		// few laptops are found, so the cost of the search is not hidden by copying them
+		{"selective", &pb.Filter{MaxPrice: 1520, MinCpuCores: 4, MinRam: &pb.Memory{Value: 12, Unit: pb.Memory_GIGABYTE}}},
+		// most laptops are found, so copying them dominates
+		{"broad", &pb.Filter{MaxPrice: 2800}},
+	}
+
+	for _, size := range []int{10_000, 100_000} {
+		store := NewInMemoryLaptopStore()
+		for i := 0; i < size; i++ {
+			require.NoError(b, store.Save(sample.NewLaptop()))
+		}
+		store.mergeIndexes()
+
+		found := func(laptop *pb.Laptop) error { return nil }
+
+		for _, f := range filters {
+			filter := f.filter
+
+			b.Run(fmt.Sprintf("%s/indexed/%d", f.name, size), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					err := store.Search(context.Background(), filter, found)
+					require.NoError(b, err)
+				}
+			})
+
+			b.Run(fmt.Sprintf("%s/scan/%d", f.name, size), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					err := scanSearch(store, filter, found)
+					require.NoError(b, err)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"sort"
+
+	"github.com/warnshun/pcbook/pb"
+)
+
+// DEFAULT_PRIOR_WEIGHT is the default number of prior scores added to the scores of each laptop when ranking them
+const DEFAULT_PRIOR_WEIGHT = 10
+
+// RankedLaptop is a rated laptop with its ranking score
+type RankedLaptop struct {
+	Laptop       *pb.Laptop
+	Rating       *Rating
+	RankingScore float64
+}
+
+// BayesianRanker ranks laptops by the Bayesian average of their scores: the scores of each laptop
+// are averaged with priorWeight scores of priorScore, so that a laptop rated a few times
+// stays close to priorScore until it gets enough ratings
+type BayesianRanker struct {
+	ratingStore RatingStore
+	priorScore  float64
+	priorWeight float64
+}
+
+// NewBayesianRanker returns a new BayesianRanker over the ratings of ratingStore,
+// priorWeight must not be negative and priorScore must be in the score range
+func NewBayesianRanker(ratingStore RatingStore, priorScore float64, priorWeight float64) *BayesianRanker {
+	return &BayesianRanker{
+		ratingStore: ratingStore,
+		priorScore:  priorScore,
+		priorWeight: priorWeight,
+	}
+}
+
+// Score returns the ranking score of a rating
+func (ranker *BayesianRanker) Score(rating *Rating) float64 {
+	weight := ranker.priorWeight + float64(rating.Count)
+	if weight <= 0 {
+		return ranker.priorScore
+	}
+
+	return (ranker.priorWeight*ranker.priorScore + rating.Sum) / weight
+}
+
+// Rank returns the rated laptops, the best ranked first, at most limit of them if limit is positive.
+// The laptops with the same ranking score are ordered by their number of ratings, then by ID
+func (ranker *BayesianRanker) Rank(laptops []*pb.Laptop, limit int) ([]*RankedLaptop, error) {
+	ranked := make([]*RankedLaptop, 0, len(laptops))
+	for _, laptop := range laptops {
+		rating, err := ranker.ratingStore.Find(laptop.GetId())
+		if err != nil {
+			return nil, err
+		}
+		if rating == nil {
+			continue
+		}
+
+		ranked = append(ranked, &RankedLaptop{
+			Laptop:       laptop,
+			Rating:       rating,
+			RankingScore: ranker.Score(rating),
+		})
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].RankingScore != ranked[j].RankingScore {
+			return ranked[i].RankingScore > ranked[j].RankingScore
+		}
+		if ranked[i].Rating.Count != ranked[j].Rating.Count {
+			return ranked[i].Rating.Count > ranked[j].Rating.Count
+		}
+		return ranked[i].Laptop.GetId() < ranked[j].Laptop.GetId()
+	})
+
+	if limit > 0 && len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+
+	return ranked, nil
+}
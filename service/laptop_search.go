@@ -0,0 +1,194 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/warnshun/pcbook/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrInvalidPageToken error
+var ErrInvalidPageToken = errors.New("invalid page token")
+
+// pageCursor is the content of a page token, it points right after
+// the last laptop of the previous page in the requested order
+type pageCursor struct {
+	Query string  `json:"q"`
+	Key   float64 `json:"k"`
+	Id    string  `json:"i"`
+}
+
+// laptopPage sorts laptops and cuts them into pages
+type laptopPage struct {
+	sortBy     pb.SearchLaptopRequest_SortBy
+	descending bool
+	pageSize   int
+	query      string
+	rating     func(laptopId string) (float64, error)
+}
+
+type sortedLaptop struct {
+	laptop *pb.Laptop
+	key    float64
+}
+
+// newLaptopPage returns a laptopPage for the request,
+// rating is only called when sorting by average rating
+func newLaptopPage(req *pb.SearchLaptopRequest, rating func(laptopId string) (float64, error)) (*laptopPage, error) {
+	query, err := queryFingerprint(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &laptopPage{
+		sortBy:     req.GetSortBy(),
+		descending: req.GetDescending(),
+		pageSize:   int(req.GetPageSize()),
+		query:      query,
+		rating:     rating,
+	}, nil
+}
+
+// Cut sorts the laptops and returns those of the page after pageToken,
+// together with the token of the next page if there is one
+func (page *laptopPage) Cut(laptops []*pb.Laptop, pageToken string) ([]*pb.Laptop, string, error) {
+	sorted := make([]sortedLaptop, 0, len(laptops))
+	for _, laptop := range laptops {
+		key, err := page.sortKey(laptop)
+		if err != nil {
+			return nil, "", err
+		}
+
+		sorted = append(sorted, sortedLaptop{laptop: laptop, key: key})
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return page.less(sorted[i].key, sorted[i].laptop.GetId(), sorted[j].key, sorted[j].laptop.GetId())
+	})
+
+	start := 0
+	if pageToken != "" {
+		cursor, err := page.decode(pageToken)
+		if err != nil {
+			return nil, "", err
+		}
+
+		start = sort.Search(len(sorted), func(i int) bool {
+			return page.less(cursor.Key, cursor.Id, sorted[i].key, sorted[i].laptop.GetId())
+		})
+	}
+
+	end := len(sorted)
+	if page.pageSize > 0 && start+page.pageSize < end {
+		end = start + page.pageSize
+	}
+
+	result := make([]*pb.Laptop, 0, end-start)
+	for _, item := range sorted[start:end] {
+		result = append(result, item.laptop)
+	}
+
+	if end == len(sorted) {
+		return result, "", nil
+	}
+
+	last := sorted[end-1]
+	nextPageToken, err := page.encode(&pageCursor{
+		Query: page.query,
+		Key:   last.key,
+		Id:    last.laptop.GetId(),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return result, nextPageToken, nil
+}
+
+// less orders laptops by their sort key, then by ID so that the order is stable
+func (page *laptopPage) less(key1 float64, id1 string, key2 float64, id2 string) bool {
+	if key1 == key2 {
+		if page.descending {
+			return id1 > id2
+		}
+		return id1 < id2
+	}
+
+	if page.descending {
+		return key1 > key2
+	}
+	return key1 < key2
+}
+
+func (page *laptopPage) sortKey(laptop *pb.Laptop) (float64, error) {
+	switch page.sortBy {
+	case pb.SearchLaptopRequest_PRICE:
+		return laptop.GetPrice(), nil
+	case pb.SearchLaptopRequest_RELEASE_YEAR:
+		return float64(laptop.GetReleaseYear()), nil
+	case pb.SearchLaptopRequest_CPU_GHZ:
+		return laptop.GetCpu().GetMinGhz(), nil
+	case pb.SearchLaptopRequest_RAM:
+		return float64(toBit(laptop.GetRam())), nil
+	case pb.SearchLaptopRequest_AVERAGE_RATING:
+		return page.rating(laptop.GetId())
+	case pb.SearchLaptopRequest_UPDATED_AT:
+		// microseconds are exactly representable as float64
+		return float64(laptop.GetUpdatedAt().AsTime().UnixMicro()), nil
+	default:
+		return 0, nil
+	}
+}
+
+func (page *laptopPage) encode(cursor *pageCursor) (string, error) {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return "", fmt.Errorf("cannot encode page token: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func (page *laptopPage) decode(pageToken string) (*pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(pageToken)
+	if err != nil {
+		return nil, ErrInvalidPageToken
+	}
+
+	cursor := &pageCursor{}
+	err = json.Unmarshal(data, cursor)
+	if err != nil {
+		return nil, ErrInvalidPageToken
+	}
+
+	if cursor.Query != page.query {
+		return nil, fmt.Errorf("%w: it belongs to another search", ErrInvalidPageToken)
+	}
+
+	return cursor, nil
+}
+
+// queryFingerprint identifies the filter and order of a search,
+// so that a page token cannot be used to continue a different search
+func queryFingerprint(req *pb.SearchLaptopRequest) (string, error) {
+	query := &pb.SearchLaptopRequest{
+		Filter:     req.GetFilter(),
+		SortBy:     req.GetSortBy(),
+		Descending: req.GetDescending(),
+		Query:      req.GetQuery(),
+	}
+
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(query)
+	if err != nil {
+		return "", fmt.Errorf("cannot marshal search query: %w", err)
+	}
+
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:8]), nil
+}
@@ -1,38 +1,126 @@
 package service
 
 import (
-	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"math"
+	"sort"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/warnshun/pcbook/pb"
+	"github.com/warnshun/pcbook/query"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 const (
+	// MAX_IMAGE_SIZE is the default maximum size of the uploaded images
 	MAX_IMAGE_SIZE = 1 << 20 // 1 megabyte
 	// MAX_IMAGE_SIZE = 1 << 10 // 1 kilobyte
+	IMAGE_CHUNK_SIZE = 32 << 10 // 32 kilobytes
+	// MIN_LAPTOP_SCORE and MAX_LAPTOP_SCORE are the default range of the laptop scores
+	MIN_LAPTOP_SCORE = 1
+	MAX_LAPTOP_SCORE = 10
+	// DEFAULT_TOP_RATED_LIMIT and MAX_TOP_RATED_LIMIT are the default and maximum numbers of top rated laptops sent
+	DEFAULT_TOP_RATED_LIMIT = 10
+	MAX_TOP_RATED_LIMIT     = 100
 )
 
+// ErrInvalidLaptop error
+var ErrInvalidLaptop = errors.New("invalid laptop")
+
 // LaptopServer is the server API for Laptop service.
 type LaptopServer struct {
 	pb.UnimplementedLaptopServiceServer
 	laptopStore LaptopStore
 	imageStore  ImageStore
 	ratingStore RatingStore
+	uploadStore UploadStore
+	// maxImageSize is the maximum size of the uploaded images in bytes
+	maxImageSize int64
+	// allowedImageTypes are the MIME types of the images that can be uploaded
+	allowedImageTypes map[string]bool
+	// minScore and maxScore are the range of the laptop scores
+	minScore float64
+	maxScore float64
+	ranker   *BayesianRanker
+}
+
+// LaptopServerOption configures a LaptopServer
+type LaptopServerOption func(server *LaptopServer)
+
+// WithAllowedImageTypes restricts the uploaded images to the given MIME types,
+// all the supported types are allowed by default
+func WithAllowedImageTypes(mimeTypes ...string) LaptopServerOption {
+	return func(server *LaptopServer) {
+		server.allowedImageTypes = make(map[string]bool)
+		for _, mimeType := range mimeTypes {
+			server.allowedImageTypes[mimeType] = true
+		}
+	}
+}
+
+// WithMaxImageSize sets the maximum size of the uploaded images in bytes,
+// it is MAX_IMAGE_SIZE by default
+func WithMaxImageSize(maxImageSize int64) LaptopServerOption {
+	return func(server *LaptopServer) {
+		server.maxImageSize = maxImageSize
+	}
+}
+
+// WithUploadStore sets the store of the resumable image uploads,
+// they are kept in memory by default, which only suits small images
+func WithUploadStore(uploadStore UploadStore) LaptopServerOption {
+	return func(server *LaptopServer) {
+		server.uploadStore = uploadStore
+	}
+}
+
+// WithScoreRange sets the range of the laptop scores, both bounds included,
+// it is MIN_LAPTOP_SCORE to MAX_LAPTOP_SCORE by default.
+// The bounds must be finite with minScore less than maxScore, the server does not check them
+func WithScoreRange(minScore float64, maxScore float64) LaptopServerOption {
+	return func(server *LaptopServer) {
+		server.minScore = minScore
+		server.maxScore = maxScore
+	}
+}
+
+// WithRanker sets the ranker of the top rated laptops, by default it ranks the ratings of the server
+// with DEFAULT_PRIOR_WEIGHT scores in the middle of the score range
+func WithRanker(ranker *BayesianRanker) LaptopServerOption {
+	return func(server *LaptopServer) {
+		server.ranker = ranker
+	}
 }
 
 // NewLaptopServer returns a new LaptopServer.
-func NewLaptopServer(laptopStore LaptopStore, imageStore ImageStore, ratingStore RatingStore) *LaptopServer {
-	return &LaptopServer{
-		laptopStore: laptopStore,
-		imageStore:  imageStore,
-		ratingStore: ratingStore,
+func NewLaptopServer(laptopStore LaptopStore, imageStore ImageStore, ratingStore RatingStore, opts ...LaptopServerOption) *LaptopServer {
+	server := &LaptopServer{
+		laptopStore:  laptopStore,
+		imageStore:   imageStore,
+		ratingStore:  ratingStore,
+		uploadStore:  NewInMemoryUploadStore(),
+		maxImageSize: MAX_IMAGE_SIZE,
+		minScore:     MIN_LAPTOP_SCORE,
+		maxScore:     MAX_LAPTOP_SCORE,
+	}
+
+	WithAllowedImageTypes(SupportedImageTypes()...)(server)
+	for _, opt := range opts {
+		opt(server)
 	}
+
+	if server.ranker == nil {
+		server.ranker = NewBayesianRanker(ratingStore, (server.minScore+server.maxScore)/2, DEFAULT_PRIOR_WEIGHT)
+	}
+
+	return server
 }
 
 // CreateLaptop is a unary RPC to create a new laptop
@@ -54,6 +142,11 @@ func (s *LaptopServer) CreateLaptop(ctx context.Context, req *pb.CreateLaptopReq
 		laptop.Id = id.String()
 	}
 
+	err := validateLaptop(laptop)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
 	// some heavy processing
 	// time.Sleep(6 * time.Second)
 
@@ -63,7 +156,7 @@ func (s *LaptopServer) CreateLaptop(ctx context.Context, req *pb.CreateLaptopReq
 	}
 
 	// save the laptop in memory store
-	err := s.laptopStore.Save(laptop)
+	err = s.laptopStore.Save(laptop)
 	if err != nil {
 		code := codes.Internal
 		if errors.Is(err, ErrAlreadyExists) {
@@ -82,33 +175,407 @@ func (s *LaptopServer) CreateLaptop(ctx context.Context, req *pb.CreateLaptopReq
 	return res, nil
 }
 
-// SearchLaptop is a server-streaming RPC to search for laptops
+// GetLaptop is a unary RPC to get a laptop by ID together with its rating and images
+func (s *LaptopServer) GetLaptop(ctx context.Context, req *pb.GetLaptopRequest) (*pb.GetLaptopResponse, error) {
+	laptopId := req.GetId()
+	log.Printf("Received a GetLaptopRequest with id: %s", laptopId)
+
+	_, err := uuid.Parse(laptopId)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Laptop ID is not a valid UUID: %v", err)
+	}
+
+	laptop, err := s.laptopStore.Find(laptopId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find laptop: %v", err)
+	}
+	if laptop == nil {
+		return nil, status.Errorf(codes.NotFound, "laptop %s not found", laptopId)
+	}
+
+	res := &pb.GetLaptopResponse{
+		Laptop: laptop,
+	}
+
+	rating, err := s.ratingStore.Find(laptopId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find laptop rating: %v", err)
+	}
+	if rating != nil {
+		res.RatedCount = rating.Count
+		res.AverageScore = rating.Average()
+	}
+
+	images, err := s.imageStore.ListByLaptop(laptopId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list laptop images: %v", err)
+	}
+	for _, image := range images {
+		res.ImageIds = append(res.ImageIds, image.Id)
+		res.Images = append(res.Images, toImageMetadata(image))
+	}
+
+	return res, nil
+}
+
+// UpdateLaptop is a unary RPC to update an existing laptop,
+// only the fields listed in the update mask are changed, or all of them if the mask is empty
+func (s *LaptopServer) UpdateLaptop(ctx context.Context, req *pb.UpdateLaptopRequest) (*pb.UpdateLaptopResponse, error) {
+	laptop := req.GetLaptop()
+	mask := req.GetUpdateMask()
+	log.Printf("Received an UpdateLaptopRequest with id: %s, mask: %v", laptop.GetId(), mask.GetPaths())
+
+	_, err := uuid.Parse(laptop.GetId())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Laptop ID is not a valid UUID: %v", err)
+	}
+
+	if !mask.IsValid(laptop) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid update mask: %v", mask.GetPaths())
+	}
+
+	for _, path := range mask.GetPaths() {
+		if path == "id" {
+			return nil, status.Errorf(codes.InvalidArgument, "laptop ID cannot be updated")
+		}
+	}
+
+	// check context error
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+
+	var updated *pb.Laptop
+	if len(mask.GetPaths()) == 0 {
+		err = validateLaptop(laptop)
+		if err == nil {
+			laptop.UpdatedAt = timestamppb.Now()
+			err = s.laptopStore.Update(laptop)
+			updated = laptop
+		}
+	} else {
+		// the mask is applied under the lock of the store, so that concurrent updates of different fields are all kept
+		updated, err = s.laptopStore.Modify(laptop.GetId(), func(updated *pb.Laptop) error {
+			applyFieldMask(updated, laptop, mask.GetPaths())
+			updated.UpdatedAt = timestamppb.Now()
+			return validateLaptop(updated)
+		})
+	}
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrNotFound) {
+			code = codes.NotFound
+		}
+		if errors.Is(err, ErrInvalidLaptop) {
+			code = codes.InvalidArgument
+		}
+
+		return nil, status.Errorf(code, "cannot update laptop in the store: %v", err)
+	}
+
+	log.Printf("Updated laptop with id: %s", updated.GetId())
+
+	res := &pb.UpdateLaptopResponse{
+		Laptop: updated,
+	}
+
+	return res, nil
+}
+
+// DeleteLaptop is a unary RPC to delete a laptop
+func (s *LaptopServer) DeleteLaptop(ctx context.Context, req *pb.DeleteLaptopRequest) (*pb.DeleteLaptopResponse, error) {
+	laptopId := req.GetId()
+	log.Printf("Received a DeleteLaptopRequest with id: %s", laptopId)
+
+	_, err := uuid.Parse(laptopId)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Laptop ID is not a valid UUID: %v", err)
+	}
+
+	// check context error
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+
+	laptop, err := s.laptopStore.Find(laptopId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find laptop: %v", err)
+	}
+	if laptop == nil {
+		return nil, status.Errorf(codes.NotFound, "laptop %s not found", laptopId)
+	}
+
+	// the images are deleted first, so that the deletion can be retried if they cannot be
+	err = s.imageStore.DeleteByLaptop(laptopId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot delete laptop images: %v", err)
+	}
+
+	err = s.laptopStore.Delete(laptopId)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrNotFound) {
+			code = codes.NotFound
+		}
+
+		return nil, status.Errorf(code, "cannot delete laptop from the store: %v", err)
+	}
+
+	log.Printf("Deleted laptop with id: %s", laptopId)
+
+	res := &pb.DeleteLaptopResponse{
+		Id: laptopId,
+	}
+
+	return res, nil
+}
+
+// SearchLaptop is a server-streaming RPC to search for laptops,
+// the found laptops are sorted and paged as requested
 func (s *LaptopServer) SearchLaptop(req *pb.SearchLaptopRequest, stream pb.LaptopService_SearchLaptopServer) error {
 	filter := req.GetFilter()
-	log.Printf("receive a search-laptop request with filter: %v", filter)
+	log.Printf("receive a search-laptop request with filter: %v, query: %q", filter, req.GetQuery())
 
-	err := s.laptopStore.Search(
+	if req.GetQuery() != "" {
+		if filter != nil {
+			return status.Errorf(codes.InvalidArgument, "cannot search with both a filter and a query")
+		}
+
+		var err error
+		filter, err = query.Parse(req.GetQuery())
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "cannot parse query: %v", err)
+		}
+	}
+
+	err := validateFilter(filter)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid filter: %v", err)
+	}
+
+	page, err := newLaptopPage(req, s.averageRating)
+	if err != nil {
+		return status.Errorf(codes.Internal, "unexpected error: %v", err)
+	}
+
+	var laptops []*pb.Laptop
+	err = s.laptopStore.Search(
 		stream.Context(),
 		filter,
 		func(laptop *pb.Laptop) error {
-			res := &pb.SearchLaptopResponse{Laptop: laptop}
-			err := stream.Send(res)
-			if err != nil {
-				return err
-			}
-
-			log.Printf("sent laptop with id: %s", laptop.GetId())
+			laptops = append(laptops, laptop)
 			return nil
 		},
 	)
-
 	if err != nil {
 		return status.Errorf(codes.Internal, "unexpected error: %v", err)
 	}
 
+	// check context error
+	if err := contextError(stream.Context()); err != nil {
+		return err
+	}
+
+	laptops, nextPageToken, err := page.Cut(laptops, req.GetPageToken())
+	if err != nil {
+		if errors.Is(err, ErrInvalidPageToken) {
+			return status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+
+		return status.Errorf(codes.Internal, "cannot sort laptops: %v", err)
+	}
+
+	for _, laptop := range laptops {
+		res := &pb.SearchLaptopResponse{Laptop: laptop}
+		err := stream.Send(res)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("sent laptop with id: %s", laptop.GetId())
+	}
+
+	if nextPageToken != "" {
+		res := &pb.SearchLaptopResponse{NextPageToken: nextPageToken}
+		err := stream.Send(res)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// averageRating returns the average score of a laptop, 0 if it has not been rated yet
+func (s *LaptopServer) averageRating(laptopId string) (float64, error) {
+	rating, err := s.ratingStore.Find(laptopId)
+	if err != nil || rating == nil {
+		return 0, err
+	}
+
+	return rating.Average(), nil
+}
+
+// TopRatedLaptops is a unary RPC to get the best ranked laptops matching a filter,
+// the laptops that are not rated yet are not ranked
+func (s *LaptopServer) TopRatedLaptops(ctx context.Context, req *pb.TopRatedLaptopsRequest) (*pb.TopRatedLaptopsResponse, error) {
+	filter := req.GetFilter()
+	log.Printf("receive a top-rated-laptops request with filter: %v, limit: %d", filter, req.GetLimit())
+
+	limit := int(req.GetLimit())
+	if limit == 0 {
+		limit = DEFAULT_TOP_RATED_LIMIT
+	}
+	if limit > MAX_TOP_RATED_LIMIT {
+		return nil, status.Errorf(codes.InvalidArgument, "limit %d is greater than %d", limit, MAX_TOP_RATED_LIMIT)
+	}
+
+	var laptops []*pb.Laptop
+	err := s.laptopStore.Search(
+		ctx,
+		filter,
+		func(laptop *pb.Laptop) error {
+			laptops = append(laptops, laptop)
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unexpected error: %v", err)
+	}
+
+	// check context error
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+
+	ranked, err := s.ranker.Rank(laptops, limit)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot rank laptops: %v", err)
+	}
+
+	res := &pb.TopRatedLaptopsResponse{}
+	for _, item := range ranked {
+		res.Laptops = append(res.Laptops, &pb.RankedLaptop{
+			Laptop:       item.Laptop,
+			RatedCount:   item.Rating.Count,
+			AverageScore: item.Rating.Average(),
+			RankingScore: item.RankingScore,
+		})
+	}
+
+	return res, nil
+}
+
+// WatchLaptops is a server-streaming RPC to receive the changes of the laptops matching a filter,
+// optionally after the laptops already matching it
+func (s *LaptopServer) WatchLaptops(req *pb.WatchLaptopsRequest, stream pb.LaptopService_WatchLaptopsServer) error {
+	filter := req.GetFilter()
+	log.Printf("receive a watch-laptops request with filter: %v, replay: %v", filter, req.GetReplay())
+
+	// subscribe before replaying, so that no change is missed in between
+	subscription := s.laptopStore.Subscribe()
+	defer subscription.Close()
+
+	if req.GetReplay() {
+		// collect the laptops first, so that a slow client does not keep the store busy
+		var laptops []*pb.Laptop
+		err := s.laptopStore.Search(
+			stream.Context(),
+			filter,
+			func(laptop *pb.Laptop) error {
+				laptops = append(laptops, laptop)
+				return nil
+			},
+		)
+		if err != nil {
+			return logErrors(status.Errorf(codes.Internal, "cannot replay laptops: %v", err))
+		}
+
+		for _, laptop := range laptops {
+			res := &pb.WatchLaptopsResponse{
+				Type:   pb.WatchLaptopsResponse_EXISTING,
+				Laptop: laptop,
+			}
+			err := stream.Send(res)
+			if err != nil {
+				return logErrors(status.Errorf(codes.Unknown, "cannot send laptop: %v", err))
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return contextError(stream.Context())
+		case event, ok := <-subscription.Events():
+			if !ok {
+				return logErrors(status.Errorf(codes.ResourceExhausted, "stopped watching laptops: %v", subscription.Err()))
+			}
+
+			if !event.Matches(filter) {
+				continue
+			}
+
+			res := &pb.WatchLaptopsResponse{
+				Type:   event.TypeFor(filter),
+				Laptop: event.Laptop,
+			}
+			err := stream.Send(res)
+			if err != nil {
+				return logErrors(status.Errorf(codes.Unknown, "cannot send laptop event: %v", err))
+			}
+
+			log.Printf("sent %v event of laptop with id: %s", res.GetType(), event.Laptop.GetId())
+		}
+	}
+}
+
+// StartUpload is a unary RPC to start a resumable upload of a laptop image
+func (s *LaptopServer) StartUpload(ctx context.Context, req *pb.StartUploadRequest) (*pb.StartUploadResponse, error) {
+	laptopId := req.GetLaptopId()
+	log.Printf("Received a StartUploadRequest for laptop %s", laptopId)
+
+	laptop, err := s.laptopStore.Find(laptopId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find laptop: %v", err)
+	}
+	if laptop == nil {
+		return nil, status.Errorf(codes.NotFound, "laptop %s not found", laptopId)
+	}
+
+	uploadId, err := s.uploadStore.Start(laptopId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot start upload: %v", err)
+	}
+
+	res := &pb.StartUploadResponse{
+		UploadId: uploadId,
+	}
+
+	return res, nil
+}
+
+// GetUploadStatus is a unary RPC to get the offset from which a resumable upload continues
+func (s *LaptopServer) GetUploadStatus(ctx context.Context, req *pb.GetUploadStatusRequest) (*pb.GetUploadStatusResponse, error) {
+	uploadId := req.GetUploadId()
+	log.Printf("Received a GetUploadStatusRequest for upload %s", uploadId)
+
+	session, err := s.uploadStore.Find(uploadId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find upload: %v", err)
+	}
+	if session == nil {
+		return nil, status.Errorf(codes.NotFound, "upload %s not found", uploadId)
+	}
+
+	res := &pb.GetUploadStatusResponse{
+		UploadId: uploadId,
+		Offset:   uint64(session.Size),
+	}
+
+	return res, nil
+}
+
 // UploadImage is a client-streaming RPC to upload the laptop image
 func (s *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServer) error {
 	req, err := stream.Recv()
@@ -116,6 +583,10 @@ func (s *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServer) er
 		return logErrors(status.Error(codes.Unknown, "cannot receive image info"))
 	}
 
+	if uploadId := req.GetUploadId(); uploadId != "" {
+		return s.resumeUpload(stream, uploadId)
+	}
+
 	laptopId := req.GetInfo().GetLaptopId()
 	imageType := req.GetInfo().GetImageType()
 	log.Printf("receive an image upload request for laptop %s with image type %s", laptopId, imageType)
@@ -128,53 +599,156 @@ func (s *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServer) er
 		return logErrors(status.Errorf(codes.InvalidArgument, "laptop %s not found", laptopId))
 	}
 
-	imageData := bytes.Buffer{}
-	imageSize := 0
+	reader := &chunkReader{
+		stream:  stream,
+		maxSize: s.maxImageSize,
+	}
+
+	imageId, mimeType, err := s.saveImage(laptopId, reader)
+	if err != nil {
+		return logErrors(err)
+	}
+
+	imageSize := reader.size
+
+	res := &pb.UploadImageResponse{
+		Id:   imageId,
+		Size: uint32(imageSize),
+	}
+
+	err = stream.SendAndClose(res)
+	if err != nil {
+		return logErrors(status.Errorf(codes.Unknown, "cannot send response: %v", err))
+	}
+
+	log.Printf("saved image with id: %s, type: %s, size: %d", imageId, mimeType, imageSize)
+	return nil
+}
+
+// resumeUpload receives the chunks of a resumable upload,
+// the chunks received are kept even if the stream breaks, and the image is saved once committed
+func (s *LaptopServer) resumeUpload(stream pb.LaptopService_UploadImageServer, uploadId string) error {
+	session, err := s.uploadStore.Find(uploadId)
+	if err != nil {
+		return logErrors(status.Errorf(codes.Internal, "cannot find upload: %v", err))
+	}
+	if session == nil {
+		return logErrors(status.Errorf(codes.NotFound, "upload %s not found", uploadId))
+	}
+
+	log.Printf("resume upload %s for laptop %s from offset %d", uploadId, session.LaptopId, session.Size)
 
 	for {
-		// check context error
 		if err := contextError(stream.Context()); err != nil {
 			return err
 		}
 
-		log.Print("waiting to receive more data")
-
 		req, err := stream.Recv()
 		if err == io.EOF {
-			log.Print("no more data")
-			break
+			return s.sendUploadProgress(stream, uploadId)
 		}
 		if err != nil {
-			return logErrors(status.Errorf(codes.Unknown, "cannot receive chunk data: %v", err))
+			return logErrors(status.Errorf(codes.Unknown, "cannot receive chunk: %v", err))
 		}
 
-		chunk := req.GetChunkData()
-		size := len(chunk)
+		switch data := req.GetData().(type) {
+		case *pb.UploadImageRequest_Chunk:
+			offset := data.Chunk.GetOffset()
+			chunk := data.Chunk.GetData()
+
+			// the offset is checked first so that the end cannot overflow
+			if offset > uint64(s.maxImageSize) {
+				return logErrors(status.Errorf(codes.InvalidArgument, "image is too large: offset %d > %d", offset, s.maxImageSize))
+			}
 
-		log.Printf("received a chunk with size: %d", size)
+			end := offset + uint64(len(chunk))
+			if end > uint64(s.maxImageSize) {
+				return logErrors(status.Errorf(codes.InvalidArgument, "image is too large: %d > %d", end, s.maxImageSize))
+			}
 
-		imageSize += size
-		if imageSize > MAX_IMAGE_SIZE {
-			return logErrors(status.Errorf(codes.InvalidArgument, "image is too large: %d > %d", imageSize, MAX_IMAGE_SIZE))
+			_, err := s.uploadStore.Append(uploadId, int64(offset), chunk)
+			if err != nil {
+				return logErrors(uploadError(uploadId, err))
+			}
+		case *pb.UploadImageRequest_Commit:
+			return s.commitUpload(stream, session, data.Commit.GetSha256())
+		default:
+			return logErrors(status.Errorf(codes.InvalidArgument, "expected a chunk or the commit of upload %s", uploadId))
 		}
+	}
+}
+
+// sendUploadProgress answers a resumable upload that ended before its commit
+func (s *LaptopServer) sendUploadProgress(stream pb.LaptopService_UploadImageServer, uploadId string) error {
+	session, err := s.uploadStore.Find(uploadId)
+	if err != nil {
+		return logErrors(status.Errorf(codes.Internal, "cannot find upload: %v", err))
+	}
+	if session == nil {
+		return logErrors(status.Errorf(codes.NotFound, "upload %s not found", uploadId))
+	}
+
+	res := &pb.UploadImageResponse{
+		UploadId: uploadId,
+		Offset:   uint64(session.Size),
+	}
+
+	err = stream.SendAndClose(res)
+	if err != nil {
+		return logErrors(status.Errorf(codes.Unknown, "cannot send response: %v", err))
+	}
 
-		// write slowly
-		// time.Sleep(1 * time.Second)
+	log.Printf("upload %s paused at offset %d", uploadId, session.Size)
+	return nil
+}
 
-		_, err = imageData.Write(chunk)
+// commitUpload verifies the checksum of a resumable upload and saves its image,
+// the upload is dropped if its laptop has been deleted since it started
+func (s *LaptopServer) commitUpload(stream pb.LaptopService_UploadImageServer, session *UploadSession, checksum []byte) error {
+	laptop, err := s.laptopStore.Find(session.LaptopId)
+	if err != nil {
+		return logErrors(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+	}
+	if laptop == nil {
+		err := s.uploadStore.Delete(session.Id)
 		if err != nil {
-			return logErrors(status.Errorf(codes.Internal, "cannot write image data: %v", err))
+			return logErrors(status.Errorf(codes.Internal, "cannot delete upload: %v", err))
 		}
+
+		return logErrors(status.Errorf(codes.NotFound, "laptop %s of upload %s not found", session.LaptopId, session.Id))
+	}
+
+	file, err := s.uploadStore.Open(session.Id)
+	if err != nil {
+		return logErrors(uploadError(session.Id, err))
+	}
+	defer file.Close()
+
+	reader := newChecksumReader(file, checksum)
+	imageId, mimeType, err := s.saveImage(session.LaptopId, reader)
+	if status.Code(err) == codes.DataLoss {
+		// the upload cannot be resumed from a corrupted chunk, so it is dropped
+		err := s.uploadStore.Delete(session.Id)
+		if err != nil {
+			return logErrors(status.Errorf(codes.Internal, "cannot delete upload: %v", err))
+		}
+
+		return logErrors(status.Errorf(codes.DataLoss, "checksum of upload %s does not match, it must be started again", session.Id))
+	}
+	if err != nil {
+		return logErrors(err)
 	}
 
-	imageId, err := s.imageStore.Save(laptopId, imageType, imageData)
+	err = s.uploadStore.Delete(session.Id)
 	if err != nil {
-		return logErrors(status.Errorf(codes.Internal, "cannot save image to the store: %v", err))
+		return logErrors(status.Errorf(codes.Internal, "cannot delete upload: %v", err))
 	}
 
 	res := &pb.UploadImageResponse{
-		Id:   imageId,
-		Size: uint32(imageSize),
+		Id:       imageId,
+		Size:     uint32(reader.size),
+		UploadId: session.Id,
+		Offset:   uint64(reader.size),
 	}
 
 	err = stream.SendAndClose(res)
@@ -182,12 +756,277 @@ func (s *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServer) er
 		return logErrors(status.Errorf(codes.Unknown, "cannot send response: %v", err))
 	}
 
-	log.Printf("saved image with id: %s, size: %d", imageId, imageSize)
+	log.Printf("saved image of upload %s with id: %s, type: %s, size: %d", session.Id, imageId, mimeType, reader.size)
+	return nil
+}
+
+// uploadError converts an error of the upload store to a status error
+func uploadError(uploadId string, err error) error {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return status.Errorf(codes.NotFound, "upload %s not found", uploadId)
+	case errors.Is(err, ErrUploadGap):
+		return status.Errorf(codes.OutOfRange, "cannot continue upload %s: %v", uploadId, err)
+	default:
+		return status.Errorf(codes.Internal, "cannot continue upload %s: %v", uploadId, err)
+	}
+}
+
+// checkImageType detects the MIME type of an image and checks that it is allowed
+func (s *LaptopServer) checkImageType(data []byte) (string, error) {
+	mimeType := detectImageType(data)
+	if !s.allowedImageTypes[mimeType] {
+		return "", status.Errorf(codes.InvalidArgument, "image type %s is not allowed", mimeType)
+	}
+
+	return mimeType, nil
+}
+
+// DownloadImage is a server-streaming RPC to download a laptop image,
+// the image metadata is sent first, then the image data in chunks
+func (s *LaptopServer) DownloadImage(req *pb.DownloadImageRequest, stream pb.LaptopService_DownloadImageServer) error {
+	imageId := req.GetImageId()
+	variant := req.GetVariant()
+	log.Printf("receive a download-image request for image %s, variant %q", imageId, variant)
+
+	info, err := s.imageStore.Find(imageId)
+	if err != nil {
+		return logErrors(status.Errorf(codes.Internal, "cannot find image: %v", err))
+	}
+	if info == nil {
+		return logErrors(status.Errorf(codes.NotFound, "image %s not found", imageId))
+	}
+
+	metadata := toImageMetadata(info)
+	if variant != "" {
+		variantInfo := info.Variants[variant]
+		if variantInfo == nil {
+			return logErrors(status.Errorf(codes.NotFound, "image %s has no variant %q", imageId, variant))
+		}
+
+		metadata.Variant = variant
+		metadata.ImageType = variantInfo.Type
+		metadata.MimeType = variantInfo.MimeType
+		metadata.Size = uint64(variantInfo.Size)
+		metadata.Width = uint32(variantInfo.Width)
+		metadata.Height = uint32(variantInfo.Height)
+	}
+
+	file, err := s.imageStore.Open(imageId, variant)
+	if err != nil {
+		return logErrors(status.Errorf(codes.Internal, "cannot open image: %v", err))
+	}
+	defer file.Close()
+
+	res := &pb.DownloadImageResponse{
+		Data: &pb.DownloadImageResponse_Metadata{
+			Metadata: metadata,
+		},
+	}
+
+	err = stream.Send(res)
+	if err != nil {
+		return logErrors(status.Errorf(codes.Unknown, "cannot send image metadata: %v", err))
+	}
+
+	buffer := make([]byte, IMAGE_CHUNK_SIZE)
+	for {
+		if err := contextError(stream.Context()); err != nil {
+			return err
+		}
+
+		n, err := file.Read(buffer)
+		if n > 0 {
+			res := &pb.DownloadImageResponse{
+				Data: &pb.DownloadImageResponse_ChunkData{
+					ChunkData: buffer[:n],
+				},
+			}
+
+			err := stream.Send(res)
+			if err != nil {
+				return logErrors(status.Errorf(codes.Unknown, "cannot send chunk data: %v", err))
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return logErrors(status.Errorf(codes.Internal, "cannot read image data: %v", err))
+		}
+	}
+
+	log.Printf("sent image with id: %s, variant %q, size: %d", imageId, variant, metadata.GetSize())
 	return nil
 }
 
+// ListImages is a unary RPC to list the images of a laptop in display order
+func (s *LaptopServer) ListImages(ctx context.Context, req *pb.ListImagesRequest) (*pb.ListImagesResponse, error) {
+	laptopId := req.GetLaptopId()
+	log.Printf("Received a ListImagesRequest with laptop id: %s", laptopId)
+
+	laptop, err := s.laptopStore.Find(laptopId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find laptop: %v", err)
+	}
+	if laptop == nil {
+		return nil, status.Errorf(codes.NotFound, "laptop %s not found", laptopId)
+	}
+
+	images, err := s.imageStore.ListByLaptop(laptopId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list laptop images: %v", err)
+	}
+
+	res := &pb.ListImagesResponse{}
+	for _, image := range images {
+		res.Images = append(res.Images, toImageMetadata(image))
+	}
+
+	return res, nil
+}
+
+// DeleteImage is a unary RPC to delete a laptop image
+func (s *LaptopServer) DeleteImage(ctx context.Context, req *pb.DeleteImageRequest) (*pb.DeleteImageResponse, error) {
+	imageId := req.GetImageId()
+	log.Printf("Received a DeleteImageRequest with id: %s", imageId)
+
+	// check context error
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+
+	err := s.imageStore.Delete(imageId)
+	if err != nil {
+		return nil, imageError(imageId, "cannot delete image from the store", err)
+	}
+
+	log.Printf("Deleted image with id: %s", imageId)
+
+	res := &pb.DeleteImageResponse{
+		ImageId: imageId,
+	}
+
+	return res, nil
+}
+
+// SetPrimaryImage is a unary RPC to choose the main image of a laptop
+func (s *LaptopServer) SetPrimaryImage(ctx context.Context, req *pb.SetPrimaryImageRequest) (*pb.SetPrimaryImageResponse, error) {
+	imageId := req.GetImageId()
+	log.Printf("Received a SetPrimaryImageRequest with id: %s", imageId)
+
+	info, err := s.imageStore.Find(imageId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find image: %v", err)
+	}
+	if info == nil {
+		return nil, status.Errorf(codes.NotFound, "image %s not found", imageId)
+	}
+
+	err = s.imageStore.SetPrimary(imageId)
+	if err != nil {
+		return nil, imageError(imageId, "cannot set primary image", err)
+	}
+
+	images, err := s.listImageMetadata(info.LaptopId)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.SetPrimaryImageResponse{
+		Images: images,
+	}
+
+	return res, nil
+}
+
+// ReorderImages is a unary RPC to change the display order of the images of a laptop
+func (s *LaptopServer) ReorderImages(ctx context.Context, req *pb.ReorderImagesRequest) (*pb.ReorderImagesResponse, error) {
+	laptopId := req.GetLaptopId()
+	log.Printf("Received a ReorderImagesRequest with laptop id: %s, images: %v", laptopId, req.GetImageIds())
+
+	laptop, err := s.laptopStore.Find(laptopId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find laptop: %v", err)
+	}
+	if laptop == nil {
+		return nil, status.Errorf(codes.NotFound, "laptop %s not found", laptopId)
+	}
+
+	err = s.imageStore.Reorder(laptopId, req.GetImageIds())
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrInvalidImageOrder) {
+			code = codes.InvalidArgument
+		}
+
+		return nil, status.Errorf(code, "cannot reorder images: %v", err)
+	}
+
+	images, err := s.listImageMetadata(laptopId)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.ReorderImagesResponse{
+		Images: images,
+	}
+
+	return res, nil
+}
+
+// listImageMetadata returns the metadata of the images of a laptop in display order
+func (s *LaptopServer) listImageMetadata(laptopId string) ([]*pb.ImageMetadata, error) {
+	images, err := s.imageStore.ListByLaptop(laptopId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list laptop images: %v", err)
+	}
+
+	var metadata []*pb.ImageMetadata
+	for _, image := range images {
+		metadata = append(metadata, toImageMetadata(image))
+	}
+
+	return metadata, nil
+}
+
+// imageError converts an error of the image store to a status error
+func imageError(imageId string, message string, err error) error {
+	if errors.Is(err, ErrNotFound) {
+		return status.Errorf(codes.NotFound, "image %s not found", imageId)
+	}
+
+	return status.Errorf(codes.Internal, "%s: %v", message, err)
+}
+
+func toImageMetadata(info *ImageInfo) *pb.ImageMetadata {
+	metadata := &pb.ImageMetadata{
+		Id:        info.Id,
+		LaptopId:  info.LaptopId,
+		ImageType: info.Type,
+		MimeType:  info.MimeType,
+		Size:      uint64(info.Size),
+		Width:     uint32(info.Width),
+		Height:    uint32(info.Height),
+		Primary:   info.Primary,
+	}
+
+	for name := range info.Variants {
+		metadata.Variants = append(metadata.Variants, name)
+	}
+	sort.Strings(metadata.Variants)
+
+	return metadata
+}
+
 // RateLaptop is a bidirectional-streaming RPC to rate a laptop
+// each user has one score per laptop, rating a laptop again replaces the previous score
 func (s *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer) error {
+	claims := ClaimsFromContext(stream.Context())
+	if claims == nil {
+		return logErrors(status.Errorf(codes.Unauthenticated, "cannot rate a laptop without a user"))
+	}
+
 	for {
 		err := contextError(stream.Context())
 		if err != nil {
@@ -203,40 +1042,186 @@ func (s *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer) erro
 			return logErrors(status.Errorf(codes.Unknown, "cannot receive stream request: %v", err))
 		}
 
-		laptopId := req.GetLaptopId()
-		score := req.GetScore()
-
-		log.Printf("received a rate-laptop request: id = %s, score = %.2f", laptopId, score)
-
-		found, err := s.laptopStore.Find(laptopId)
+		res, err := s.rateLaptop(claims.Username, req)
 		if err != nil {
-			return logErrors(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
-		}
-		if found == nil {
-			return logErrors(status.Errorf(codes.InvalidArgument, "laptopID %s not found", laptopId))
+			return logErrors(err)
 		}
 
-		rating, err := s.ratingStore.Add(laptopId, score)
+		err = stream.Send(res)
 		if err != nil {
-			return logErrors(status.Errorf(codes.Internal, "cannot add rating to the store: %v", err))
+			return logErrors(status.Errorf(codes.Unknown, "cannot send stream response: %v", err))
 		}
 
-		res := &pb.RateLaptopResponse{
-			LaptopId:     laptopId,
-			RatedCount:   rating.Count,
-			AverageScore: rating.Sum / float64(rating.Count),
+		// log.Printf("sent a rate-laptop response: %v", res)
+	}
+	return nil
+}
+
+// rateLaptop adds the score of a request, an invalid request is reported in the status of the response,
+// an error is only returned when the stream cannot go on
+func (s *LaptopServer) rateLaptop(username string, req *pb.RateLaptopRequest) (*pb.RateLaptopResponse, error) {
+	laptopId := req.GetLaptopId()
+	score := req.GetScore()
+
+	log.Printf("received a rate-laptop request: id = %s, score = %.2f, user = %s", laptopId, score, username)
+
+	// the comparisons are false for NaN
+	if !(score >= s.minScore && score <= s.maxScore) {
+		return rateLaptopError(laptopId, status.Newf(codes.InvalidArgument, "score %v is not between %v and %v", score, s.minScore, s.maxScore)), nil
+	}
+
+	found, err := s.laptopStore.Find(laptopId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find laptop: %v", err)
+	}
+	if found == nil {
+		return rateLaptopError(laptopId, status.Newf(codes.NotFound, "laptopID %s not found", laptopId)), nil
+	}
+
+	rating, err := s.ratingStore.Add(laptopId, username, score)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot add rating to the store: %v", err)
+	}
+
+	return &pb.RateLaptopResponse{
+		LaptopId:     laptopId,
+		RatedCount:   rating.Count,
+		AverageScore: rating.Average(),
+		Status: &pb.RateLaptopStatus{
+			Code: int32(codes.OK),
+		},
+	}, nil
+}
+
+func rateLaptopError(laptopId string, st *status.Status) *pb.RateLaptopResponse {
+	log.Print(st.Err())
+
+	return &pb.RateLaptopResponse{
+		LaptopId: laptopId,
+		Status: &pb.RateLaptopStatus{
+			Code:    int32(st.Code()),
+			Message: st.Message(),
+		},
+	}
+}
+
+// GetMyRatings is a unary RPC to list the scores given by the user to laptops
+func (s *LaptopServer) GetMyRatings(ctx context.Context, req *pb.GetMyRatingsRequest) (*pb.GetMyRatingsResponse, error) {
+	claims := ClaimsFromContext(ctx)
+	if claims == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "cannot get the ratings without a user")
+	}
+
+	ratings, err := s.ratingStore.FindByUser(claims.Username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find ratings: %v", err)
+	}
+
+	res := &pb.GetMyRatingsResponse{}
+	for _, rating := range ratings {
+		res.Ratings = append(res.Ratings, &pb.MyRating{
+			LaptopId: rating.LaptopId,
+			Score:    rating.Score,
+			RatedAt:  timestamppb.New(rating.RatedAt),
+		})
+	}
+
+	return res, nil
+}
+
+// GetRatingStats is a unary RPC to get the statistics of the scores of a laptop
+func (s *LaptopServer) GetRatingStats(ctx context.Context, req *pb.GetRatingStatsRequest) (*pb.GetRatingStatsResponse, error) {
+	laptopId := req.GetLaptopId()
+	log.Printf("Received a GetRatingStatsRequest with laptop id: %s", laptopId)
+
+	for _, window := range req.GetWindows() {
+		if window.Start != nil && window.End != nil && !window.GetStart().AsTime().Before(window.GetEnd().AsTime()) {
+			return nil, status.Errorf(codes.InvalidArgument, "time window start %v is not before its end %v", window.GetStart().AsTime(), window.GetEnd().AsTime())
 		}
+	}
 
-		err = stream.Send(res)
-		if err != nil {
-			return logErrors(status.Errorf(codes.Unknown, "cannot send stream response: %v", err))
+	laptop, err := s.laptopStore.Find(laptopId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find laptop: %v", err)
+	}
+	if laptop == nil {
+		return nil, status.Errorf(codes.NotFound, "laptop %s not found", laptopId)
+	}
+
+	history, err := s.ratingStore.History(laptopId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find rating history: %v", err)
+	}
+
+	scores := latestScores(history, time.Time{}, time.Time{})
+	res := &pb.GetRatingStatsResponse{
+		LaptopId:     laptopId,
+		RatedCount:   uint32(len(scores)),
+		AverageScore: averageScore(scores),
+		MedianScore:  medianScore(scores),
+		Histogram:    scoreHistogram(scores, s.minScore, s.maxScore),
+	}
+
+	for _, window := range req.GetWindows() {
+		var start, end time.Time
+		if window.Start != nil {
+			start = window.GetStart().AsTime()
+		}
+		if window.End != nil {
+			end = window.GetEnd().AsTime()
 		}
 
-		// log.Printf("sent a rate-laptop response: %v", res)
+		scores := latestScores(history, start, end)
+		res.Windows = append(res.Windows, &pb.WindowRating{
+			Window:       window,
+			RatedCount:   uint32(len(scores)),
+			AverageScore: averageScore(scores),
+		})
 	}
+
+	return res, nil
+}
+
+// validateLaptop checks the numbers the laptops are indexed and sorted by,
+// NaN would break their order
+func validateLaptop(laptop *pb.Laptop) error {
+	if !isFinite(laptop.GetPrice()) {
+		return fmt.Errorf("%w: price %v is not a finite number", ErrInvalidLaptop, laptop.GetPrice())
+	}
+	if !isFinite(laptop.GetCpu().GetMinGhz()) || !isFinite(laptop.GetCpu().GetMaxGhz()) {
+		return fmt.Errorf("%w: CPU frequency is not a finite number", ErrInvalidLaptop)
+	}
+
 	return nil
 }
 
+// validateFilter checks the bounds of a search filter,
+// NaN or infinite bounds would not select the same laptops from the indexes as from a scan
+func validateFilter(filter *pb.Filter) error {
+	bounds := []struct {
+		name  string
+		value float64
+	}{
+		{"min_price", filter.GetMinPrice()},
+		{"max_price", filter.GetMaxPrice()},
+		{"min_cpu_ghz", filter.GetMinCpuGhz()},
+		{"min_screen_size_inch", float64(filter.GetMinScreenSizeInch())},
+		{"max_screen_size_inch", float64(filter.GetMaxScreenSizeInch())},
+		{"max_weight_kg", filter.GetMaxWeightKg()},
+	}
+	for _, bound := range bounds {
+		if !isFinite(bound.value) {
+			return fmt.Errorf("%s %v is not a finite number", bound.name, bound.value)
+		}
+	}
+
+	return nil
+}
+
+func isFinite(value float64) bool {
+	return !math.IsNaN(value) && !math.IsInf(value, 0)
+}
+
 func contextError(ctx context.Context) error {
 	switch ctx.Err() {
 	// check context canceled
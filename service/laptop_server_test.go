@@ -1,7 +1,10 @@
 package service_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"math"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -10,6 +13,7 @@ import (
 	"github.com/warnshun/pcbook/service"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 )
 
 func TestServerCreateLaptop(t *testing.T) {
@@ -21,6 +25,9 @@ func TestServerCreateLaptop(t *testing.T) {
 	laptopIncalidId := sample.NewLaptop()
 	laptopIncalidId.Id = "invalid-uuid"
 
+	laptopNaNPrice := sample.NewLaptop()
+	laptopNaNPrice.Price = math.NaN()
+
 	laptopDuplicateId := sample.NewLaptop()
 	storeDuplicateId := service.NewInMemoryLaptopStore()
 	err := storeDuplicateId.Save(laptopDuplicateId)
@@ -57,6 +64,12 @@ func TestServerCreateLaptop(t *testing.T) {
 			laptopStore: storeDuplicateId,
 			code:        codes.AlreadyExists,
 		},
+		{
+			name:        "failure_nan_price",
+			laptop:      laptopNaNPrice,
+			laptopStore: service.NewInMemoryLaptopStore(),
+			code:        codes.InvalidArgument,
+		},
 	}
 
 	for i := range testCases {
@@ -88,3 +101,206 @@ func TestServerCreateLaptop(t *testing.T) {
 		})
 	}
 }
+
+func TestServerUpdateLaptop(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	changes := sample.NewLaptop()
+	changes.Id = laptop.Id
+	changes.Price = 999
+	changes.Weight = &pb.Laptop_WeightLb{WeightLb: 4.2}
+
+	testCases := []struct {
+		name   string
+		laptop *pb.Laptop
+		paths  []string
+		code   codes.Code
+	}{
+		{
+			name:   "success_partial",
+			laptop: changes,
+			paths:  []string{"price", "weight_lb", "cpu.min_ghz"},
+			code:   codes.OK,
+		},
+		{
+			name:   "failure_invalid_id",
+			laptop: &pb.Laptop{Id: "invalid-uuid"},
+			code:   codes.InvalidArgument,
+		},
+		{
+			name:   "failure_invalid_mask",
+			laptop: changes,
+			paths:  []string{"no_such_field"},
+			code:   codes.InvalidArgument,
+		},
+		{
+			name:   "failure_not_found",
+			laptop: sample.NewLaptop(),
+			code:   codes.NotFound,
+		},
+		{
+			name:   "failure_infinite_price",
+			laptop: &pb.Laptop{Id: laptop.Id, Price: math.Inf(1)},
+			paths:  []string{"price"},
+			code:   codes.InvalidArgument,
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := &pb.UpdateLaptopRequest{
+				Laptop:     tc.laptop,
+				UpdateMask: &fieldmaskpb.FieldMask{Paths: tc.paths},
+			}
+
+			server := service.NewLaptopServer(laptopStore, nil, nil)
+			res, err := server.UpdateLaptop(context.Background(), req)
+			if tc.code != codes.OK {
+				require.Error(t, err)
+				require.Nil(t, res)
+				st, ok := status.FromError(err)
+				require.True(t, ok)
+				require.Equal(t, tc.code, st.Code())
+				return
+			}
+
+			require.NoError(t, err)
+
+			updated, err := laptopStore.Find(laptop.Id)
+			require.NoError(t, err)
+			require.Equal(t, changes.GetPrice(), updated.GetPrice())
+			require.Equal(t, changes.GetWeightLb(), updated.GetWeightLb())
+			require.Equal(t, changes.GetCpu().GetMinGhz(), updated.GetCpu().GetMinGhz())
+			require.Equal(t, laptop.GetCpu().GetName(), updated.GetCpu().GetName())
+			require.Equal(t, laptop.GetBrand(), updated.GetBrand())
+			require.True(t, updated.GetUpdatedAt().AsTime().After(laptop.GetUpdatedAt().AsTime()))
+			requireSameLaptop(t, updated, res.GetLaptop())
+		})
+	}
+}
+
+func TestServerUpdateLaptopConcurrent(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	server := service.NewLaptopServer(laptopStore, nil, nil)
+
+	// each update changes another field, none of the changes is lost
+	n := 20
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		changes := &pb.Laptop{Id: laptop.GetId(), Price: 1000}
+		paths := []string{"price"}
+		if i%2 == 1 {
+			changes = &pb.Laptop{Id: laptop.GetId(), ReleaseYear: 2030}
+			paths = []string{"release_year"}
+		}
+
+		go func() {
+			_, err := server.UpdateLaptop(context.Background(), &pb.UpdateLaptopRequest{
+				Laptop:     changes,
+				UpdateMask: &fieldmaskpb.FieldMask{Paths: paths},
+			})
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		require.NoError(t, <-errs)
+	}
+
+	updated, err := laptopStore.Find(laptop.GetId())
+	require.NoError(t, err)
+	require.Equal(t, 1000.0, updated.GetPrice())
+	require.Equal(t, uint32(2030), updated.GetReleaseYear())
+	require.Equal(t, laptop.GetBrand(), updated.GetBrand())
+}
+
+func TestServerDeleteLaptop(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	imageStore, err := service.NewDiskImageStore(t.TempDir())
+	require.NoError(t, err)
+	imageId, err := imageStore.Save(laptop.Id, "image/jpeg", bytes.NewBufferString("image"))
+	require.NoError(t, err)
+
+	server := service.NewLaptopServer(laptopStore, imageStore, nil)
+
+	res, err := server.DeleteLaptop(context.Background(), &pb.DeleteLaptopRequest{Id: laptop.Id})
+	require.NoError(t, err)
+	require.Equal(t, laptop.Id, res.GetId())
+
+	other, err := laptopStore.Find(laptop.Id)
+	require.NoError(t, err)
+	require.Nil(t, other)
+
+	// the images of the laptop are deleted with it
+	image, err := imageStore.Find(imageId)
+	require.NoError(t, err)
+	require.Nil(t, image)
+
+	_, err = server.DeleteLaptop(context.Background(), &pb.DeleteLaptopRequest{Id: laptop.Id})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = server.DeleteLaptop(context.Background(), &pb.DeleteLaptopRequest{Id: "invalid-uuid"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// failingImageStore is an image store that cannot delete images
+type failingImageStore struct {
+	service.ImageStore
+}
+
+func (store failingImageStore) DeleteByLaptop(laptopId string) error {
+	return errors.New("disk failure")
+}
+
+func TestServerDeleteLaptopImageError(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	imageStore, err := service.NewDiskImageStore(t.TempDir())
+	require.NoError(t, err)
+	imageId, err := imageStore.Save(laptop.Id, "image/jpeg", bytes.NewBufferString("image"))
+	require.NoError(t, err)
+
+	server := service.NewLaptopServer(laptopStore, failingImageStore{imageStore}, nil)
+
+	// the laptop is kept if its images cannot be deleted, so that the deletion can be retried
+	_, err = server.DeleteLaptop(context.Background(), &pb.DeleteLaptopRequest{Id: laptop.Id})
+	require.Equal(t, codes.Internal, status.Code(err))
+
+	other, err := laptopStore.Find(laptop.Id)
+	require.NoError(t, err)
+	require.NotNil(t, other)
+
+	server = service.NewLaptopServer(laptopStore, imageStore, nil)
+	_, err = server.DeleteLaptop(context.Background(), &pb.DeleteLaptopRequest{Id: laptop.Id})
+	require.NoError(t, err)
+
+	image, err := imageStore.Find(imageId)
+	require.NoError(t, err)
+	require.Nil(t, image)
+}
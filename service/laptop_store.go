@@ -3,37 +3,55 @@ package service
 import (
 	"context"
 	"errors"
-	"fmt"
 	"log"
+	"math"
+	"strings"
 	"sync"
 
-	"github.com/jinzhu/copier"
 	"github.com/warnshun/pcbook/pb"
+	"google.golang.org/protobuf/proto"
 )
 
 // ErrAlreadyExists error
 var ErrAlreadyExists = errors.New("record already exists")
 
+// ErrNotFound error
+var ErrNotFound = errors.New("record not found")
+
+const kilogramsPerPound = 0.45359237
+
 // LaptopStore is an interface to store laptop
 type LaptopStore interface {
 	// Save saves the laptop to the store
 	Save(laptop *pb.Laptop) error
+	// Update replaces an existing laptop in the store
+	Update(laptop *pb.Laptop) error
+	// Modify applies modify to a copy of an existing laptop and stores the result, atomically,
+	// the error of modify is returned as is and leaves the laptop unchanged
+	Modify(id string, modify func(laptop *pb.Laptop) error) (*pb.Laptop, error)
+	// Delete deletes a laptop by ID
+	Delete(id string) error
 	// Find finds a laptop by ID
 	Find(id string) (*pb.Laptop, error)
 	// Search searches for laptops with filter, returns one by one via the found function
 	Search(ctx context.Context, filter *pb.Filter, found func(laptop *pb.Laptop) error) error
+	// Subscribe subscribes to the laptops created, updated and deleted from now on
+	Subscribe() *LaptopSubscription
 }
 
 // InMemoryLaptopStore stores laptop in memory
 type InMemoryLaptopStore struct {
-	mutex sync.RWMutex
-	data  map[string]*pb.Laptop
+	mutex       sync.RWMutex
+	data        map[string]*pb.Laptop
+	indexes     []*laptopIndex
+	broadcaster laptopBroadcaster
 }
 
 // NewInMemoryLaptopStore returns a new InMemoryLaptopStore
 func NewInMemoryLaptopStore() *InMemoryLaptopStore {
 	return &InMemoryLaptopStore{
-		data: make(map[string]*pb.Laptop),
+		data:    make(map[string]*pb.Laptop),
+		indexes: newLaptopIndexes(),
 	}
 }
 
@@ -46,12 +64,80 @@ func (store *InMemoryLaptopStore) Save(laptop *pb.Laptop) error {
 		return ErrAlreadyExists
 	}
 
-	other, err := deepCopy(laptop)
+	other := deepCopy(laptop)
+	store.data[other.Id] = other
+	for _, index := range store.indexes {
+		index.Add(other)
+	}
+
+	store.broadcaster.Publish(pb.WatchLaptopsResponse_CREATED, other, nil)
+	return nil
+}
+
+// Update replaces an existing laptop in the store
+func (store *InMemoryLaptopStore) Update(laptop *pb.Laptop) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	old := store.data[laptop.Id]
+	if old == nil {
+		return ErrNotFound
+	}
+
+	store.replace(old, deepCopy(laptop))
+	return nil
+}
+
+// Modify applies modify to a copy of an existing laptop and stores the result
+func (store *InMemoryLaptopStore) Modify(id string, modify func(laptop *pb.Laptop) error) (*pb.Laptop, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	old := store.data[id]
+	if old == nil {
+		return nil, ErrNotFound
+	}
+
+	other := deepCopy(old)
+	err := modify(other)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	// the ID of the stored laptop cannot change
+	other.Id = id
+	store.replace(old, other)
+
+	return deepCopy(other), nil
+}
+
+// replace replaces old by other, the mutex must be locked
+func (store *InMemoryLaptopStore) replace(old *pb.Laptop, other *pb.Laptop) {
 	store.data[other.Id] = other
+	for _, index := range store.indexes {
+		index.Remove(old)
+		index.Add(other)
+	}
+
+	store.broadcaster.Publish(pb.WatchLaptopsResponse_UPDATED, other, old)
+}
+
+// Delete deletes a laptop by ID
+func (store *InMemoryLaptopStore) Delete(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	old := store.data[id]
+	if old == nil {
+		return ErrNotFound
+	}
+
+	delete(store.data, id)
+	for _, index := range store.indexes {
+		index.Remove(old)
+	}
+
+	store.broadcaster.Publish(pb.WatchLaptopsResponse_DELETED, old, nil)
 	return nil
 }
 
@@ -65,7 +151,12 @@ func (store *InMemoryLaptopStore) Find(id string) (*pb.Laptop, error) {
 		return nil, nil
 	}
 
-	return deepCopy(laptop)
+	return deepCopy(laptop), nil
+}
+
+// Subscribe subscribes to the laptops created, updated and deleted from now on
+func (store *InMemoryLaptopStore) Subscribe() *LaptopSubscription {
+	return store.broadcaster.Subscribe()
 }
 
 // Search searches for laptops with filter, returns one by one via the found function
@@ -75,12 +166,26 @@ func (store *InMemoryLaptopStore) Search(
 	found func(laptop *pb.Laptop) error,
 ) error {
 	store.mutex.RLock()
-	defer store.mutex.RUnlock()
+	for store.indexesDirty() {
+		store.mutex.RUnlock()
+		store.mergeIndexes()
+		store.mutex.RLock()
+	}
+
+	// the laptops are copied under the lock and sent after releasing it,
+	// so that a slow client does not block the writers
+	var laptops []*pb.Laptop
+	for _, entry := range store.candidates(filter) {
+		laptop := store.data[entry.id]
+		if isQualified(filter, laptop) {
+			laptops = append(laptops, deepCopy(laptop))
+		}
+	}
+	store.mutex.RUnlock()
 
-	for _, laptop := range store.data {
+	for _, laptop := range laptops {
 		// some heavy processing
 		// time.Sleep(1 * time.Second)
-		log.Print("checking laptop ID: ", laptop.GetId())
 
 		if ctx.Err() == context.Canceled {
 			log.Print("the client canceled the request")
@@ -92,35 +197,75 @@ func (store *InMemoryLaptopStore) Search(
 			return nil
 		}
 
-		if isQualified(filter, laptop) {
-			other, err := deepCopy(laptop)
-			if err != nil {
-				return err
-			}
-
-			err = found(other)
-			if err != nil {
-				return err
-			}
+		err := found(laptop)
+		if err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func deepCopy(laptop *pb.Laptop) (*pb.Laptop, error) {
-	other := &pb.Laptop{}
+// indexesDirty returns true if some laptops have not been merged into the indexes yet,
+// the caller must hold the read lock
+func (store *InMemoryLaptopStore) indexesDirty() bool {
+	for _, index := range store.indexes {
+		if index.Dirty() {
+			return true
+		}
+	}
 
-	err := copier.Copy(other, laptop)
-	if err != nil {
-		return nil, fmt.Errorf("cannot copy laptop data: %w", err)
+	return false
+}
+
+// mergeIndexes merges the laptops saved since the last search into the indexes
+func (store *InMemoryLaptopStore) mergeIndexes() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, index := range store.indexes {
+		index.Merge()
+	}
+}
+
+// candidates returns the laptops within the bounds of the most selective index,
+// the caller must hold the read lock
+func (store *InMemoryLaptopStore) candidates(filter *pb.Filter) []indexEntry {
+	var candidates []indexEntry
+
+	for i, index := range store.indexes {
+		entries := index.Range(filter)
+		if i == 0 || len(entries) < len(candidates) {
+			candidates = entries
+		}
 	}
 
-	return other, nil
+	return candidates
+}
+
+// deepCopy returns a copy of the laptop that shares no memory with it
+func deepCopy(laptop *pb.Laptop) *pb.Laptop {
+	return proto.Clone(laptop).(*pb.Laptop)
 }
 
 func isQualified(filter *pb.Filter, laptop *pb.Laptop) bool {
-	if laptop.GetPrice() > filter.GetMaxPrice() {
+	if filter.GetMaxPrice() > 0 && laptop.GetPrice() > filter.GetMaxPrice() {
+		return false
+	}
+
+	if laptop.GetPrice() < filter.GetMinPrice() {
+		return false
+	}
+
+	if len(filter.GetBrands()) > 0 && !containsFold(filter.GetBrands(), laptop.GetBrand()) {
+		return false
+	}
+
+	if laptop.GetReleaseYear() < filter.GetMinReleaseYear() {
+		return false
+	}
+
+	if filter.GetMaxReleaseYear() > 0 && laptop.GetReleaseYear() > filter.GetMaxReleaseYear() {
 		return false
 	}
 
@@ -136,9 +281,121 @@ func isQualified(filter *pb.Filter, laptop *pb.Laptop) bool {
 		return false
 	}
 
+	if !isGPUQualified(filter, laptop.GetGpus()) {
+		return false
+	}
+
+	if !isStorageQualified(filter, laptop.GetStorages()) {
+		return false
+	}
+
+	if !isScreenQualified(filter, laptop.GetScreen()) {
+		return false
+	}
+
+	if filter.GetBacklitKeyboard() && !laptop.GetKeyboard().GetBacklit() {
+		return false
+	}
+
+	if filter.GetMaxWeightKg() > 0 && weightKg(laptop) > filter.GetMaxWeightKg() {
+		return false
+	}
+
 	return true
 }
 
+// isGPUQualified checks that a single GPU satisfies all the GPU criteria
+func isGPUQualified(filter *pb.Filter, gpus []*pb.GPU) bool {
+	if len(filter.GetGpuBrands()) == 0 && filter.GetMinGpuMemory() == nil {
+		return true
+	}
+
+	for _, gpu := range gpus {
+		if len(filter.GetGpuBrands()) > 0 && !containsFold(filter.GetGpuBrands(), gpu.GetBrand()) {
+			continue
+		}
+
+		if toBit(gpu.GetMemory()) < toBit(filter.GetMinGpuMemory()) {
+			continue
+		}
+
+		return true
+	}
+
+	return false
+}
+
+func isStorageQualified(filter *pb.Filter, storages []*pb.Storage) bool {
+	if filter.GetSsdOnly() {
+		if len(storages) == 0 {
+			return false
+		}
+
+		for _, storage := range storages {
+			if storage.GetDriver() != pb.Storage_SSD {
+				return false
+			}
+		}
+	}
+
+	total := uint64(0)
+	for _, storage := range storages {
+		total += toBit(storage.GetMemory())
+	}
+
+	return total >= toBit(filter.GetMinStorage())
+}
+
+func isScreenQualified(filter *pb.Filter, screen *pb.Screen) bool {
+	if screen.GetSizeInch() < filter.GetMinScreenSizeInch() {
+		return false
+	}
+
+	if filter.GetMaxScreenSizeInch() > 0 && screen.GetSizeInch() > filter.GetMaxScreenSizeInch() {
+		return false
+	}
+
+	resolution := screen.GetResolution()
+	minResolution := filter.GetMinScreenResolution()
+	if resolution.GetWidth() < minResolution.GetWidth() || resolution.GetHeight() < minResolution.GetHeight() {
+		return false
+	}
+
+	if len(filter.GetScreenPanels()) == 0 {
+		return true
+	}
+
+	for _, panel := range filter.GetScreenPanels() {
+		if panel == screen.GetPanel() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// weightKg returns the laptop weight in kilograms, or +Inf if it is unknown
+func weightKg(laptop *pb.Laptop) float64 {
+	switch weight := laptop.GetWeight().(type) {
+	case *pb.Laptop_WeightKg:
+		return weight.WeightKg
+	case *pb.Laptop_WeightLb:
+		return weight.WeightLb * kilogramsPerPound
+	default:
+		return math.Inf(1)
+	}
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func toBit(memory *pb.Memory) uint64 {
 	value := memory.GetValue()
 
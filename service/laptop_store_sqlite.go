@@ -0,0 +1,297 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/warnshun/pcbook/pb"
+	"google.golang.org/protobuf/proto"
+	_ "modernc.org/sqlite" // register the pure-Go SQLite driver
+)
+
+const createLaptopsTable = `
+CREATE TABLE IF NOT EXISTS laptops (
+	id   TEXT PRIMARY KEY,
+	data BLOB NOT NULL
+)`
+
+// SQLiteLaptopStore stores laptops in a SQLite database
+type SQLiteLaptopStore struct {
+	// writeMutex serializes the writes, so that their events are published in order
+	writeMutex  sync.Mutex
+	db          *sql.DB
+	broadcaster laptopBroadcaster
+}
+
+// NewSQLiteLaptopStore opens the SQLite database at dataSourceName and returns a new SQLiteLaptopStore
+func NewSQLiteLaptopStore(dataSourceName string) (*SQLiteLaptopStore, error) {
+	db, err := sql.Open("sqlite", dataSourceName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open laptop database: %w", err)
+	}
+
+	// SQLite serializes writers anyway, and a single connection keeps
+	// ":memory:" databases shared by every query
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(createLaptopsTable)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot create laptops table: %w", err)
+	}
+
+	return &SQLiteLaptopStore{
+		db: db,
+	}, nil
+}
+
+// Close closes the underlying database
+func (store *SQLiteLaptopStore) Close() error {
+	return store.db.Close()
+}
+
+// Save saves the laptop to the store
+func (store *SQLiteLaptopStore) Save(laptop *pb.Laptop) error {
+	store.writeMutex.Lock()
+	defer store.writeMutex.Unlock()
+
+	data, err := proto.Marshal(laptop)
+	if err != nil {
+		return fmt.Errorf("cannot marshal laptop: %w", err)
+	}
+
+	result, err := store.db.Exec(
+		"INSERT INTO laptops (id, data) VALUES (?, ?) ON CONFLICT (id) DO NOTHING",
+		laptop.GetId(),
+		data,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot insert laptop: %w", err)
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("cannot check inserted laptop: %w", err)
+	}
+	if inserted == 0 {
+		return ErrAlreadyExists
+	}
+
+	store.broadcaster.Publish(pb.WatchLaptopsResponse_CREATED, laptop, nil)
+	return nil
+}
+
+// Update replaces an existing laptop in the store
+func (store *SQLiteLaptopStore) Update(laptop *pb.Laptop) error {
+	store.writeMutex.Lock()
+	defer store.writeMutex.Unlock()
+
+	old, err := store.Find(laptop.GetId())
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return ErrNotFound
+	}
+
+	return store.replace(old, laptop)
+}
+
+// Modify applies modify to a copy of an existing laptop and stores the result
+func (store *SQLiteLaptopStore) Modify(id string, modify func(laptop *pb.Laptop) error) (*pb.Laptop, error) {
+	store.writeMutex.Lock()
+	defer store.writeMutex.Unlock()
+
+	old, err := store.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	if old == nil {
+		return nil, ErrNotFound
+	}
+
+	laptop := proto.Clone(old).(*pb.Laptop)
+	err = modify(laptop)
+	if err != nil {
+		return nil, err
+	}
+
+	// the ID of the stored laptop cannot change
+	laptop.Id = id
+	err = store.replace(old, laptop)
+	if err != nil {
+		return nil, err
+	}
+
+	return laptop, nil
+}
+
+// replace replaces old by laptop, the write mutex must be locked
+func (store *SQLiteLaptopStore) replace(old *pb.Laptop, laptop *pb.Laptop) error {
+	data, err := proto.Marshal(laptop)
+	if err != nil {
+		return fmt.Errorf("cannot marshal laptop: %w", err)
+	}
+
+	result, err := store.db.Exec("UPDATE laptops SET data = ? WHERE id = ?", data, laptop.GetId())
+	if err != nil {
+		return fmt.Errorf("cannot update laptop: %w", err)
+	}
+
+	err = requireAffected(result)
+	if err != nil {
+		return err
+	}
+
+	store.broadcaster.Publish(pb.WatchLaptopsResponse_UPDATED, laptop, old)
+	return nil
+}
+
+// Delete deletes a laptop by ID
+func (store *SQLiteLaptopStore) Delete(id string) error {
+	store.writeMutex.Lock()
+	defer store.writeMutex.Unlock()
+
+	old, err := store.Find(id)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return ErrNotFound
+	}
+
+	result, err := store.db.Exec("DELETE FROM laptops WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("cannot delete laptop: %w", err)
+	}
+
+	err = requireAffected(result)
+	if err != nil {
+		return err
+	}
+
+	store.broadcaster.Publish(pb.WatchLaptopsResponse_DELETED, old, nil)
+	return nil
+}
+
+// Subscribe subscribes to the laptops created, updated and deleted from now on
+func (store *SQLiteLaptopStore) Subscribe() *LaptopSubscription {
+	return store.broadcaster.Subscribe()
+}
+
+// Find finds a laptop by ID
+func (store *SQLiteLaptopStore) Find(id string) (*pb.Laptop, error) {
+	var data []byte
+
+	err := store.db.QueryRow("SELECT data FROM laptops WHERE id = ?", id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot query laptop: %w", err)
+	}
+
+	return unmarshalLaptop(data)
+}
+
+// Search searches for laptops with filter, returns one by one via the found function
+func (store *SQLiteLaptopStore) Search(
+	ctx context.Context,
+	filter *pb.Filter,
+	found func(laptop *pb.Laptop) error,
+) error {
+	laptops, err := store.query(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	for _, laptop := range laptops {
+		if ctx.Err() == context.Canceled {
+			log.Print("the client canceled the request")
+			return nil
+		}
+
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Print("deadline exceeded")
+			return nil
+		}
+
+		err := found(laptop)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// query loads the qualified laptops before any of them is handed out,
+// so a slow consumer never keeps the database connection busy
+func (store *SQLiteLaptopStore) query(ctx context.Context, filter *pb.Filter) ([]*pb.Laptop, error) {
+	rows, err := store.db.QueryContext(ctx, "SELECT data FROM laptops ORDER BY id")
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("cannot query laptops: %w", err)
+	}
+	defer rows.Close()
+
+	var laptops []*pb.Laptop
+	for rows.Next() {
+		var data []byte
+		err := rows.Scan(&data)
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan laptop: %w", err)
+		}
+
+		laptop, err := unmarshalLaptop(data)
+		if err != nil {
+			return nil, err
+		}
+
+		if isQualified(filter, laptop) {
+			laptops = append(laptops, laptop)
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil, nil
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read laptops: %w", err)
+	}
+
+	return laptops, nil
+}
+
+// requireAffected returns ErrNotFound if the statement did not touch any row
+func requireAffected(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("cannot check affected rows: %w", err)
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func unmarshalLaptop(data []byte) (*pb.Laptop, error) {
+	laptop := &pb.Laptop{}
+
+	err := proto.Unmarshal(data, laptop)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unmarshal laptop: %w", err)
+	}
+
+	return laptop, nil
+}
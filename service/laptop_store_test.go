@@ -0,0 +1,307 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/warnshun/pcbook/pb"
+	"github.com/warnshun/pcbook/sample"
+	"github.com/warnshun/pcbook/service"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestLaptopStore(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		newStore func(t *testing.T) service.LaptopStore
+	}{
+		{
+			name: "in_memory",
+			newStore: func(t *testing.T) service.LaptopStore {
+				return service.NewInMemoryLaptopStore()
+			},
+		},
+		{
+			name: "sqlite",
+			newStore: func(t *testing.T) service.LaptopStore {
+				store, err := service.NewSQLiteLaptopStore(filepath.Join(t.TempDir(), "laptop.db"))
+				require.NoError(t, err)
+				t.Cleanup(func() { store.Close() })
+				return store
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			store := tc.newStore(t)
+
+			laptop := sample.NewLaptop()
+			err := store.Save(laptop)
+			require.NoError(t, err)
+
+			err = store.Save(laptop)
+			require.ErrorIs(t, err, service.ErrAlreadyExists)
+
+			other, err := store.Find(laptop.GetId())
+			require.NoError(t, err)
+			require.NotNil(t, other)
+			requireSameLaptop(t, laptop, other)
+
+			missing, err := store.Find(sample.NewLaptop().GetId())
+			require.NoError(t, err)
+			require.Nil(t, missing)
+
+			cheap := sample.NewLaptop()
+			cheap.Price = 1000
+			err = store.Save(cheap)
+			require.NoError(t, err)
+
+			filter := &pb.Filter{MaxPrice: 1200}
+			var found []string
+			err = store.Search(context.Background(), filter, func(laptop *pb.Laptop) error {
+				found = append(found, laptop.GetId())
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, []string{cheap.GetId()}, found)
+
+			cheap.Price = 1100
+			err = store.Update(cheap)
+			require.NoError(t, err)
+
+			other, err = store.Find(cheap.GetId())
+			require.NoError(t, err)
+			require.Equal(t, 1100.0, other.GetPrice())
+
+			modified, err := store.Modify(cheap.GetId(), func(laptop *pb.Laptop) error {
+				laptop.Price = 1150
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, 1150.0, modified.GetPrice())
+			require.Equal(t, cheap.GetBrand(), modified.GetBrand())
+
+			// an error of the modification leaves the laptop unchanged
+			errModify := errors.New("cannot modify")
+			_, err = store.Modify(cheap.GetId(), func(laptop *pb.Laptop) error {
+				laptop.Price = 1
+				return errModify
+			})
+			require.ErrorIs(t, err, errModify)
+
+			other, err = store.Find(cheap.GetId())
+			require.NoError(t, err)
+			require.Equal(t, 1150.0, other.GetPrice())
+
+			err = store.Delete(cheap.GetId())
+			require.NoError(t, err)
+
+			_, err = store.Modify(cheap.GetId(), func(laptop *pb.Laptop) error { return nil })
+			require.ErrorIs(t, err, service.ErrNotFound)
+
+			err = store.Delete(cheap.GetId())
+			require.ErrorIs(t, err, service.ErrNotFound)
+
+			err = store.Update(cheap)
+			require.ErrorIs(t, err, service.ErrNotFound)
+		})
+	}
+}
+
+func TestSQLiteLaptopStoreReopen(t *testing.T) {
+	t.Parallel()
+
+	dataSourceName := filepath.Join(t.TempDir(), "laptop.db")
+
+	store, err := service.NewSQLiteLaptopStore(dataSourceName)
+	require.NoError(t, err)
+
+	laptop := sample.NewLaptop()
+	err = store.Save(laptop)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	store, err = service.NewSQLiteLaptopStore(dataSourceName)
+	require.NoError(t, err)
+	defer store.Close()
+
+	other, err := store.Find(laptop.GetId())
+	require.NoError(t, err)
+	require.NotNil(t, other)
+	requireSameLaptop(t, laptop, other)
+}
+
+func TestLaptopStoreSearchFilter(t *testing.T) {
+	t.Parallel()
+
+	laptop := sample.NewLaptop()
+	laptop.Brand = "Apple"
+	laptop.Price = 2000
+	laptop.ReleaseYear = 2021
+	laptop.Gpus = []*pb.GPU{{Brand: "Nvidia", Memory: &pb.Memory{Value: 8, Unit: pb.Memory_GIGABYTE}}}
+	laptop.Storages = []*pb.Storage{{Driver: pb.Storage_SSD, Memory: &pb.Memory{Value: 512, Unit: pb.Memory_GIGABYTE}}}
+	laptop.Screen = &pb.Screen{
+		SizeInch:   15.6,
+		Resolution: &pb.Screen_Resolution{Width: 2560, Height: 1440},
+		Panel:      pb.Screen_OLED,
+	}
+	laptop.Keyboard = &pb.Keyboard{Backlit: true}
+	laptop.Weight = &pb.Laptop_WeightLb{WeightLb: 4}
+
+	store := service.NewInMemoryLaptopStore()
+	err := store.Save(laptop)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name   string
+		filter *pb.Filter
+		found  bool
+	}{
+		{"empty", &pb.Filter{}, true},
+		{"price_range", &pb.Filter{MinPrice: 1500, MaxPrice: 2000}, true},
+		{"price_too_low", &pb.Filter{MinPrice: 2001}, false},
+		{"brands", &pb.Filter{Brands: []string{"dell", "apple"}}, true},
+		{"other_brands", &pb.Filter{Brands: []string{"Dell", "HP"}}, false},
+		{"release_year", &pb.Filter{MinReleaseYear: 2020, MaxReleaseYear: 2021}, true},
+		{"too_old", &pb.Filter{MinReleaseYear: 2022}, false},
+		{"gpu", &pb.Filter{GpuBrands: []string{"NVIDIA"}, MinGpuMemory: &pb.Memory{Value: 8192, Unit: pb.Memory_MEGABYTE}}, true},
+		{"gpu_brand", &pb.Filter{GpuBrands: []string{"AMD"}}, false},
+		{"gpu_memory", &pb.Filter{MinGpuMemory: &pb.Memory{Value: 16, Unit: pb.Memory_GIGABYTE}}, false},
+		{"storage", &pb.Filter{SsdOnly: true, MinStorage: &pb.Memory{Value: 512, Unit: pb.Memory_GIGABYTE}}, true},
+		{"storage_too_small", &pb.Filter{MinStorage: &pb.Memory{Value: 1, Unit: pb.Memory_TERABYTE}}, false},
+		{"screen", &pb.Filter{
+			MinScreenSizeInch:   15,
+			MaxScreenSizeInch:   16,
+			MinScreenResolution: &pb.Screen_Resolution{Width: 1920, Height: 1080},
+			ScreenPanels:        []pb.Screen_Panel{pb.Screen_OLED},
+		}, true},
+		{"screen_resolution", &pb.Filter{MinScreenResolution: &pb.Screen_Resolution{Width: 3840, Height: 2160}}, false},
+		{"screen_panel", &pb.Filter{ScreenPanels: []pb.Screen_Panel{pb.Screen_IPS}}, false},
+		{"backlit_keyboard", &pb.Filter{BacklitKeyboard: true}, true},
+		{"weight", &pb.Filter{MaxWeightKg: 1.9}, true},
+		{"too_heavy", &pb.Filter{MaxWeightKg: 1.8}, false},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			found := false
+			err := store.Search(context.Background(), tc.filter, func(laptop *pb.Laptop) error {
+				found = true
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, tc.found, found)
+		})
+	}
+}
+
+func TestInMemoryLaptopStoreCopy(t *testing.T) {
+	t.Parallel()
+
+	store := service.NewInMemoryLaptopStore()
+
+	laptopKg := sample.NewLaptop()
+	laptopKg.Weight = &pb.Laptop_WeightKg{WeightKg: 1.5}
+
+	laptopLb := sample.NewLaptop()
+	laptopLb.Weight = &pb.Laptop_WeightLb{WeightLb: 3.3}
+	laptopLb.UpdatedAt = timestamppb.New(time.Date(2023, 9, 1, 12, 30, 0, 123456789, time.UTC))
+
+	for _, laptop := range []*pb.Laptop{laptopKg, laptopLb} {
+		err := store.Save(laptop)
+		require.NoError(t, err)
+
+		other, err := store.Find(laptop.GetId())
+		require.NoError(t, err)
+		require.True(t, proto.Equal(laptop, other))
+		require.Equal(t, laptop.GetWeightKg(), other.GetWeightKg())
+		require.Equal(t, laptop.GetWeightLb(), other.GetWeightLb())
+		require.IsType(t, laptop.GetWeight(), other.GetWeight())
+		require.Equal(t, laptop.GetUpdatedAt().AsTime(), other.GetUpdatedAt().AsTime())
+
+		// the store keeps its own copy
+		other.Weight = nil
+		other.UpdatedAt.Seconds = 0
+		other.Cpu.NumberCores = 64
+
+		again, err := store.Find(laptop.GetId())
+		require.NoError(t, err)
+		require.True(t, proto.Equal(laptop, again))
+	}
+
+	laptopLb.Weight = &pb.Laptop_WeightLb{WeightLb: 9.9}
+	again, err := store.Find(laptopLb.GetId())
+	require.NoError(t, err)
+	require.Equal(t, 3.3, again.GetWeightLb())
+}
+
+func TestInMemoryLaptopStoreSearchUnlocked(t *testing.T) {
+	t.Parallel()
+
+	store := service.NewInMemoryLaptopStore()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, store.Save(sample.NewLaptop()))
+	}
+
+	// the laptops are sent without holding the lock of the store, which a slow client would block
+	found := 0
+	err := store.Search(context.Background(), &pb.Filter{}, func(laptop *pb.Laptop) error {
+		found++
+
+		saved := make(chan error, 1)
+		go func() {
+			saved <- store.Save(sample.NewLaptop())
+		}()
+
+		select {
+		case err := <-saved:
+			return err
+		case <-time.After(5 * time.Second):
+			return errors.New("the store is locked while sending the laptops")
+		}
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, found)
+}
+
+func TestLaptopStoreSlowSubscriber(t *testing.T) {
+	t.Parallel()
+
+	store := service.NewInMemoryLaptopStore()
+	slow := store.Subscribe()
+
+	// saving never waits for the slow subscriber, which is dropped once its buffer is full
+	for i := 0; i < 1000; i++ {
+		err := store.Save(sample.NewLaptop())
+		require.NoError(t, err)
+	}
+
+	received := 0
+	for range slow.Events() {
+		received++
+	}
+	require.Less(t, received, 1000)
+	require.ErrorIs(t, slow.Err(), service.ErrSlowSubscriber)
+
+	closed := store.Subscribe()
+	closed.Close()
+	_, ok := <-closed.Events()
+	require.False(t, ok)
+	require.NoError(t, closed.Err())
+}
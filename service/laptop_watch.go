@@ -0,0 +1,145 @@
+package service
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/warnshun/pcbook/pb"
+)
+
+// ErrSlowSubscriber error
+var ErrSlowSubscriber = errors.New("subscriber is too slow to receive laptop events")
+
+const laptopEventBufferSize = 64
+
+// LaptopEvent is a change of a laptop in the store
+type LaptopEvent struct {
+	Type pb.WatchLaptopsResponse_EventType
+	// Laptop is the laptop after the change, or before it was deleted
+	Laptop *pb.Laptop
+	// Previous is the laptop before it was updated
+	Previous *pb.Laptop
+}
+
+// Matches returns true if the event concerns a laptop matching the filter,
+// an updated laptop matches if it did before or after the update
+func (event *LaptopEvent) Matches(filter *pb.Filter) bool {
+	if isQualified(filter, event.Laptop) {
+		return true
+	}
+
+	return event.Previous != nil && isQualified(filter, event.Previous)
+}
+
+// TypeFor returns the type of the event sent to a watcher with the filter,
+// an updated laptop that stopped matching the filter is REMOVED and one that started matching it is CREATED
+func (event *LaptopEvent) TypeFor(filter *pb.Filter) pb.WatchLaptopsResponse_EventType {
+	if event.Type != pb.WatchLaptopsResponse_UPDATED {
+		return event.Type
+	}
+
+	if !isQualified(filter, event.Laptop) {
+		return pb.WatchLaptopsResponse_REMOVED
+	}
+	if event.Previous != nil && !isQualified(filter, event.Previous) {
+		return pb.WatchLaptopsResponse_CREATED
+	}
+
+	return event.Type
+}
+
+// LaptopSubscription receives the events of a laptop store
+type LaptopSubscription struct {
+	broadcaster *laptopBroadcaster
+	events      chan *LaptopEvent
+	err         error
+}
+
+// Events returns the channel of events, it is closed when the subscription ends
+func (subscription *LaptopSubscription) Events() <-chan *LaptopEvent {
+	return subscription.events
+}
+
+// Err returns why the subscription ended, once the events channel is closed
+func (subscription *LaptopSubscription) Err() error {
+	subscription.broadcaster.mutex.Lock()
+	defer subscription.broadcaster.mutex.Unlock()
+
+	return subscription.err
+}
+
+// Close ends the subscription
+func (subscription *LaptopSubscription) Close() {
+	subscription.broadcaster.remove(subscription, nil)
+}
+
+// laptopBroadcaster sends the events of a laptop store to its subscribers,
+// without ever waiting for them
+type laptopBroadcaster struct {
+	mutex       sync.Mutex
+	subscribers map[*LaptopSubscription]bool
+}
+
+// Subscribe returns a new subscription to the events
+func (broadcaster *laptopBroadcaster) Subscribe() *LaptopSubscription {
+	broadcaster.mutex.Lock()
+	defer broadcaster.mutex.Unlock()
+
+	subscription := &LaptopSubscription{
+		broadcaster: broadcaster,
+		events:      make(chan *LaptopEvent, laptopEventBufferSize),
+	}
+
+	if broadcaster.subscribers == nil {
+		broadcaster.subscribers = make(map[*LaptopSubscription]bool)
+	}
+	broadcaster.subscribers[subscription] = true
+
+	return subscription
+}
+
+// Publish sends the event to every subscriber,
+// those whose buffer is full are dropped with ErrSlowSubscriber
+func (broadcaster *laptopBroadcaster) Publish(eventType pb.WatchLaptopsResponse_EventType, laptop *pb.Laptop, previous *pb.Laptop) {
+	broadcaster.mutex.Lock()
+	defer broadcaster.mutex.Unlock()
+
+	if len(broadcaster.subscribers) == 0 {
+		return
+	}
+
+	// subscribers share the event, they must not modify it
+	event := &LaptopEvent{
+		Type:   eventType,
+		Laptop: deepCopy(laptop),
+	}
+	if previous != nil {
+		event.Previous = deepCopy(previous)
+	}
+
+	for subscription := range broadcaster.subscribers {
+		select {
+		case subscription.events <- event:
+		default:
+			broadcaster.close(subscription, ErrSlowSubscriber)
+		}
+	}
+}
+
+func (broadcaster *laptopBroadcaster) remove(subscription *LaptopSubscription, err error) {
+	broadcaster.mutex.Lock()
+	defer broadcaster.mutex.Unlock()
+
+	broadcaster.close(subscription, err)
+}
+
+// close closes a subscription, the caller must hold the lock
+func (broadcaster *laptopBroadcaster) close(subscription *LaptopSubscription, err error) {
+	if !broadcaster.subscribers[subscription] {
+		return
+	}
+
+	delete(broadcaster.subscribers, subscription)
+	subscription.err = err
+	close(subscription.events)
+}
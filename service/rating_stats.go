@@ -0,0 +1,100 @@
+package service
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/warnshun/pcbook/pb"
+)
+
+// latestScores returns the last score of each user among the scores of history given from start included
+// to end excluded, a zero start or end leaves that side of the period open
+func latestScores(history []*UserRating, start time.Time, end time.Time) []float64 {
+	latest := make(map[string]float64)
+	for _, rating := range history {
+		if !start.IsZero() && rating.RatedAt.Before(start) {
+			continue
+		}
+		if !end.IsZero() && !rating.RatedAt.Before(end) {
+			continue
+		}
+
+		// history is in the order the scores were given
+		if rating.Removed {
+			delete(latest, rating.Username)
+		} else {
+			latest[rating.Username] = rating.Score
+		}
+	}
+
+	scores := make([]float64, 0, len(latest))
+	for _, score := range latest {
+		scores = append(scores, score)
+	}
+	sort.Float64s(scores)
+
+	return scores
+}
+
+// averageScore returns the average of scores, 0 if there are none
+func averageScore(scores []float64) float64 {
+	if len(scores) == 0 {
+		return 0
+	}
+
+	sum := 0.0
+	for _, score := range scores {
+		sum += score
+	}
+
+	return sum / float64(len(scores))
+}
+
+// medianScore returns the median of sorted scores, 0 if there are none
+func medianScore(scores []float64) float64 {
+	n := len(scores)
+	if n == 0 {
+		return 0
+	}
+	if n%2 == 1 {
+		return scores[n/2]
+	}
+
+	return (scores[n/2-1] + scores[n/2]) / 2
+}
+
+// maxScoreBuckets is the maximum number of buckets of the score histograms
+const maxScoreBuckets = 100
+
+// scoreHistogram counts scores in buckets of one point from minScore to maxScore,
+// or in maxScoreBuckets buckets of the same width if the range is wider
+func scoreHistogram(scores []float64, minScore float64, maxScore float64) []*pb.ScoreBucket {
+	width := 1.0
+	n := int(math.Min(math.Ceil(maxScore-minScore), maxScoreBuckets+1))
+	if n < 1 {
+		n = 1
+	}
+	if n > maxScoreBuckets {
+		n = maxScoreBuckets
+		width = (maxScore - minScore) / maxScoreBuckets
+	}
+
+	histogram := make([]*pb.ScoreBucket, n)
+	for i := range histogram {
+		histogram[i] = &pb.ScoreBucket{
+			MinScore: minScore + float64(i)*width,
+			MaxScore: minScore + float64(i+1)*width,
+		}
+	}
+	histogram[n-1].MaxScore = maxScore
+
+	for _, score := range scores {
+		// the scores out of range were given before the range changed, they count in the closest bucket
+		i := int(math.Max(0, math.Min(math.Floor((score-minScore)/width), float64(n-1))))
+
+		histogram[i].Count++
+	}
+
+	return histogram
+}
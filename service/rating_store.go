@@ -1,10 +1,29 @@
 package service
 
-import "sync"
+import (
+	"sort"
+	"sync"
+	"time"
+)
 
 // RatingStore is an interface to store laptop ratings
 type RatingStore interface {
-	Add(laptopId string, score float64) (*Rating, error)
+	// Add adds the score of a user to a laptop and returns its updated rating,
+	// the score replaces the previous one of the user
+	Add(laptopId string, username string, score float64) (*Rating, error)
+	// AddReview adds the score of the approved review of a user to a laptop and returns its updated rating.
+	// The score replaces the previous one of the user, unless the user rated the laptop without a review
+	// after submittedAt, the time the review was submitted
+	AddReview(laptopId string, username string, reviewId string, score float64, submittedAt time.Time) (*Rating, error)
+	// RemoveReview removes the score of a user from a laptop and returns its updated rating,
+	// it does nothing if the current score of the user did not come with the review
+	RemoveReview(laptopId string, username string, reviewId string) (*Rating, error)
+	// Find finds the rating of a laptop, returns nil if it has not been rated yet
+	Find(laptopId string) (*Rating, error)
+	// FindByUser finds the scores given by a user, in the order they were given
+	FindByUser(username string) ([]*UserRating, error)
+	// History lists all the scores given to a laptop, including the replaced and removed ones, in the order they were given
+	History(laptopId string) ([]*UserRating, error)
 }
 
 // Rating contains the rating information for a laptop
@@ -13,34 +32,190 @@ type Rating struct {
 	Sum   float64
 }
 
+// Average returns the average score of the rating
+func (rating *Rating) Average() float64 {
+	if rating.Count == 0 {
+		return 0
+	}
+
+	return rating.Sum / float64(rating.Count)
+}
+
+// UserRating is the score given by a user to a laptop
+type UserRating struct {
+	LaptopId string
+	Username string
+	Score    float64
+	RatedAt  time.Time
+	// ReviewId is the ID of the review the score came with, empty if it was rated without a review
+	ReviewId string
+	// Removed is true in the history for the removal of the score of the user
+	Removed bool
+}
+
 // InMemoryRatingStore stores laptop ratings in memory
 type InMemoryRatingStore struct {
 	mutex   sync.Mutex
 	ratings map[string]*Rating
+	// userRatings are the scores of each user by laptop ID
+	userRatings map[string]map[string]*UserRating
+	// history are all the scores given by laptop ID
+	history map[string][]*UserRating
 }
 
 func NewInMemoryRatingStore() *InMemoryRatingStore {
 	return &InMemoryRatingStore{
-		ratings: make(map[string]*Rating),
+		ratings:     make(map[string]*Rating),
+		userRatings: make(map[string]map[string]*UserRating),
+		history:     make(map[string][]*UserRating),
 	}
 }
 
-func (store *InMemoryRatingStore) Add(laptopId string, score float64) (*Rating, error) {
+func (store *InMemoryRatingStore) Add(laptopId string, username string, score float64) (*Rating, error) {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
+	store.add(laptopId, username, score, "")
+
+	return store.copy(laptopId), nil
+}
+
+func (store *InMemoryRatingStore) AddReview(
+	laptopId string,
+	username string,
+	reviewId string,
+	score float64,
+	submittedAt time.Time,
+) (*Rating, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	previous := store.userRatings[username][laptopId]
+	if previous == nil || previous.ReviewId != "" || !previous.RatedAt.After(submittedAt) {
+		store.add(laptopId, username, score, reviewId)
+	}
+
+	return store.copy(laptopId), nil
+}
+
+func (store *InMemoryRatingStore) RemoveReview(laptopId string, username string, reviewId string) (*Rating, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	previous := store.userRatings[username][laptopId]
+	if previous == nil || previous.ReviewId != reviewId {
+		return store.copy(laptopId), nil
+	}
+
+	rating := store.ratings[laptopId]
+	rating.Count -= 1
+	rating.Sum -= previous.Score
+	if rating.Count == 0 {
+		// no rounding error is left behind
+		rating.Sum = 0
+	}
+
+	delete(store.userRatings[username], laptopId)
+	store.history[laptopId] = append(store.history[laptopId], &UserRating{
+		LaptopId: laptopId,
+		Username: username,
+		RatedAt:  time.Now(),
+		Removed:  true,
+	})
+
+	return store.copy(laptopId), nil
+}
+
+// add replaces the score of a user for a laptop, the caller must hold the mutex
+func (store *InMemoryRatingStore) add(laptopId string, username string, score float64, reviewId string) {
 	rating := store.ratings[laptopId]
 	if rating == nil {
-		rating = &Rating{
-			Count: 1,
-			Sum:   score,
-		}
-	} else {
+		rating = &Rating{}
+		store.ratings[laptopId] = rating
+	}
+
+	userRatings := store.userRatings[username]
+	if userRatings == nil {
+		userRatings = make(map[string]*UserRating)
+		store.userRatings[username] = userRatings
+	}
+
+	previous := userRatings[laptopId]
+	if previous == nil {
 		rating.Count += 1
 		rating.Sum += score
+	} else {
+		rating.Sum += score - previous.Score
+	}
+
+	userRating := &UserRating{
+		LaptopId: laptopId,
+		Username: username,
+		Score:    score,
+		RatedAt:  time.Now(),
+		ReviewId: reviewId,
+	}
+	userRatings[laptopId] = userRating
+	store.history[laptopId] = append(store.history[laptopId], userRating)
+}
+
+// copy returns a copy of the rating of a laptop, the caller must hold the mutex
+func (store *InMemoryRatingStore) copy(laptopId string) *Rating {
+	rating := store.ratings[laptopId]
+	if rating == nil {
+		return &Rating{}
+	}
+
+	return &Rating{
+		Count: rating.Count,
+		Sum:   rating.Sum,
+	}
+}
+
+func (store *InMemoryRatingStore) Find(laptopId string) (*Rating, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	rating := store.ratings[laptopId]
+	if rating == nil || rating.Count == 0 {
+		return nil, nil
+	}
+
+	return &Rating{
+		Count: rating.Count,
+		Sum:   rating.Sum,
+	}, nil
+}
+
+func (store *InMemoryRatingStore) FindByUser(username string) ([]*UserRating, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	ratings := make([]*UserRating, 0, len(store.userRatings[username]))
+	for _, rating := range store.userRatings[username] {
+		other := *rating
+		ratings = append(ratings, &other)
 	}
 
-	store.ratings[laptopId] = rating
+	sort.Slice(ratings, func(i, j int) bool {
+		if ratings[i].RatedAt.Equal(ratings[j].RatedAt) {
+			return ratings[i].LaptopId < ratings[j].LaptopId
+		}
+		return ratings[i].RatedAt.Before(ratings[j].RatedAt)
+	})
+
+	return ratings, nil
+}
+
+func (store *InMemoryRatingStore) History(laptopId string) ([]*UserRating, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	history := make([]*UserRating, 0, len(store.history[laptopId]))
+	for _, rating := range store.history[laptopId] {
+		other := *rating
+		history = append(history, &other)
+	}
 
-	return rating, nil
+	return history, nil
 }
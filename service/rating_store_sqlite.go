@@ -0,0 +1,267 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite" // register the pure-Go SQLite driver
+)
+
+const createRatingsTables = `
+CREATE TABLE IF NOT EXISTS ratings (
+	laptop_id TEXT NOT NULL,
+	username  TEXT NOT NULL,
+	score     REAL NOT NULL,
+	rated_at  INTEGER NOT NULL,
+	review_id TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (laptop_id, username)
+);
+CREATE INDEX IF NOT EXISTS ratings_username ON ratings (username);
+CREATE TABLE IF NOT EXISTS rating_history (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	laptop_id TEXT NOT NULL,
+	username  TEXT NOT NULL,
+	score     REAL NOT NULL,
+	rated_at  INTEGER NOT NULL,
+	removed   INTEGER NOT NULL DEFAULT 0,
+	review_id TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS rating_history_laptop_id ON rating_history (laptop_id)`
+
+// SQLiteRatingStore stores laptop ratings in a SQLite database,
+// the current score of each user and the history of all the scores given.
+// The rating times are stored as Unix nanoseconds
+type SQLiteRatingStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteRatingStore opens the SQLite database at dataSourceName and returns a new SQLiteRatingStore
+func NewSQLiteRatingStore(dataSourceName string) (*SQLiteRatingStore, error) {
+	db, err := sql.Open("sqlite", dataSourceName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open rating database: %w", err)
+	}
+
+	// SQLite serializes writers anyway, and a single connection keeps
+	// ":memory:" databases shared by every query
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(createRatingsTables)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot create ratings tables: %w", err)
+	}
+
+	return &SQLiteRatingStore{
+		db: db,
+	}, nil
+}
+
+// Close closes the underlying database
+func (store *SQLiteRatingStore) Close() error {
+	return store.db.Close()
+}
+
+func (store *SQLiteRatingStore) Add(laptopId string, username string, score float64) (*Rating, error) {
+	return store.update(laptopId, func(tx *sql.Tx) error {
+		return addRating(tx, laptopId, username, score, "")
+	})
+}
+
+func (store *SQLiteRatingStore) AddReview(
+	laptopId string,
+	username string,
+	reviewId string,
+	score float64,
+	submittedAt time.Time,
+) (*Rating, error) {
+	return store.update(laptopId, func(tx *sql.Tx) error {
+		var previousReviewId string
+		var ratedAt int64
+
+		err := tx.QueryRow(
+			"SELECT review_id, rated_at FROM ratings WHERE laptop_id = ? AND username = ?",
+			laptopId,
+			username,
+		).Scan(&previousReviewId, &ratedAt)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("cannot query rating: %w", err)
+		}
+
+		// the user rated the laptop without a review after submitting it
+		if err == nil && previousReviewId == "" && ratedAt > submittedAt.UnixNano() {
+			return nil
+		}
+
+		return addRating(tx, laptopId, username, score, reviewId)
+	})
+}
+
+func (store *SQLiteRatingStore) RemoveReview(laptopId string, username string, reviewId string) (*Rating, error) {
+	return store.update(laptopId, func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			"DELETE FROM ratings WHERE laptop_id = ? AND username = ? AND review_id = ?",
+			laptopId,
+			username,
+			reviewId,
+		)
+		if err != nil {
+			return fmt.Errorf("cannot delete rating: %w", err)
+		}
+
+		removed, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("cannot check deleted rating: %w", err)
+		}
+		if removed == 0 {
+			return nil
+		}
+
+		_, err = tx.Exec(
+			"INSERT INTO rating_history (laptop_id, username, score, rated_at, removed) VALUES (?, ?, 0, ?, 1)",
+			laptopId,
+			username,
+			time.Now().UnixNano(),
+		)
+		if err != nil {
+			return fmt.Errorf("cannot save rating history: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// update changes the scores of a laptop with change in a transaction and returns its updated rating
+func (store *SQLiteRatingStore) update(laptopId string, change func(tx *sql.Tx) error) (*Rating, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("cannot begin rating transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = change(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	rating, err := queryRating(tx, laptopId)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("cannot commit rating: %w", err)
+	}
+
+	return rating, nil
+}
+
+// addRating replaces the score of a user for a laptop and records it in the history
+func addRating(tx *sql.Tx, laptopId string, username string, score float64, reviewId string) error {
+	ratedAt := time.Now().UnixNano()
+
+	_, err := tx.Exec(
+		`INSERT INTO ratings (laptop_id, username, score, rated_at, review_id) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (laptop_id, username) DO UPDATE
+		SET score = excluded.score, rated_at = excluded.rated_at, review_id = excluded.review_id`,
+		laptopId,
+		username,
+		score,
+		ratedAt,
+		reviewId,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot save rating: %w", err)
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO rating_history (laptop_id, username, score, rated_at, review_id) VALUES (?, ?, ?, ?, ?)",
+		laptopId,
+		username,
+		score,
+		ratedAt,
+		reviewId,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot save rating history: %w", err)
+	}
+
+	return nil
+}
+
+func (store *SQLiteRatingStore) Find(laptopId string) (*Rating, error) {
+	rating, err := queryRating(store.db, laptopId)
+	if err != nil {
+		return nil, err
+	}
+	if rating.Count == 0 {
+		return nil, nil
+	}
+
+	return rating, nil
+}
+
+// ratingQuerier is implemented by both sql.DB and sql.Tx
+type ratingQuerier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// queryRating sums the current scores of a laptop
+func queryRating(querier ratingQuerier, laptopId string) (*Rating, error) {
+	rating := &Rating{}
+
+	err := querier.QueryRow(
+		"SELECT COUNT(*), COALESCE(SUM(score), 0) FROM ratings WHERE laptop_id = ?",
+		laptopId,
+	).Scan(&rating.Count, &rating.Sum)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query rating: %w", err)
+	}
+
+	return rating, nil
+}
+
+func (store *SQLiteRatingStore) FindByUser(username string) ([]*UserRating, error) {
+	return store.query(
+		"SELECT laptop_id, username, score, rated_at, review_id, 0 FROM ratings WHERE username = ? ORDER BY rated_at, laptop_id",
+		username,
+	)
+}
+
+func (store *SQLiteRatingStore) History(laptopId string) ([]*UserRating, error) {
+	return store.query(
+		"SELECT laptop_id, username, score, rated_at, review_id, removed FROM rating_history WHERE laptop_id = ? ORDER BY id",
+		laptopId,
+	)
+}
+
+func (store *SQLiteRatingStore) query(query string, args ...any) ([]*UserRating, error) {
+	rows, err := store.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query ratings: %w", err)
+	}
+	defer rows.Close()
+
+	ratings := []*UserRating{}
+	for rows.Next() {
+		rating := &UserRating{}
+		var ratedAt int64
+
+		err := rows.Scan(&rating.LaptopId, &rating.Username, &rating.Score, &ratedAt, &rating.ReviewId, &rating.Removed)
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan rating: %w", err)
+		}
+
+		rating.RatedAt = time.Unix(0, ratedAt)
+		ratings = append(ratings, rating)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read ratings: %w", err)
+	}
+
+	return ratings, nil
+}
@@ -0,0 +1,187 @@
+package service_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/warnshun/pcbook/service"
+)
+
+func TestRatingStore(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		newStore func(t *testing.T) service.RatingStore
+	}{
+		{
+			name: "in_memory",
+			newStore: func(t *testing.T) service.RatingStore {
+				return service.NewInMemoryRatingStore()
+			},
+		},
+		{
+			name: "sqlite",
+			newStore: func(t *testing.T) service.RatingStore {
+				store, err := service.NewSQLiteRatingStore(filepath.Join(t.TempDir(), "rating.db"))
+				require.NoError(t, err)
+				t.Cleanup(func() { store.Close() })
+				return store
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			store := tc.newStore(t)
+
+			rating, err := store.Find("laptop1")
+			require.NoError(t, err)
+			require.Nil(t, rating)
+
+			rating, err = store.Add("laptop1", "user1", 4)
+			require.NoError(t, err)
+			require.Equal(t, uint32(1), rating.Count)
+			require.Equal(t, 4.0, rating.Average())
+
+			_, err = store.Add("laptop1", "user2", 8)
+			require.NoError(t, err)
+			_, err = store.Add("laptop2", "user1", 5)
+			require.NoError(t, err)
+
+			// the new score of user1 replaces the previous one
+			rating, err = store.Add("laptop1", "user1", 10)
+			require.NoError(t, err)
+			require.Equal(t, uint32(2), rating.Count)
+			require.Equal(t, 9.0, rating.Average())
+
+			rating, err = store.Find("laptop1")
+			require.NoError(t, err)
+			require.Equal(t, uint32(2), rating.Count)
+			require.Equal(t, 18.0, rating.Sum)
+
+			ratings, err := store.FindByUser("user1")
+			require.NoError(t, err)
+			require.Len(t, ratings, 2)
+			require.Equal(t, "laptop2", ratings[0].LaptopId)
+			require.Equal(t, 5.0, ratings[0].Score)
+			require.Equal(t, "laptop1", ratings[1].LaptopId)
+			require.Equal(t, 10.0, ratings[1].Score)
+
+			history, err := store.History("laptop1")
+			require.NoError(t, err)
+			require.Len(t, history, 3)
+			for i, score := range []float64{4, 8, 10} {
+				require.Equal(t, score, history[i].Score)
+				require.Equal(t, "laptop1", history[i].LaptopId)
+			}
+			require.Equal(t, "user2", history[1].Username)
+			require.False(t, history[2].RatedAt.Before(history[0].RatedAt))
+
+			// the score of user1 did not come with a review
+			rating, err = store.RemoveReview("laptop1", "user1", "review1")
+			require.NoError(t, err)
+			require.Equal(t, uint32(2), rating.Count)
+
+			// a review submitted before the last score of user1 does not replace it
+			rating, err = store.AddReview("laptop1", "user1", "review1", 2, history[0].RatedAt)
+			require.NoError(t, err)
+			require.Equal(t, 9.0, rating.Average())
+
+			rating, err = store.AddReview("laptop1", "user1", "review1", 2, time.Now())
+			require.NoError(t, err)
+			require.Equal(t, uint32(2), rating.Count)
+			require.Equal(t, 5.0, rating.Average())
+
+			ratings, err = store.FindByUser("user1")
+			require.NoError(t, err)
+			require.Equal(t, "review1", ratings[1].ReviewId)
+
+			// only the score that came with the review is removed
+			rating, err = store.RemoveReview("laptop1", "user1", "review2")
+			require.NoError(t, err)
+			require.Equal(t, uint32(2), rating.Count)
+
+			rating, err = store.RemoveReview("laptop1", "user1", "review1")
+			require.NoError(t, err)
+			require.Equal(t, uint32(1), rating.Count)
+			require.Equal(t, 8.0, rating.Average())
+
+			// removing a missing score changes nothing
+			rating, err = store.RemoveReview("laptop1", "user1", "review1")
+			require.NoError(t, err)
+			require.Equal(t, uint32(1), rating.Count)
+
+			ratings, err = store.FindByUser("user1")
+			require.NoError(t, err)
+			require.Len(t, ratings, 1)
+
+			history, err = store.History("laptop1")
+			require.NoError(t, err)
+			require.Len(t, history, 5)
+			require.Equal(t, "review1", history[3].ReviewId)
+			require.True(t, history[4].Removed)
+			require.Equal(t, "user1", history[4].Username)
+
+			// a score given with RateLaptop replaces the one of a review, which then cannot remove it
+			_, err = store.AddReview("laptop1", "user2", "review3", 6, time.Now())
+			require.NoError(t, err)
+			_, err = store.Add("laptop1", "user2", 7)
+			require.NoError(t, err)
+			rating, err = store.RemoveReview("laptop1", "user2", "review3")
+			require.NoError(t, err)
+			require.Equal(t, uint32(1), rating.Count)
+			require.Equal(t, 7.0, rating.Average())
+
+			_, err = store.AddReview("laptop1", "user2", "review3", 6, time.Now())
+			require.NoError(t, err)
+			rating, err = store.RemoveReview("laptop1", "user2", "review3")
+			require.NoError(t, err)
+			require.Equal(t, uint32(0), rating.Count)
+
+			rating, err = store.Find("laptop1")
+			require.NoError(t, err)
+			require.Nil(t, rating)
+
+			history, err = store.History("unknown")
+			require.NoError(t, err)
+			require.Empty(t, history)
+		})
+	}
+}
+
+func TestSQLiteRatingStoreReopen(t *testing.T) {
+	t.Parallel()
+
+	dataSourceName := filepath.Join(t.TempDir(), "rating.db")
+
+	store, err := service.NewSQLiteRatingStore(dataSourceName)
+	require.NoError(t, err)
+
+	_, err = store.Add("laptop1", "user1", 3)
+	require.NoError(t, err)
+	_, err = store.Add("laptop1", "user1", 7)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	store, err = service.NewSQLiteRatingStore(dataSourceName)
+	require.NoError(t, err)
+	defer store.Close()
+
+	rating, err := store.Find("laptop1")
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), rating.Count)
+	require.Equal(t, 7.0, rating.Average())
+
+	history, err := store.History("laptop1")
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	require.Equal(t, "user1", history[0].Username)
+	require.Equal(t, 3.0, history[0].Score)
+}
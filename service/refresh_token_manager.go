@@ -0,0 +1,156 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrInvalidRefreshToken error
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+// ErrRefreshTokenReused error, the token may have been stolen so its whole family is revoked
+var ErrRefreshTokenReused = errors.New("refresh token already used")
+
+// REFRESH_TOKEN_REUSE_GRACE_PERIOD is how long after its rotation a refresh token can be used again
+// without revoking its login, as long as the token replacing it is unused, which the retry then supersedes.
+// It lets a client retry a rotation whose response was lost
+const REFRESH_TOKEN_REUSE_GRACE_PERIOD = 30 * time.Second
+
+// RefreshTokenManager issues refresh tokens and rotates them on use
+type RefreshTokenManager struct {
+	tokenStore    RefreshTokenStore
+	tokenDuration time.Duration
+}
+
+// NewRefreshTokenManager returns a new RefreshTokenManager,
+// each refresh token is valid for tokenDuration after it is issued
+func NewRefreshTokenManager(tokenStore RefreshTokenStore, tokenDuration time.Duration) *RefreshTokenManager {
+	return &RefreshTokenManager{
+		tokenStore:    tokenStore,
+		tokenDuration: tokenDuration,
+	}
+}
+
+// Issue issues the refresh token of a new login of the user
+func (manager *RefreshTokenManager) Issue(username string) (string, error) {
+	familyId, err := uuid.NewRandom()
+	if err != nil {
+		return "", fmt.Errorf("cannot generate refresh token family id: %w", err)
+	}
+
+	refreshToken, err := newRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = manager.save(refreshToken, username, familyId.String())
+	if err != nil {
+		return "", err
+	}
+
+	return refreshToken, nil
+}
+
+// Rotate uses a refresh token and returns its user with the refresh token replacing it.
+// Using a token again revokes all the tokens of its login and returns ErrRefreshTokenReused,
+// unless it is retried within the grace period and the token replacing it is unused,
+// in which case that token is superseded by the one returned
+func (manager *RefreshTokenManager) Rotate(refreshToken string) (string, string, error) {
+	newToken, err := newRefreshToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	token, err := manager.tokenStore.Find(hashRefreshToken(refreshToken))
+	if err != nil {
+		return "", "", err
+	}
+	if token == nil || token.Revoked {
+		return "", "", ErrInvalidRefreshToken
+	}
+
+	if time.Now().After(token.ExpiresAt) {
+		return "", "", fmt.Errorf("%w: it is expired", ErrInvalidRefreshToken)
+	}
+
+	token, rotated, err := manager.tokenStore.Rotate(
+		token.Hash,
+		manager.storedToken(newToken, token.Username, token.FamilyId),
+		REFRESH_TOKEN_REUSE_GRACE_PERIOD,
+	)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot save refresh token: %w", err)
+	}
+	if token == nil || token.Revoked {
+		return "", "", ErrInvalidRefreshToken
+	}
+
+	if !rotated {
+		err := manager.tokenStore.RevokeFamily(token.FamilyId)
+		if err != nil {
+			return "", "", err
+		}
+
+		return "", "", ErrRefreshTokenReused
+	}
+
+	return token.Username, newToken, nil
+}
+
+// Revoke revokes a refresh token together with all the tokens of its login
+func (manager *RefreshTokenManager) Revoke(refreshToken string) error {
+	token, err := manager.tokenStore.Find(hashRefreshToken(refreshToken))
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return ErrInvalidRefreshToken
+	}
+
+	return manager.tokenStore.RevokeFamily(token.FamilyId)
+}
+
+// save saves a new refresh token of the user to the store
+func (manager *RefreshTokenManager) save(refreshToken string, username string, familyId string) error {
+	err := manager.tokenStore.Save(manager.storedToken(refreshToken, username, familyId))
+	if err != nil {
+		return fmt.Errorf("cannot save refresh token: %w", err)
+	}
+
+	return nil
+}
+
+// storedToken returns the stored form of a new refresh token of the user
+func (manager *RefreshTokenManager) storedToken(refreshToken string, username string, familyId string) *RefreshToken {
+	return &RefreshToken{
+		Hash:      hashRefreshToken(refreshToken),
+		FamilyId:  familyId,
+		Username:  username,
+		ExpiresAt: time.Now().Add(manager.tokenDuration),
+	}
+}
+
+// newRefreshToken generates a random refresh token
+func newRefreshToken() (string, error) {
+	data := make([]byte, 32)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", fmt.Errorf("cannot generate refresh token: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// hashRefreshToken returns the hash a refresh token is stored with,
+// so that the tokens cannot be used by anyone reading the store
+func hashRefreshToken(refreshToken string) string {
+	hash := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,34 @@
+package service_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/warnshun/pcbook/service"
+)
+
+func TestRefreshTokenManagerRetry(t *testing.T) {
+	t.Parallel()
+
+	store := service.NewInMemoryRefreshTokenStore()
+	manager := service.NewRefreshTokenManager(store, time.Hour)
+
+	refreshToken, err := manager.Issue("user1")
+	require.NoError(t, err)
+
+	_, first, err := manager.Rotate(refreshToken)
+	require.NoError(t, err)
+	_, retried, err := manager.Rotate(refreshToken)
+	require.NoError(t, err)
+	require.NotEqual(t, first, retried)
+
+	// the replacement issued first is superseded by the retry, using it revokes the whole login
+	_, _, err = manager.Rotate(first)
+	require.ErrorIs(t, err, service.ErrRefreshTokenReused)
+
+	_, _, err = manager.Rotate(retried)
+	require.ErrorIs(t, err, service.ErrInvalidRefreshToken)
+	_, _, err = manager.Rotate(refreshToken)
+	require.ErrorIs(t, err, service.ErrInvalidRefreshToken)
+}
@@ -0,0 +1,200 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// RefreshToken is a refresh token of a user, only the hash of the token is stored
+type RefreshToken struct {
+	Hash string
+	// FamilyId identifies the login the token comes from, the tokens rotated from the same login share it
+	FamilyId  string
+	Username  string
+	ExpiresAt time.Time
+	// Used is true once the token has been rotated, at UsedAt
+	Used   bool
+	UsedAt time.Time
+	// ReplacedBy is the hash of the token replacing this one
+	ReplacedBy string
+	// Superseded is true once the rotation that issued the token has been retried,
+	// the token issued by the retry replaces it and using it again is a reuse
+	Superseded bool
+	// Revoked is true once the family of the token has been revoked
+	Revoked bool
+}
+
+// RefreshTokenStore is an interface to store refresh tokens
+type RefreshTokenStore interface {
+	// Save saves a new refresh token to the store
+	Save(token *RefreshToken) error
+	// Find finds a refresh token by its hash, nil if it does not exist
+	Find(hash string) (*RefreshToken, error)
+	// Rotate marks a refresh token as used and saves the token replacing it in one step.
+	// A used token is only replaced again by the retry of its rotation, less than gracePeriod after it was used
+	// and while its replacement is unused, in which case that replacement is superseded by the new one.
+	// It returns the token as it was before and whether the replacement is saved, nil if it does not exist
+	Rotate(hash string, replacement *RefreshToken, gracePeriod time.Duration) (*RefreshToken, bool, error)
+	// RevokeFamily revokes all the refresh tokens of a family
+	RevokeFamily(familyId string) error
+}
+
+// refreshTokenPurgeInterval is the minimum interval between two purges of the expired refresh tokens
+const refreshTokenPurgeInterval = time.Minute
+
+// InMemoryRefreshTokenStore stores refresh tokens in memory,
+// the expired tokens are deleted when they are found and purged periodically when tokens are saved
+type InMemoryRefreshTokenStore struct {
+	mutex  sync.Mutex
+	tokens map[string]*RefreshToken
+	// families are the hashes of the tokens of each family
+	families map[string][]string
+	purgedAt time.Time
+}
+
+// NewInMemoryRefreshTokenStore returns a new InMemoryRefreshTokenStore
+func NewInMemoryRefreshTokenStore() *InMemoryRefreshTokenStore {
+	return &InMemoryRefreshTokenStore{
+		tokens:   make(map[string]*RefreshToken),
+		families: make(map[string][]string),
+	}
+}
+
+func (store *InMemoryRefreshTokenStore) Save(token *RefreshToken) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.save(token)
+}
+
+func (store *InMemoryRefreshTokenStore) Find(hash string) (*RefreshToken, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	token := store.find(hash)
+	if token == nil {
+		return nil, nil
+	}
+
+	other := *token
+	return &other, nil
+}
+
+func (store *InMemoryRefreshTokenStore) Rotate(
+	hash string,
+	replacement *RefreshToken,
+	gracePeriod time.Duration,
+) (*RefreshToken, bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	token := store.find(hash)
+	if token == nil {
+		return nil, false, nil
+	}
+
+	other := *token
+	if token.Revoked || token.Superseded {
+		return &other, false, nil
+	}
+
+	var replaced *RefreshToken
+	if token.Used {
+		replaced = store.find(token.ReplacedBy)
+		retried := time.Since(token.UsedAt) <= gracePeriod &&
+			replaced != nil && !replaced.Used && !replaced.Superseded && !replaced.Revoked
+		if !retried {
+			return &other, false, nil
+		}
+	}
+
+	err := store.save(replacement)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if replaced != nil {
+		replaced.Superseded = true
+	}
+	if !token.Used {
+		token.Used = true
+		token.UsedAt = time.Now()
+	}
+	token.ReplacedBy = replacement.Hash
+
+	return &other, true, nil
+}
+
+func (store *InMemoryRefreshTokenStore) RevokeFamily(familyId string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, hash := range store.families[familyId] {
+		store.tokens[hash].Revoked = true
+	}
+
+	return nil
+}
+
+// save saves a new token, purging the expired tokens first if they have not been purged for a while
+func (store *InMemoryRefreshTokenStore) save(token *RefreshToken) error {
+	now := time.Now()
+	if now.Sub(store.purgedAt) >= refreshTokenPurgeInterval {
+		store.purgeExpired(now)
+	}
+
+	if store.tokens[token.Hash] != nil {
+		return ErrAlreadyExists
+	}
+
+	other := *token
+	store.tokens[token.Hash] = &other
+	store.families[token.FamilyId] = append(store.families[token.FamilyId], token.Hash)
+
+	return nil
+}
+
+// find returns the token with the hash, nil if it does not exist or is expired, in which case it is deleted
+func (store *InMemoryRefreshTokenStore) find(hash string) *RefreshToken {
+	token := store.tokens[hash]
+	if token == nil {
+		return nil
+	}
+
+	if time.Now().After(token.ExpiresAt) {
+		store.delete(token)
+		return nil
+	}
+
+	return token
+}
+
+// purgeExpired deletes the tokens expired at now
+func (store *InMemoryRefreshTokenStore) purgeExpired(now time.Time) {
+	for _, token := range store.tokens {
+		if now.After(token.ExpiresAt) {
+			store.delete(token)
+		}
+	}
+
+	store.purgedAt = now
+}
+
+// delete deletes a token together with its family once it has no tokens left
+func (store *InMemoryRefreshTokenStore) delete(token *RefreshToken) {
+	delete(store.tokens, token.Hash)
+
+	hashes := store.families[token.FamilyId]
+	for i, hash := range hashes {
+		if hash == token.Hash {
+			hashes = append(hashes[:i], hashes[i+1:]...)
+			break
+		}
+	}
+
+	if len(hashes) == 0 {
+		delete(store.families, token.FamilyId)
+	} else {
+		store.families[token.FamilyId] = hashes
+	}
+}
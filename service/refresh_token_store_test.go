@@ -0,0 +1,76 @@
+package service_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/warnshun/pcbook/service"
+)
+
+func TestInMemoryRefreshTokenStore(t *testing.T) {
+	t.Parallel()
+
+	store := service.NewInMemoryRefreshTokenStore()
+
+	err := store.Save(&service.RefreshToken{Hash: "expired", FamilyId: "family1", ExpiresAt: time.Now().Add(-time.Second)})
+	require.NoError(t, err)
+	err = store.Save(&service.RefreshToken{Hash: "valid", FamilyId: "family2", ExpiresAt: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	err = store.Save(&service.RefreshToken{Hash: "valid", FamilyId: "family2", ExpiresAt: time.Now().Add(time.Hour)})
+	require.ErrorIs(t, err, service.ErrAlreadyExists)
+
+	// the expired tokens are deleted
+	token, err := store.Find("expired")
+	require.NoError(t, err)
+	require.Nil(t, token)
+	token, rotated, err := store.Rotate("expired", &service.RefreshToken{Hash: "other", FamilyId: "family1"}, time.Minute)
+	require.NoError(t, err)
+	require.Nil(t, token)
+	require.False(t, rotated)
+
+	next := &service.RefreshToken{Hash: "next", FamilyId: "family2", ExpiresAt: time.Now().Add(time.Hour)}
+	token, rotated, err = store.Rotate("valid", next, time.Minute)
+	require.NoError(t, err)
+	require.False(t, token.Used)
+	require.True(t, rotated)
+
+	token, err = store.Find("valid")
+	require.NoError(t, err)
+	require.True(t, token.Used)
+	require.False(t, token.UsedAt.IsZero())
+	require.Equal(t, "next", token.ReplacedBy)
+
+	// a retry within the grace period supersedes the replacement issued first
+	retried := &service.RefreshToken{Hash: "retried", FamilyId: "family2", ExpiresAt: time.Now().Add(time.Hour)}
+	token, rotated, err = store.Rotate("valid", retried, time.Minute)
+	require.NoError(t, err)
+	require.True(t, token.Used)
+	require.True(t, rotated)
+
+	token, err = store.Find("next")
+	require.NoError(t, err)
+	require.True(t, token.Superseded)
+	token, err = store.Find("valid")
+	require.NoError(t, err)
+	require.Equal(t, "retried", token.ReplacedBy)
+
+	// once the grace period is over, the used token is not replaced again
+	other := &service.RefreshToken{Hash: "other", FamilyId: "family2", ExpiresAt: time.Now().Add(time.Hour)}
+	_, rotated, err = store.Rotate("valid", other, 0)
+	require.NoError(t, err)
+	require.False(t, rotated)
+	token, err = store.Find("other")
+	require.NoError(t, err)
+	require.Nil(t, token)
+
+	// a superseded token is not replaced
+	_, rotated, err = store.Rotate("next", other, time.Minute)
+	require.NoError(t, err)
+	require.False(t, rotated)
+
+	require.NoError(t, store.RevokeFamily("family2"))
+	token, err = store.Find("valid")
+	require.NoError(t, err)
+	require.True(t, token.Revoked)
+}
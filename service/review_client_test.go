@@ -0,0 +1,673 @@
+package service_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/warnshun/pcbook/pb"
+	"github.com/warnshun/pcbook/sample"
+	"github.com/warnshun/pcbook/service"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestClientSubmitReview(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	ratingStore := service.NewInMemoryRatingStore()
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	serverAddress := startTestReviewServer(t, laptopStore, service.NewInMemoryReviewStore(), ratingStore, jwtManager)
+	reviewClient := newTestReviewClient(t, serverAddress)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	user1 := newTestUserContext(t, jwtManager, "user1")
+	user2 := newTestUserContext(t, jwtManager, "user2")
+	admin := newTestRoleContext(t, jwtManager, "admin1", "admin")
+
+	// the scores of the reviews and of RateLaptop feed the same rating
+	rateTestLaptop(t, user2, laptopClient, laptop.GetId(), []float64{2})
+
+	res, err := reviewClient.SubmitReview(user1, &pb.SubmitReviewRequest{
+		LaptopId: laptop.GetId(),
+		Score:    8,
+		Title:    " Great laptop ",
+		Body:     "Fast and light",
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, res.GetReview().GetId())
+	require.Equal(t, "user1", res.GetReview().GetUsername())
+	require.Equal(t, "Great laptop", res.GetReview().GetTitle())
+	require.Equal(t, pb.Review_PENDING, res.GetReview().GetStatus())
+	require.Empty(t, res.GetReview().GetFlags())
+
+	// the score of a pending review is not counted
+	require.Equal(t, uint32(1), res.GetRatedCount())
+	require.Equal(t, 2.0, res.GetAverageScore())
+
+	moderated := moderateTestReview(t, admin, reviewClient, res.GetReview().GetId(), pb.Review_APPROVED, "")
+	require.Equal(t, uint32(2), moderated.GetRatedCount())
+	require.Equal(t, 5.0, moderated.GetAverageScore())
+
+	// a new review replaces the review of the user and waits for a new moderation
+	updated, err := reviewClient.SubmitReview(user1, &pb.SubmitReviewRequest{
+		LaptopId: laptop.GetId(),
+		Score:    4,
+		Title:    "Fine laptop",
+	})
+	require.NoError(t, err)
+	require.Equal(t, res.GetReview().GetId(), updated.GetReview().GetId())
+	require.Equal(t, pb.Review_PENDING, updated.GetReview().GetStatus())
+
+	moderated = moderateTestReview(t, admin, reviewClient, res.GetReview().GetId(), pb.Review_APPROVED, "")
+	require.Equal(t, uint32(2), moderated.GetRatedCount())
+	require.Equal(t, 3.0, moderated.GetAverageScore())
+
+	responses := rateTestLaptop(t, user1, laptopClient, laptop.GetId(), []float64{6})
+	require.Equal(t, uint32(2), responses[0].GetRatedCount())
+	require.Equal(t, 4.0, responses[0].GetAverageScore())
+
+	testCases := []struct {
+		name string
+		ctx  context.Context
+		req  *pb.SubmitReviewRequest
+		code codes.Code
+	}{
+		{
+			name: "anonymous",
+			ctx:  context.Background(),
+			req:  &pb.SubmitReviewRequest{LaptopId: laptop.GetId(), Score: 5, Title: "Title"},
+			code: codes.Unauthenticated,
+		},
+		{
+			name: "score_out_of_range",
+			ctx:  user1,
+			req:  &pb.SubmitReviewRequest{LaptopId: laptop.GetId(), Score: 11, Title: "Title"},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "no_title",
+			ctx:  user1,
+			req:  &pb.SubmitReviewRequest{LaptopId: laptop.GetId(), Score: 5, Title: "  "},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "body_too_long",
+			ctx:  user1,
+			req:  &pb.SubmitReviewRequest{LaptopId: laptop.GetId(), Score: 5, Title: "Title", Body: strings.Repeat("a", service.MAX_REVIEW_BODY_LENGTH+1)},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "unknown_laptop",
+			ctx:  user1,
+			req:  &pb.SubmitReviewRequest{LaptopId: "unknown", Score: 5, Title: "Title"},
+			code: codes.NotFound,
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := reviewClient.SubmitReview(tc.ctx, tc.req)
+			require.Equal(t, tc.code, status.Code(err))
+		})
+	}
+}
+
+func TestClientListReviews(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	serverAddress := startTestReviewServer(t, laptopStore, service.NewInMemoryReviewStore(), service.NewInMemoryRatingStore(), jwtManager)
+	reviewClient := newTestReviewClient(t, serverAddress)
+	admin := newTestRoleContext(t, jwtManager, "admin1", "admin")
+
+	n := 5
+	var reviewIds []string
+	for i := 0; i < n; i++ {
+		res, err := reviewClient.SubmitReview(newTestUserContext(t, jwtManager, fmt.Sprintf("user%d", i)), &pb.SubmitReviewRequest{
+			LaptopId: laptop.GetId(),
+			Score:    5,
+			Title:    fmt.Sprintf("Review %d", i),
+		})
+		require.NoError(t, err)
+
+		reviewIds = append(reviewIds, res.GetReview().GetId())
+		moderateTestReview(t, admin, reviewClient, res.GetReview().GetId(), pb.Review_APPROVED, "")
+	}
+
+	// the pending reviews are not listed
+	_, err = reviewClient.SubmitReview(newTestUserContext(t, jwtManager, "pending"), &pb.SubmitReviewRequest{
+		LaptopId: laptop.GetId(),
+		Score:    1,
+		Title:    "Pending",
+	})
+	require.NoError(t, err)
+
+	// the most recent reviews come first
+	var listed []string
+	pageToken := ""
+	for pages := 0; ; pages++ {
+		res, err := reviewClient.ListReviews(context.Background(), &pb.ListReviewsRequest{
+			LaptopId:  laptop.GetId(),
+			PageSize:  2,
+			PageToken: pageToken,
+		})
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(res.GetReviews()), 2)
+
+		for _, review := range res.GetReviews() {
+			listed = append(listed, review.GetId())
+		}
+
+		pageToken = res.GetNextPageToken()
+		if pageToken == "" {
+			require.Equal(t, 2, pages)
+			break
+		}
+	}
+
+	require.Len(t, listed, n)
+	for i, reviewId := range listed {
+		require.Equal(t, reviewIds[n-1-i], reviewId)
+	}
+
+	res, err := reviewClient.ListReviews(context.Background(), &pb.ListReviewsRequest{LaptopId: laptop.GetId()})
+	require.NoError(t, err)
+	require.Len(t, res.GetReviews(), n)
+	require.Empty(t, res.GetNextPageToken())
+
+	other := sample.NewLaptop()
+	err = laptopStore.Save(other)
+	require.NoError(t, err)
+
+	first, err := reviewClient.ListReviews(context.Background(), &pb.ListReviewsRequest{LaptopId: laptop.GetId(), PageSize: 1})
+	require.NoError(t, err)
+
+	_, err = reviewClient.ListReviews(context.Background(), &pb.ListReviewsRequest{LaptopId: other.GetId(), PageToken: first.GetNextPageToken()})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = reviewClient.ListReviews(context.Background(), &pb.ListReviewsRequest{LaptopId: laptop.GetId(), PageToken: "invalid"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = reviewClient.ListReviews(context.Background(), &pb.ListReviewsRequest{LaptopId: "unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestClientVoteReviewHelpful(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	serverAddress := startTestReviewServer(t, laptopStore, service.NewInMemoryReviewStore(), service.NewInMemoryRatingStore(), jwtManager)
+	reviewClient := newTestReviewClient(t, serverAddress)
+
+	user1 := newTestUserContext(t, jwtManager, "user1")
+	user2 := newTestUserContext(t, jwtManager, "user2")
+
+	submitted, err := reviewClient.SubmitReview(user1, &pb.SubmitReviewRequest{LaptopId: laptop.GetId(), Score: 7, Title: "Good"})
+	require.NoError(t, err)
+	reviewId := submitted.GetReview().GetId()
+
+	// a pending review cannot be voted for
+	_, err = reviewClient.VoteReviewHelpful(user2, &pb.VoteReviewHelpfulRequest{ReviewId: reviewId, Helpful: true})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	moderateTestReview(t, newTestRoleContext(t, jwtManager, "admin1", "admin"), reviewClient, reviewId, pb.Review_APPROVED, "")
+
+	// voting twice counts once
+	for i := 0; i < 2; i++ {
+		res, err := reviewClient.VoteReviewHelpful(user2, &pb.VoteReviewHelpfulRequest{ReviewId: reviewId, Helpful: true})
+		require.NoError(t, err)
+		require.Equal(t, reviewId, res.GetReviewId())
+		require.Equal(t, uint32(1), res.GetHelpfulCount())
+	}
+
+	listed, err := reviewClient.ListReviews(context.Background(), &pb.ListReviewsRequest{LaptopId: laptop.GetId()})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), listed.GetReviews()[0].GetHelpfulCount())
+
+	res, err := reviewClient.VoteReviewHelpful(user2, &pb.VoteReviewHelpfulRequest{ReviewId: reviewId, Helpful: false})
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), res.GetHelpfulCount())
+
+	_, err = reviewClient.VoteReviewHelpful(user1, &pb.VoteReviewHelpfulRequest{ReviewId: reviewId, Helpful: true})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = reviewClient.VoteReviewHelpful(user2, &pb.VoteReviewHelpfulRequest{ReviewId: "unknown", Helpful: true})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = reviewClient.VoteReviewHelpful(context.Background(), &pb.VoteReviewHelpfulRequest{ReviewId: reviewId, Helpful: true})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestClientModerateReview(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	serverAddress := startTestReviewServer(t, laptopStore, service.NewInMemoryReviewStore(), service.NewInMemoryRatingStore(), jwtManager)
+	reviewClient := newTestReviewClient(t, serverAddress)
+
+	user1 := newTestUserContext(t, jwtManager, "user1")
+	user2 := newTestUserContext(t, jwtManager, "user2")
+	admin := newTestRoleContext(t, jwtManager, "admin1", "admin")
+
+	res1, err := reviewClient.SubmitReview(user1, &pb.SubmitReviewRequest{LaptopId: laptop.GetId(), Score: 8, Title: "Good"})
+	require.NoError(t, err)
+	res2, err := reviewClient.SubmitReview(user2, &pb.SubmitReviewRequest{LaptopId: laptop.GetId(), Score: 4, Title: "Bad"})
+	require.NoError(t, err)
+
+	res := moderateTestReview(t, admin, reviewClient, res1.GetReview().GetId(), pb.Review_APPROVED, "")
+	require.Equal(t, pb.Review_APPROVED, res.GetReview().GetStatus())
+	require.Equal(t, uint32(1), res.GetRatedCount())
+	require.Equal(t, 8.0, res.GetAverageScore())
+
+	res = moderateTestReview(t, admin, reviewClient, res2.GetReview().GetId(), pb.Review_APPROVED, "")
+	require.Equal(t, uint32(2), res.GetRatedCount())
+	require.Equal(t, 6.0, res.GetAverageScore())
+
+	// rejecting an approved review removes its score
+	res = moderateTestReview(t, admin, reviewClient, res2.GetReview().GetId(), pb.Review_REJECTED, " Off topic ")
+	require.Equal(t, pb.Review_REJECTED, res.GetReview().GetStatus())
+	require.Equal(t, "Off topic", res.GetReview().GetModerationReason())
+	require.Equal(t, uint32(1), res.GetRatedCount())
+	require.Equal(t, 8.0, res.GetAverageScore())
+
+	listed, err := reviewClient.ListReviews(context.Background(), &pb.ListReviewsRequest{LaptopId: laptop.GetId()})
+	require.NoError(t, err)
+	require.Len(t, listed.GetReviews(), 1)
+	require.Equal(t, res1.GetReview().GetId(), listed.GetReviews()[0].GetId())
+
+	testCases := []struct {
+		name string
+		ctx  context.Context
+		req  *pb.ModerateReviewRequest
+		code codes.Code
+	}{
+		{
+			name: "not_admin",
+			ctx:  user1,
+			req:  &pb.ModerateReviewRequest{ReviewId: res1.GetReview().GetId(), Status: pb.Review_APPROVED},
+			code: codes.PermissionDenied,
+		},
+		{
+			name: "anonymous",
+			ctx:  context.Background(),
+			req:  &pb.ModerateReviewRequest{ReviewId: res1.GetReview().GetId(), Status: pb.Review_APPROVED},
+			code: codes.Unauthenticated,
+		},
+		{
+			name: "pending",
+			ctx:  admin,
+			req:  &pb.ModerateReviewRequest{ReviewId: res1.GetReview().GetId(), Status: pb.Review_PENDING},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "reject_without_reason",
+			ctx:  admin,
+			req:  &pb.ModerateReviewRequest{ReviewId: res1.GetReview().GetId(), Status: pb.Review_REJECTED, Reason: " "},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "unknown_review",
+			ctx:  admin,
+			req:  &pb.ModerateReviewRequest{ReviewId: "unknown", Status: pb.Review_APPROVED},
+			code: codes.NotFound,
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := reviewClient.ModerateReview(tc.ctx, tc.req)
+			require.Equal(t, tc.code, status.Code(err))
+		})
+	}
+}
+
+func TestClientModerateReviewRating(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	serverAddress := startTestReviewServer(t, laptopStore, service.NewInMemoryReviewStore(), service.NewInMemoryRatingStore(), jwtManager)
+	reviewClient := newTestReviewClient(t, serverAddress)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	user1 := newTestUserContext(t, jwtManager, "user1")
+	admin := newTestRoleContext(t, jwtManager, "admin1", "admin")
+
+	responses := rateTestLaptop(t, user1, laptopClient, laptop.GetId(), []float64{6})
+	require.Equal(t, uint32(1), responses[0].GetRatedCount())
+
+	// rejecting a review that was never approved keeps the score rated with RateLaptop
+	submitted, err := reviewClient.SubmitReview(user1, &pb.SubmitReviewRequest{LaptopId: laptop.GetId(), Score: 9, Title: "Great"})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), submitted.GetRatedCount())
+	require.Equal(t, 6.0, submitted.GetAverageScore())
+
+	res := moderateTestReview(t, admin, reviewClient, submitted.GetReview().GetId(), pb.Review_REJECTED, "Spam")
+	require.Equal(t, uint32(1), res.GetRatedCount())
+	require.Equal(t, 6.0, res.GetAverageScore())
+
+	_, err = reviewClient.SubmitReview(user1, &pb.SubmitReviewRequest{LaptopId: laptop.GetId(), Score: 9, Title: "Great"})
+	require.NoError(t, err)
+	res = moderateTestReview(t, admin, reviewClient, submitted.GetReview().GetId(), pb.Review_APPROVED, "")
+	require.Equal(t, uint32(1), res.GetRatedCount())
+	require.Equal(t, 9.0, res.GetAverageScore())
+
+	// editing an approved review stops counting its score until it is approved again
+	submitted, err = reviewClient.SubmitReview(user1, &pb.SubmitReviewRequest{LaptopId: laptop.GetId(), Score: 3, Title: "Worse"})
+	require.NoError(t, err)
+	require.Equal(t, pb.Review_PENDING, submitted.GetReview().GetStatus())
+	require.Equal(t, uint32(0), submitted.GetRatedCount())
+
+	res = moderateTestReview(t, admin, reviewClient, submitted.GetReview().GetId(), pb.Review_APPROVED, "")
+	require.Equal(t, uint32(1), res.GetRatedCount())
+	require.Equal(t, 3.0, res.GetAverageScore())
+}
+
+func TestClientModerateReviewLaterRating(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	serverAddress := startTestReviewServer(t, laptopStore, service.NewInMemoryReviewStore(), service.NewInMemoryRatingStore(), jwtManager)
+	reviewClient := newTestReviewClient(t, serverAddress)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	user1 := newTestUserContext(t, jwtManager, "user1")
+	admin := newTestRoleContext(t, jwtManager, "admin1", "admin")
+
+	submitted, err := reviewClient.SubmitReview(user1, &pb.SubmitReviewRequest{LaptopId: laptop.GetId(), Score: 9, Title: "Great"})
+	require.NoError(t, err)
+	moderateTestReview(t, admin, reviewClient, submitted.GetReview().GetId(), pb.Review_APPROVED, "")
+
+	// rejecting the review keeps the score the author rated with RateLaptop after it
+	rateTestLaptop(t, user1, laptopClient, laptop.GetId(), []float64{4})
+	res := moderateTestReview(t, admin, reviewClient, submitted.GetReview().GetId(), pb.Review_REJECTED, "Spam")
+	require.Equal(t, uint32(1), res.GetRatedCount())
+	require.Equal(t, 4.0, res.GetAverageScore())
+
+	// approving the review again does not replace that score either
+	res = moderateTestReview(t, admin, reviewClient, submitted.GetReview().GetId(), pb.Review_APPROVED, "")
+	require.Equal(t, uint32(1), res.GetRatedCount())
+	require.Equal(t, 4.0, res.GetAverageScore())
+
+	// nor does resubmitting it remove the score
+	resubmitted, err := reviewClient.SubmitReview(user1, &pb.SubmitReviewRequest{LaptopId: laptop.GetId(), Score: 2, Title: "Worse"})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), resubmitted.GetRatedCount())
+	require.Equal(t, 4.0, resubmitted.GetAverageScore())
+}
+
+func TestClientModerateReviewConcurrently(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	reviewStore := service.NewInMemoryReviewStore()
+	ratingStore := service.NewInMemoryRatingStore()
+	serverAddress := startTestReviewServer(t, laptopStore, reviewStore, ratingStore, jwtManager)
+	reviewClient := newTestReviewClient(t, serverAddress)
+
+	user1 := newTestUserContext(t, jwtManager, "user1")
+	admin := newTestRoleContext(t, jwtManager, "admin1", "admin")
+
+	for i := 0; i < 20; i++ {
+		submitted, err := reviewClient.SubmitReview(user1, &pb.SubmitReviewRequest{LaptopId: laptop.GetId(), Score: 9, Title: "Great"})
+		require.NoError(t, err)
+		reviewId := submitted.GetReview().GetId()
+
+		// an approval races a rejection, the rating must follow whichever status is kept
+		errs := make(chan error, 2)
+		go func() {
+			_, err := reviewClient.ModerateReview(admin, &pb.ModerateReviewRequest{ReviewId: reviewId, Status: pb.Review_APPROVED})
+			errs <- err
+		}()
+		go func() {
+			_, err := reviewClient.ModerateReview(admin, &pb.ModerateReviewRequest{ReviewId: reviewId, Status: pb.Review_REJECTED, Reason: "Spam"})
+			errs <- err
+		}()
+		require.NoError(t, <-errs)
+		require.NoError(t, <-errs)
+
+		review, err := reviewStore.Find(reviewId)
+		require.NoError(t, err)
+
+		rating, err := ratingStore.Find(laptop.GetId())
+		require.NoError(t, err)
+		if review.Status == pb.Review_APPROVED {
+			require.NotNil(t, rating)
+			require.Equal(t, uint32(1), rating.Count)
+		} else {
+			require.Nil(t, rating)
+		}
+	}
+}
+
+func TestClientListReviewsModeration(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	serverAddress := startTestReviewServer(
+		t,
+		laptopStore,
+		service.NewInMemoryReviewStore(),
+		service.NewInMemoryRatingStore(),
+		jwtManager,
+		service.WithBannedWords("scam"),
+	)
+	reviewClient := newTestReviewClient(t, serverAddress)
+
+	author := newTestUserContext(t, jwtManager, "user1")
+	admin := newTestRoleContext(t, jwtManager, "admin1", "admin")
+
+	submitted, err := reviewClient.SubmitReview(author, &pb.SubmitReviewRequest{LaptopId: laptop.GetId(), Score: 8, Title: "Not a scam"})
+	require.NoError(t, err)
+	moderateTestReview(t, admin, reviewClient, submitted.GetReview().GetId(), pb.Review_APPROVED, "Checked")
+
+	testCases := []struct {
+		name      string
+		ctx       context.Context
+		moderated bool
+	}{
+		{"anonymous", context.Background(), false},
+		{"other_user", newTestUserContext(t, jwtManager, "user2"), false},
+		{"author", author, true},
+		{"admin", admin, true},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := reviewClient.ListReviews(tc.ctx, &pb.ListReviewsRequest{LaptopId: laptop.GetId()})
+			require.NoError(t, err)
+			require.Len(t, res.GetReviews(), 1)
+
+			review := res.GetReviews()[0]
+			require.Equal(t, "Not a scam", review.GetTitle())
+			if tc.moderated {
+				require.Equal(t, "Checked", review.GetModerationReason())
+				require.Equal(t, []string{"banned word: scam"}, review.GetFlags())
+			} else {
+				require.Empty(t, review.GetModerationReason())
+				require.Empty(t, review.GetFlags())
+			}
+		})
+	}
+}
+
+func TestClientListPendingReviews(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	serverAddress := startTestReviewServer(
+		t,
+		laptopStore,
+		service.NewInMemoryReviewStore(),
+		service.NewInMemoryRatingStore(),
+		jwtManager,
+		service.WithBannedWords("scam", "c++", "$$$", " "),
+	)
+	reviewClient := newTestReviewClient(t, serverAddress)
+	admin := newTestRoleContext(t, jwtManager, "admin1", "admin")
+
+	clean, err := reviewClient.SubmitReview(newTestUserContext(t, jwtManager, "user1"), &pb.SubmitReviewRequest{
+		LaptopId: laptop.GetId(),
+		Score:    8,
+		Title:    "Good",
+		Body:     "Fast and light, scammers aside, abc++ works",
+	})
+	require.NoError(t, err)
+	require.Empty(t, clean.GetReview().GetFlags())
+
+	flagged, err := reviewClient.SubmitReview(newTestUserContext(t, jwtManager, "user2"), &pb.SubmitReviewRequest{
+		LaptopId: laptop.GetId(),
+		Score:    1,
+		Title:    "SCAM",
+		Body:     "Buy it cheaper at https://example.com/deal or cheap-laptops.net, it is a scam, $$$ for a C++ compiler",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"banned word: scam",
+		"banned word: $$$",
+		"banned word: c++",
+		"URL: https://example.com/deal",
+		"URL: cheap-laptops.net",
+	}, flagged.GetReview().GetFlags())
+
+	res, err := reviewClient.ListPendingReviews(admin, &pb.ListPendingReviewsRequest{PageSize: 1})
+	require.NoError(t, err)
+	require.Len(t, res.GetReviews(), 1)
+	require.Equal(t, flagged.GetReview().GetId(), res.GetReviews()[0].GetId())
+
+	res, err = reviewClient.ListPendingReviews(admin, &pb.ListPendingReviewsRequest{PageSize: 1, PageToken: res.GetNextPageToken()})
+	require.NoError(t, err)
+	require.Len(t, res.GetReviews(), 1)
+	require.Equal(t, clean.GetReview().GetId(), res.GetReviews()[0].GetId())
+	require.Empty(t, res.GetNextPageToken())
+
+	res, err = reviewClient.ListPendingReviews(admin, &pb.ListPendingReviewsRequest{FlaggedOnly: true})
+	require.NoError(t, err)
+	require.Len(t, res.GetReviews(), 1)
+	require.Equal(t, flagged.GetReview().GetId(), res.GetReviews()[0].GetId())
+
+	// the moderated reviews are not pending anymore
+	moderateTestReview(t, admin, reviewClient, flagged.GetReview().GetId(), pb.Review_REJECTED, "Spam")
+
+	res, err = reviewClient.ListPendingReviews(admin, &pb.ListPendingReviewsRequest{})
+	require.NoError(t, err)
+	require.Len(t, res.GetReviews(), 1)
+	require.Equal(t, clean.GetReview().GetId(), res.GetReviews()[0].GetId())
+
+	_, err = reviewClient.ListPendingReviews(newTestUserContext(t, jwtManager, "user1"), &pb.ListPendingReviewsRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+// startTestReviewServer starts the review and laptop servers behind the auth interceptor,
+// writing reviews and ratings require the user role and moderating them the admin role
+func startTestReviewServer(t *testing.T, laptopStore *service.InMemoryLaptopStore, reviewStore service.ReviewStore, ratingStore service.RatingStore, jwtManager *service.JWTManager, opts ...service.ReviewServerOption) string {
+	laptopServer := service.NewLaptopServer(laptopStore, nil, ratingStore)
+	reviewServer := service.NewReviewServer(reviewStore, ratingStore, laptopStore, opts...)
+
+	const laptopServicePath = "/LaptopService/"
+	const reviewServicePath = "/ReviewService/"
+	interceptor := service.NewAuthInterceptor(jwtManager, map[string][]string{
+		laptopServicePath + "RateLaptop":         {"admin", "user"},
+		reviewServicePath + "SubmitReview":       {"admin", "user"},
+		reviewServicePath + "VoteReviewHelpful":  {"admin", "user"},
+		reviewServicePath + "ListPendingReviews": {"admin"},
+		reviewServicePath + "ModerateReview":     {"admin"},
+	})
+
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(interceptor.Unary()),
+		grpc.StreamInterceptor(interceptor.Stream()),
+	)
+	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
+	pb.RegisterReviewServiceServer(grpcServer, reviewServer)
+	t.Cleanup(grpcServer.Stop)
+
+	listener, err := net.Listen("tcp", ":0") // random available port
+	require.NoError(t, err)
+
+	go grpcServer.Serve(listener)
+
+	return listener.Addr().String()
+}
+
+func moderateTestReview(t *testing.T, ctx context.Context, reviewClient pb.ReviewServiceClient, reviewId string, reviewStatus pb.Review_Status, reason string) *pb.ModerateReviewResponse {
+	res, err := reviewClient.ModerateReview(ctx, &pb.ModerateReviewRequest{
+		ReviewId: reviewId,
+		Status:   reviewStatus,
+		Reason:   reason,
+	})
+	require.NoError(t, err)
+	return res
+}
+
+func newTestReviewClient(t *testing.T, serverAddress string) pb.ReviewServiceClient {
+	conn, err := grpc.Dial(serverAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	return pb.NewReviewServiceClient(conn)
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// urlPattern matches the links of the reviews, with a scheme, starting with www.
+// or as a bare domain name of a common top-level domain
+var urlPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+|\b[a-z0-9-]+(?:\.[a-z0-9-]+)*\.(?:com|net|org|info|biz|io|co|me|xyz|top|ru|cn)\b(?:/[^\s<>"]*)?`)
+
+// reviewFlagger flags the reviews that need the attention of the admins
+type reviewFlagger struct {
+	// bannedWords matches any of the banned words as whole words, nil if there are none
+	bannedWords *regexp.Regexp
+}
+
+func newReviewFlagger(bannedWords []string) *reviewFlagger {
+	var patterns []string
+	for _, word := range bannedWords {
+		word = strings.TrimSpace(word)
+		if word != "" {
+			patterns = append(patterns, wholeWordPattern(word))
+		}
+	}
+
+	flagger := &reviewFlagger{}
+	if len(patterns) > 0 {
+		flagger.bannedWords = regexp.MustCompile(`(?i)` + strings.Join(patterns, "|"))
+	}
+
+	return flagger
+}
+
+// wholeWordPattern returns the pattern matching a word not part of a longer word,
+// a word boundary is only required on the sides where the word starts or ends with a word character,
+// since there is none next to a symbol like those of "c++" or "$$$"
+func wholeWordPattern(word string) string {
+	pattern := regexp.QuoteMeta(word)
+	if isWordChar(word[0]) {
+		pattern = `\b` + pattern
+	}
+	if isWordChar(word[len(word)-1]) {
+		pattern += `\b`
+	}
+
+	return `(?:` + pattern + `)`
+}
+
+// isWordChar tells whether a byte is an ASCII letter, digit or underscore, the word characters of \b
+func isWordChar(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// Flags returns the reasons to flag a review with the given texts, in the order they appear, nil if there are none
+func (flagger *reviewFlagger) Flags(texts ...string) []string {
+	var flags []string
+	seen := make(map[string]bool)
+	add := func(flag string) {
+		if !seen[flag] {
+			seen[flag] = true
+			flags = append(flags, flag)
+		}
+	}
+
+	for _, text := range texts {
+		if flagger.bannedWords != nil {
+			for _, word := range flagger.bannedWords.FindAllString(text, -1) {
+				add(fmt.Sprintf("banned word: %s", strings.ToLower(word)))
+			}
+		}
+
+		for _, url := range urlPattern.FindAllString(text, -1) {
+			add(fmt.Sprintf("URL: %s", url))
+		}
+	}
+
+	return flags
+}
@@ -0,0 +1,401 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/warnshun/pcbook/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// MAX_REVIEW_TITLE_LENGTH and MAX_REVIEW_BODY_LENGTH are the maximum lengths of the reviews in characters
+	MAX_REVIEW_TITLE_LENGTH = 200
+	MAX_REVIEW_BODY_LENGTH  = 10000
+)
+
+// ReviewServer is the server API for Review service.
+type ReviewServer struct {
+	pb.UnimplementedReviewServiceServer
+	reviewStore ReviewStore
+	ratingStore RatingStore
+	laptopStore LaptopStore
+	// minScore and maxScore are the range of the review scores
+	minScore float64
+	maxScore float64
+	flagger  *reviewFlagger
+	// reviewMutex serializes the changes of the review of each user for a laptop with the update of its score
+	reviewMutex keyedMutex
+}
+
+// ReviewServerOption configures a ReviewServer
+type ReviewServerOption func(server *ReviewServer)
+
+// WithReviewScoreRange sets the range of the review scores, both bounds included,
+// it is MIN_LAPTOP_SCORE to MAX_LAPTOP_SCORE by default.
+// The bounds must be finite with minScore less than maxScore, the server does not check them
+func WithReviewScoreRange(minScore float64, maxScore float64) ReviewServerOption {
+	return func(server *ReviewServer) {
+		server.minScore = minScore
+		server.maxScore = maxScore
+	}
+}
+
+// WithBannedWords flags the reviews containing any of the words, ignoring case,
+// the reviews containing URLs are always flagged
+func WithBannedWords(words ...string) ReviewServerOption {
+	return func(server *ReviewServer) {
+		server.flagger = newReviewFlagger(words)
+	}
+}
+
+// NewReviewServer returns a new ReviewServer,
+// the scores of the approved reviews are added to the ratings of ratingStore
+func NewReviewServer(reviewStore ReviewStore, ratingStore RatingStore, laptopStore LaptopStore, opts ...ReviewServerOption) *ReviewServer {
+	server := &ReviewServer{
+		reviewStore: reviewStore,
+		ratingStore: ratingStore,
+		laptopStore: laptopStore,
+		minScore:    MIN_LAPTOP_SCORE,
+		maxScore:    MAX_LAPTOP_SCORE,
+		flagger:     newReviewFlagger(nil),
+	}
+
+	for _, opt := range opts {
+		opt(server)
+	}
+
+	return server
+}
+
+// SubmitReview is a unary RPC to write the review of the user for a laptop,
+// the review is pending until an admin moderates it
+func (s *ReviewServer) SubmitReview(ctx context.Context, req *pb.SubmitReviewRequest) (*pb.SubmitReviewResponse, error) {
+	claims := ClaimsFromContext(ctx)
+	if claims == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "cannot review a laptop without a user")
+	}
+
+	laptopId := req.GetLaptopId()
+	log.Printf("receive a submit-review request: laptop id = %s, user = %s", laptopId, claims.Username)
+
+	score := req.GetScore()
+	// the comparisons are false for NaN
+	if !(score >= s.minScore && score <= s.maxScore) {
+		return nil, status.Errorf(codes.InvalidArgument, "score %v is not between %v and %v", score, s.minScore, s.maxScore)
+	}
+
+	title := strings.TrimSpace(req.GetTitle())
+	if title == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "review title is required")
+	}
+	if utf8.RuneCountInString(title) > MAX_REVIEW_TITLE_LENGTH {
+		return nil, status.Errorf(codes.InvalidArgument, "review title is longer than %d characters", MAX_REVIEW_TITLE_LENGTH)
+	}
+
+	body := strings.TrimSpace(req.GetBody())
+	if utf8.RuneCountInString(body) > MAX_REVIEW_BODY_LENGTH {
+		return nil, status.Errorf(codes.InvalidArgument, "review body is longer than %d characters", MAX_REVIEW_BODY_LENGTH)
+	}
+
+	laptop, err := s.laptopStore.Find(laptopId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find laptop: %v", err)
+	}
+	if laptop == nil {
+		return nil, status.Errorf(codes.NotFound, "laptop %s not found", laptopId)
+	}
+
+	unlock := s.reviewMutex.Lock(reviewKey(laptopId, claims.Username))
+	defer unlock()
+
+	review, _, err := s.reviewStore.Save(&Review{
+		LaptopId: laptopId,
+		Username: claims.Username,
+		Score:    score,
+		Title:    title,
+		Body:     body,
+		Flags:    s.flagger.Flags(title, body),
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot save review to the store: %v", err)
+	}
+
+	// the score of an approved review stops counting until the edited review is approved
+	rating, err := s.updateRating(review)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot update laptop rating: %v", err)
+	}
+
+	res := &pb.SubmitReviewResponse{
+		Review:       toPbReview(review),
+		RatedCount:   rating.Count,
+		AverageScore: rating.Average(),
+	}
+
+	return res, nil
+}
+
+// ListReviews is a unary RPC to list the approved reviews of a laptop, a page at a time,
+// the moderation reason and the flags of a review are only sent to the admins and its author
+func (s *ReviewServer) ListReviews(ctx context.Context, req *pb.ListReviewsRequest) (*pb.ListReviewsResponse, error) {
+	laptopId := req.GetLaptopId()
+	log.Printf("receive a list-reviews request: laptop id = %s", laptopId)
+
+	laptop, err := s.laptopStore.Find(laptopId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find laptop: %v", err)
+	}
+	if laptop == nil {
+		return nil, status.Errorf(codes.NotFound, "laptop %s not found", laptopId)
+	}
+
+	reviews, err := s.reviewStore.ListByLaptop(laptopId, pb.Review_APPROVED)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list reviews: %v", err)
+	}
+
+	page, nextPageToken, err := cutReviewPage(reviews, "laptop:"+laptopId, int(req.GetPageSize()), req.GetPageToken())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot list reviews: %v", err)
+	}
+
+	claims := ClaimsFromContext(ctx)
+
+	res := &pb.ListReviewsResponse{
+		NextPageToken: nextPageToken,
+	}
+	for _, review := range page {
+		pbReview := toPbReview(review)
+		if claims == nil || claims.Role != "admin" && claims.Username != review.Username {
+			pbReview.ModerationReason = ""
+			pbReview.Flags = nil
+		}
+
+		res.Reviews = append(res.Reviews, pbReview)
+	}
+
+	return res, nil
+}
+
+// VoteReviewHelpful is a unary RPC to record whether the user found a review helpful
+func (s *ReviewServer) VoteReviewHelpful(ctx context.Context, req *pb.VoteReviewHelpfulRequest) (*pb.VoteReviewHelpfulResponse, error) {
+	claims := ClaimsFromContext(ctx)
+	if claims == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "cannot vote without a user")
+	}
+
+	reviewId := req.GetReviewId()
+	log.Printf("receive a vote-review-helpful request: review id = %s, user = %s", reviewId, claims.Username)
+
+	review, err := s.reviewStore.Find(reviewId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find review: %v", err)
+	}
+	// only the approved reviews are public
+	if review == nil || review.Status != pb.Review_APPROVED {
+		return nil, status.Errorf(codes.NotFound, "review %s not found", reviewId)
+	}
+	if review.Username == claims.Username {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot vote for your own review")
+	}
+
+	review, err = s.reviewStore.Vote(reviewId, claims.Username, req.GetHelpful())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot vote for review: %v", err)
+	}
+
+	res := &pb.VoteReviewHelpfulResponse{
+		ReviewId:     reviewId,
+		HelpfulCount: review.HelpfulCount,
+	}
+
+	return res, nil
+}
+
+// ListPendingReviews is a unary RPC to list the reviews waiting for moderation, a page at a time
+func (s *ReviewServer) ListPendingReviews(ctx context.Context, req *pb.ListPendingReviewsRequest) (*pb.ListPendingReviewsResponse, error) {
+	log.Printf("receive a list-pending-reviews request: flagged only = %t", req.GetFlaggedOnly())
+
+	reviews, err := s.reviewStore.ListByStatus(pb.Review_PENDING)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list reviews: %v", err)
+	}
+
+	scope := "pending"
+	if req.GetFlaggedOnly() {
+		scope = "flagged"
+
+		var flagged []*Review
+		for _, review := range reviews {
+			if len(review.Flags) > 0 {
+				flagged = append(flagged, review)
+			}
+		}
+		reviews = flagged
+	}
+
+	page, nextPageToken, err := cutReviewPage(reviews, scope, int(req.GetPageSize()), req.GetPageToken())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot list reviews: %v", err)
+	}
+
+	res := &pb.ListPendingReviewsResponse{
+		NextPageToken: nextPageToken,
+	}
+	for _, review := range page {
+		res.Reviews = append(res.Reviews, toPbReview(review))
+	}
+
+	return res, nil
+}
+
+// ModerateReview is a unary RPC to approve or reject a review,
+// the score of the review is only counted in the laptop rating while it is approved
+func (s *ReviewServer) ModerateReview(ctx context.Context, req *pb.ModerateReviewRequest) (*pb.ModerateReviewResponse, error) {
+	reviewId := req.GetReviewId()
+	log.Printf("receive a moderate-review request: review id = %s, status = %s", reviewId, req.GetStatus())
+
+	reason := strings.TrimSpace(req.GetReason())
+	switch req.GetStatus() {
+	case pb.Review_APPROVED:
+	case pb.Review_REJECTED:
+		if reason == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "a reason is required to reject a review")
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "review status %s is not APPROVED or REJECTED", req.GetStatus())
+	}
+
+	review, err := s.reviewStore.Find(reviewId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find review: %v", err)
+	}
+	if review == nil {
+		return nil, status.Errorf(codes.NotFound, "review %s not found", reviewId)
+	}
+
+	// the ID of the review of a user for a laptop never changes, so its key can be locked before moderating it
+	unlock := s.reviewMutex.Lock(reviewKey(review.LaptopId, review.Username))
+	defer unlock()
+
+	review, _, err = s.reviewStore.Moderate(reviewId, req.GetStatus(), reason)
+	if errors.Is(err, ErrNotFound) {
+		return nil, status.Errorf(codes.NotFound, "review %s not found", reviewId)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot moderate review: %v", err)
+	}
+
+	rating, err := s.updateRating(review)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot update laptop rating: %v", err)
+	}
+
+	res := &pb.ModerateReviewResponse{
+		Review:       toPbReview(review),
+		RatedCount:   rating.Count,
+		AverageScore: rating.Average(),
+	}
+
+	return res, nil
+}
+
+// updateRating counts the score of a review in the laptop rating while it is approved and returns the rating,
+// the caller must hold the lock of the review.
+// The score of the author is the same whether it came with the review or from RateLaptop,
+// so it is only removed while it is the one that came with the review
+func (s *ReviewServer) updateRating(review *Review) (*Rating, error) {
+	if review.Status == pb.Review_APPROVED {
+		return s.ratingStore.AddReview(review.LaptopId, review.Username, review.Id, review.Score, review.UpdatedAt)
+	}
+
+	return s.ratingStore.RemoveReview(review.LaptopId, review.Username, review.Id)
+}
+
+// reviewKey is the key of the review of a user for a laptop in the review mutex
+func reviewKey(laptopId string, username string) string {
+	return laptopId + "/" + username
+}
+
+func toPbReview(review *Review) *pb.Review {
+	return &pb.Review{
+		Id:           review.Id,
+		LaptopId:     review.LaptopId,
+		Username:     review.Username,
+		Score:        review.Score,
+		Title:        review.Title,
+		Body:         review.Body,
+		HelpfulCount: review.HelpfulCount,
+		CreatedAt:    timestamppb.New(review.CreatedAt),
+		UpdatedAt:    timestamppb.New(review.UpdatedAt),
+		Status:       review.Status,
+		// the flags and the reason are only for the admins and the author
+		ModerationReason: review.ModerationReason,
+		Flags:            review.Flags,
+	}
+}
+
+// reviewCursor is the content of a review page token, it points right after
+// the last review of the previous page
+type reviewCursor struct {
+	// Scope identifies the listing the token belongs to
+	Scope     string `json:"s"`
+	CreatedAt int64  `json:"t"`
+	Id        string `json:"i"`
+}
+
+// cutReviewPage returns the reviews of the page after pageToken, reviews being the most recent first,
+// together with the token of the next page if there is one. scope identifies the listing of the reviews
+func cutReviewPage(reviews []*Review, scope string, pageSize int, pageToken string) ([]*Review, string, error) {
+	start := 0
+	if pageToken != "" {
+		cursor := &reviewCursor{}
+		data, err := base64.RawURLEncoding.DecodeString(pageToken)
+		if err == nil {
+			err = json.Unmarshal(data, cursor)
+		}
+		if err != nil {
+			return nil, "", ErrInvalidPageToken
+		}
+		if cursor.Scope != scope {
+			return nil, "", fmt.Errorf("%w: it belongs to another listing", ErrInvalidPageToken)
+		}
+
+		start = sort.Search(len(reviews), func(i int) bool {
+			createdAt := reviews[i].CreatedAt.UnixNano()
+			return createdAt < cursor.CreatedAt || createdAt == cursor.CreatedAt && reviews[i].Id < cursor.Id
+		})
+	}
+
+	end := len(reviews)
+	if pageSize > 0 && start+pageSize < end {
+		end = start + pageSize
+	}
+
+	page := reviews[start:end]
+	if end == len(reviews) {
+		return page, "", nil
+	}
+
+	last := page[len(page)-1]
+	data, err := json.Marshal(&reviewCursor{
+		Scope:     scope,
+		CreatedAt: last.CreatedAt.UnixNano(),
+		Id:        last.Id,
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot encode page token: %w", err)
+	}
+
+	return page, base64.RawURLEncoding.EncodeToString(data), nil
+}
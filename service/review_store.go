@@ -0,0 +1,204 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/warnshun/pcbook/pb"
+)
+
+// ReviewStore is an interface to store the written reviews of laptops
+type ReviewStore interface {
+	// Save saves the review of a user for a laptop and returns it with its ID, pending moderation,
+	// it replaces the previous review of the user, keeping its ID, creation time and votes.
+	// It also returns the status of the previous review, PENDING if there is none
+	Save(review *Review) (*Review, pb.Review_Status, error)
+	// Find finds a review by ID, returns nil if it does not exist
+	Find(reviewId string) (*Review, error)
+	// ListByLaptop lists the reviews of a laptop with the given status, the most recent first
+	ListByLaptop(laptopId string, status pb.Review_Status) ([]*Review, error)
+	// ListByStatus lists the reviews of all laptops with the given status, the most recent first
+	ListByStatus(status pb.Review_Status) ([]*Review, error)
+	// Vote records whether a user found a review helpful and returns the review
+	Vote(reviewId string, username string, helpful bool) (*Review, error)
+	// Moderate sets the status of a review with the reason of the admin and returns the review
+	// together with its previous status
+	Moderate(reviewId string, status pb.Review_Status, reason string) (*Review, pb.Review_Status, error)
+}
+
+// Review is the written review of a laptop by a user
+type Review struct {
+	Id           string
+	LaptopId     string
+	Username     string
+	Score        float64
+	Title        string
+	Body         string
+	HelpfulCount uint32
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	Status       pb.Review_Status
+	// ModerationReason is the reason given by the admin who moderated the review
+	ModerationReason string
+	// Flags are the reasons the review needs the attention of the admins
+	Flags []string
+}
+
+// clone returns a copy of the review that shares nothing with it
+func (review *Review) clone() *Review {
+	other := *review
+	other.Flags = append([]string(nil), review.Flags...)
+	return &other
+}
+
+// sortReviews sorts reviews from the most recent
+func sortReviews(reviews []*Review) {
+	sort.Slice(reviews, func(i, j int) bool {
+		if reviews[i].CreatedAt.Equal(reviews[j].CreatedAt) {
+			return reviews[i].Id > reviews[j].Id
+		}
+		return reviews[i].CreatedAt.After(reviews[j].CreatedAt)
+	})
+}
+
+// InMemoryReviewStore stores laptop reviews in memory
+type InMemoryReviewStore struct {
+	mutex   sync.RWMutex
+	reviews map[string]*Review
+	// laptopReviews are the review IDs of each user by laptop ID
+	laptopReviews map[string]map[string]string
+	// votes are the users who found each review helpful
+	votes map[string]map[string]bool
+}
+
+func NewInMemoryReviewStore() *InMemoryReviewStore {
+	return &InMemoryReviewStore{
+		reviews:       make(map[string]*Review),
+		laptopReviews: make(map[string]map[string]string),
+		votes:         make(map[string]map[string]bool),
+	}
+}
+
+func (store *InMemoryReviewStore) Save(review *Review) (*Review, pb.Review_Status, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	userReviews := store.laptopReviews[review.LaptopId]
+	if userReviews == nil {
+		userReviews = make(map[string]string)
+		store.laptopReviews[review.LaptopId] = userReviews
+	}
+
+	other := review.clone()
+	other.UpdatedAt = time.Now()
+	other.Status = pb.Review_PENDING
+	other.ModerationReason = ""
+
+	previousStatus := pb.Review_PENDING
+	if previous := store.reviews[userReviews[review.Username]]; previous != nil {
+		previousStatus = previous.Status
+		other.Id = previous.Id
+		other.CreatedAt = previous.CreatedAt
+		other.HelpfulCount = previous.HelpfulCount
+	} else {
+		reviewId, err := uuid.NewRandom()
+		if err != nil {
+			return nil, previousStatus, fmt.Errorf("cannot generate review id: %w", err)
+		}
+
+		other.Id = reviewId.String()
+		other.CreatedAt = other.UpdatedAt
+		other.HelpfulCount = 0
+	}
+
+	store.reviews[other.Id] = other
+	userReviews[other.Username] = other.Id
+
+	return other.clone(), previousStatus, nil
+}
+
+func (store *InMemoryReviewStore) Find(reviewId string) (*Review, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	review := store.reviews[reviewId]
+	if review == nil {
+		return nil, nil
+	}
+
+	return review.clone(), nil
+}
+
+func (store *InMemoryReviewStore) ListByLaptop(laptopId string, status pb.Review_Status) ([]*Review, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	reviews := []*Review{}
+	for _, reviewId := range store.laptopReviews[laptopId] {
+		if review := store.reviews[reviewId]; review.Status == status {
+			reviews = append(reviews, review.clone())
+		}
+	}
+	sortReviews(reviews)
+
+	return reviews, nil
+}
+
+func (store *InMemoryReviewStore) ListByStatus(status pb.Review_Status) ([]*Review, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	reviews := []*Review{}
+	for _, review := range store.reviews {
+		if review.Status == status {
+			reviews = append(reviews, review.clone())
+		}
+	}
+	sortReviews(reviews)
+
+	return reviews, nil
+}
+
+func (store *InMemoryReviewStore) Vote(reviewId string, username string, helpful bool) (*Review, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	review := store.reviews[reviewId]
+	if review == nil {
+		return nil, ErrNotFound
+	}
+
+	voters := store.votes[reviewId]
+	if voters == nil {
+		voters = make(map[string]bool)
+		store.votes[reviewId] = voters
+	}
+
+	if helpful {
+		voters[username] = true
+	} else {
+		delete(voters, username)
+	}
+	review.HelpfulCount = uint32(len(voters))
+
+	return review.clone(), nil
+}
+
+func (store *InMemoryReviewStore) Moderate(reviewId string, status pb.Review_Status, reason string) (*Review, pb.Review_Status, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	review := store.reviews[reviewId]
+	if review == nil {
+		return nil, pb.Review_PENDING, ErrNotFound
+	}
+
+	previousStatus := review.Status
+	review.Status = status
+	review.ModerationReason = reason
+
+	return review.clone(), previousStatus, nil
+}
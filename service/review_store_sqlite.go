@@ -0,0 +1,286 @@
+package service
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/warnshun/pcbook/pb"
+	_ "modernc.org/sqlite" // register the pure-Go SQLite driver
+)
+
+const createReviewsTables = `
+CREATE TABLE IF NOT EXISTS reviews (
+	id                TEXT PRIMARY KEY,
+	laptop_id         TEXT NOT NULL,
+	username          TEXT NOT NULL,
+	score             REAL NOT NULL,
+	title             TEXT NOT NULL,
+	body              TEXT NOT NULL,
+	created_at        INTEGER NOT NULL,
+	updated_at        INTEGER NOT NULL,
+	status            INTEGER NOT NULL DEFAULT 0,
+	moderation_reason TEXT NOT NULL DEFAULT '',
+	flags             TEXT NOT NULL DEFAULT '[]',
+	UNIQUE (laptop_id, username)
+);
+CREATE INDEX IF NOT EXISTS reviews_status ON reviews (status);
+CREATE TABLE IF NOT EXISTS review_votes (
+	review_id TEXT NOT NULL REFERENCES reviews (id),
+	username  TEXT NOT NULL,
+	PRIMARY KEY (review_id, username)
+)`
+
+// selectReviews selects the columns scanned by scanReview
+const selectReviews = `
+SELECT id, laptop_id, username, score, title, body, created_at, updated_at, status, moderation_reason, flags,
+	(SELECT COUNT(*) FROM review_votes WHERE review_id = reviews.id)
+FROM reviews`
+
+// SQLiteReviewStore stores laptop reviews in a SQLite database,
+// the times are stored as Unix nanoseconds
+type SQLiteReviewStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteReviewStore opens the SQLite database at dataSourceName and returns a new SQLiteReviewStore
+func NewSQLiteReviewStore(dataSourceName string) (*SQLiteReviewStore, error) {
+	db, err := sql.Open("sqlite", dataSourceName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open review database: %w", err)
+	}
+
+	// SQLite serializes writers anyway, and a single connection keeps
+	// ":memory:" databases shared by every query
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(createReviewsTables)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot create reviews tables: %w", err)
+	}
+
+	return &SQLiteReviewStore{
+		db: db,
+	}, nil
+}
+
+// Close closes the underlying database
+func (store *SQLiteReviewStore) Close() error {
+	return store.db.Close()
+}
+
+func (store *SQLiteReviewStore) Save(review *Review) (*Review, pb.Review_Status, error) {
+	reviewId, err := uuid.NewRandom()
+	if err != nil {
+		return nil, pb.Review_PENDING, fmt.Errorf("cannot generate review id: %w", err)
+	}
+
+	flags, err := json.Marshal(append([]string{}, review.Flags...))
+	if err != nil {
+		return nil, pb.Review_PENDING, fmt.Errorf("cannot marshal review flags: %w", err)
+	}
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return nil, pb.Review_PENDING, fmt.Errorf("cannot begin review transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	previousStatus := pb.Review_PENDING
+	err = tx.QueryRow(
+		"SELECT status FROM reviews WHERE laptop_id = ? AND username = ?",
+		review.LaptopId,
+		review.Username,
+	).Scan(&previousStatus)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, pb.Review_PENDING, fmt.Errorf("cannot find previous review: %w", err)
+	}
+
+	now := time.Now().UnixNano()
+
+	// the ID and creation time of a new review are ignored when the user already reviewed the laptop
+	_, err = tx.Exec(
+		`INSERT INTO reviews (id, laptop_id, username, score, title, body, created_at, updated_at, status, moderation_reason, flags)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, '', ?)
+		ON CONFLICT (laptop_id, username) DO UPDATE SET
+			score = excluded.score, title = excluded.title, body = excluded.body, updated_at = excluded.updated_at,
+			status = excluded.status, moderation_reason = '', flags = excluded.flags`,
+		reviewId.String(),
+		review.LaptopId,
+		review.Username,
+		review.Score,
+		review.Title,
+		review.Body,
+		now,
+		now,
+		pb.Review_PENDING,
+		string(flags),
+	)
+	if err != nil {
+		return nil, pb.Review_PENDING, fmt.Errorf("cannot save review: %w", err)
+	}
+
+	saved, err := scanReview(tx.QueryRow(
+		selectReviews+" WHERE laptop_id = ? AND username = ?",
+		review.LaptopId,
+		review.Username,
+	))
+	if err != nil {
+		return nil, pb.Review_PENDING, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, pb.Review_PENDING, fmt.Errorf("cannot commit review: %w", err)
+	}
+
+	return saved, previousStatus, nil
+}
+
+func (store *SQLiteReviewStore) Find(reviewId string) (*Review, error) {
+	review, err := scanReview(store.db.QueryRow(selectReviews+" WHERE id = ?", reviewId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return review, err
+}
+
+func (store *SQLiteReviewStore) ListByLaptop(laptopId string, status pb.Review_Status) ([]*Review, error) {
+	return store.query(selectReviews+" WHERE laptop_id = ? AND status = ? ORDER BY created_at DESC, id DESC", laptopId, status)
+}
+
+func (store *SQLiteReviewStore) ListByStatus(status pb.Review_Status) ([]*Review, error) {
+	return store.query(selectReviews+" WHERE status = ? ORDER BY created_at DESC, id DESC", status)
+}
+
+func (store *SQLiteReviewStore) query(query string, args ...any) ([]*Review, error) {
+	rows, err := store.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query reviews: %w", err)
+	}
+	defer rows.Close()
+
+	reviews := []*Review{}
+	for rows.Next() {
+		review, err := scanReview(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		reviews = append(reviews, review)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read reviews: %w", err)
+	}
+
+	return reviews, nil
+}
+
+func (store *SQLiteReviewStore) Vote(reviewId string, username string, helpful bool) (*Review, error) {
+	review, err := store.Find(reviewId)
+	if err != nil {
+		return nil, err
+	}
+	if review == nil {
+		return nil, ErrNotFound
+	}
+
+	if helpful {
+		_, err = store.db.Exec(
+			"INSERT INTO review_votes (review_id, username) VALUES (?, ?) ON CONFLICT DO NOTHING",
+			reviewId,
+			username,
+		)
+	} else {
+		_, err = store.db.Exec("DELETE FROM review_votes WHERE review_id = ? AND username = ?", reviewId, username)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot save review vote: %w", err)
+	}
+
+	return scanReview(store.db.QueryRow(selectReviews+" WHERE id = ?", reviewId))
+}
+
+func (store *SQLiteReviewStore) Moderate(reviewId string, status pb.Review_Status, reason string) (*Review, pb.Review_Status, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return nil, pb.Review_PENDING, fmt.Errorf("cannot begin review transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var previousStatus pb.Review_Status
+	err = tx.QueryRow("SELECT status FROM reviews WHERE id = ?", reviewId).Scan(&previousStatus)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, pb.Review_PENDING, ErrNotFound
+	}
+	if err != nil {
+		return nil, pb.Review_PENDING, fmt.Errorf("cannot find review: %w", err)
+	}
+
+	_, err = tx.Exec("UPDATE reviews SET status = ?, moderation_reason = ? WHERE id = ?", status, reason, reviewId)
+	if err != nil {
+		return nil, pb.Review_PENDING, fmt.Errorf("cannot moderate review: %w", err)
+	}
+
+	review, err := scanReview(tx.QueryRow(selectReviews+" WHERE id = ?", reviewId))
+	if err != nil {
+		return nil, pb.Review_PENDING, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, pb.Review_PENDING, fmt.Errorf("cannot commit review: %w", err)
+	}
+
+	return review, previousStatus, nil
+}
+
+// reviewScanner is implemented by both sql.Row and sql.Rows
+type reviewScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanReview scans a row selected with selectReviews, it returns sql.ErrNoRows as is
+func scanReview(row reviewScanner) (*Review, error) {
+	review := &Review{}
+	var createdAt, updatedAt int64
+	var flags string
+
+	err := row.Scan(
+		&review.Id,
+		&review.LaptopId,
+		&review.Username,
+		&review.Score,
+		&review.Title,
+		&review.Body,
+		&createdAt,
+		&updatedAt,
+		&review.Status,
+		&review.ModerationReason,
+		&flags,
+		&review.HelpfulCount,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot scan review: %w", err)
+	}
+
+	review.CreatedAt = time.Unix(0, createdAt)
+	review.UpdatedAt = time.Unix(0, updatedAt)
+
+	err = json.Unmarshal([]byte(flags), &review.Flags)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unmarshal review flags: %w", err)
+	}
+
+	return review, nil
+}
@@ -0,0 +1,138 @@
+package service_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/warnshun/pcbook/pb"
+	"github.com/warnshun/pcbook/service"
+)
+
+func TestReviewStore(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		newStore func(t *testing.T) service.ReviewStore
+	}{
+		{
+			name: "in_memory",
+			newStore: func(t *testing.T) service.ReviewStore {
+				return service.NewInMemoryReviewStore()
+			},
+		},
+		{
+			name: "sqlite",
+			newStore: func(t *testing.T) service.ReviewStore {
+				store, err := service.NewSQLiteReviewStore(filepath.Join(t.TempDir(), "review.db"))
+				require.NoError(t, err)
+				t.Cleanup(func() { store.Close() })
+				return store
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			store := tc.newStore(t)
+
+			first, _, err := store.Save(&service.Review{LaptopId: "laptop1", Username: "user1", Score: 4, Title: "Good", Body: "Fast"})
+			require.NoError(t, err)
+			require.NotEmpty(t, first.Id)
+			require.False(t, first.CreatedAt.IsZero())
+			require.Equal(t, pb.Review_PENDING, first.Status)
+
+			second, _, err := store.Save(&service.Review{LaptopId: "laptop1", Username: "user2", Score: 2, Title: "Bad", Flags: []string{"URL: spam.com"}})
+			require.NoError(t, err)
+			require.NotEqual(t, first.Id, second.Id)
+
+			_, _, err = store.Save(&service.Review{LaptopId: "laptop2", Username: "user1", Score: 5, Title: "Great"})
+			require.NoError(t, err)
+
+			review, err := store.Vote(first.Id, "user2", true)
+			require.NoError(t, err)
+			require.Equal(t, uint32(1), review.HelpfulCount)
+			review, err = store.Vote(first.Id, "user2", true)
+			require.NoError(t, err)
+			require.Equal(t, uint32(1), review.HelpfulCount)
+			review, err = store.Vote(first.Id, "user3", true)
+			require.NoError(t, err)
+			require.Equal(t, uint32(2), review.HelpfulCount)
+			review, err = store.Vote(first.Id, "user3", false)
+			require.NoError(t, err)
+			require.Equal(t, uint32(1), review.HelpfulCount)
+
+			_, err = store.Vote("unknown", "user2", true)
+			require.ErrorIs(t, err, service.ErrNotFound)
+
+			// a new review of user1 replaces the previous one and keeps its votes
+			updated, previousStatus, err := store.Save(&service.Review{LaptopId: "laptop1", Username: "user1", Score: 3, Title: "Fine", Body: "Fast but loud"})
+			require.NoError(t, err)
+			require.Equal(t, first.Id, updated.Id)
+			require.Equal(t, pb.Review_PENDING, previousStatus)
+			require.True(t, first.CreatedAt.Equal(updated.CreatedAt))
+			require.False(t, updated.UpdatedAt.Before(first.UpdatedAt))
+			require.Equal(t, uint32(1), updated.HelpfulCount)
+
+			review, err = store.Find(first.Id)
+			require.NoError(t, err)
+			require.Equal(t, "Fine", review.Title)
+			require.Equal(t, "Fast but loud", review.Body)
+			require.Equal(t, 3.0, review.Score)
+
+			review, err = store.Find("unknown")
+			require.NoError(t, err)
+			require.Nil(t, review)
+
+			reviews, err := store.ListByLaptop("laptop1", pb.Review_PENDING)
+			require.NoError(t, err)
+			require.Len(t, reviews, 2)
+			require.Equal(t, second.Id, reviews[0].Id)
+			require.Equal(t, []string{"URL: spam.com"}, reviews[0].Flags)
+			require.Equal(t, first.Id, reviews[1].Id)
+			require.Equal(t, uint32(1), reviews[1].HelpfulCount)
+
+			moderated, previousStatus, err := store.Moderate(first.Id, pb.Review_APPROVED, "")
+			require.NoError(t, err)
+			require.Equal(t, pb.Review_APPROVED, moderated.Status)
+			require.Equal(t, pb.Review_PENDING, previousStatus)
+			moderated, _, err = store.Moderate(second.Id, pb.Review_REJECTED, "Spam")
+			require.NoError(t, err)
+			require.Equal(t, "Spam", moderated.ModerationReason)
+
+			moderated, previousStatus, err = store.Moderate(second.Id, pb.Review_REJECTED, "Spam again")
+			require.NoError(t, err)
+			require.Equal(t, pb.Review_REJECTED, previousStatus)
+
+			_, _, err = store.Moderate("unknown", pb.Review_APPROVED, "")
+			require.ErrorIs(t, err, service.ErrNotFound)
+
+			reviews, err = store.ListByLaptop("laptop1", pb.Review_APPROVED)
+			require.NoError(t, err)
+			require.Len(t, reviews, 1)
+			require.Equal(t, first.Id, reviews[0].Id)
+
+			reviews, err = store.ListByStatus(pb.Review_PENDING)
+			require.NoError(t, err)
+			require.Len(t, reviews, 1)
+			require.Equal(t, "laptop2", reviews[0].LaptopId)
+
+			// an edited review waits for a new moderation
+			updated, previousStatus, err = store.Save(&service.Review{LaptopId: "laptop1", Username: "user2", Score: 3, Title: "Not bad"})
+			require.NoError(t, err)
+			require.Equal(t, pb.Review_REJECTED, previousStatus)
+			require.Equal(t, pb.Review_PENDING, updated.Status)
+			require.Empty(t, updated.ModerationReason)
+			require.Empty(t, updated.Flags)
+
+			reviews, err = store.ListByLaptop("unknown", pb.Review_APPROVED)
+			require.NoError(t, err)
+			require.Empty(t, reviews)
+		})
+	}
+}
@@ -0,0 +1,404 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config configures the connection to a bucket of an S3-compatible object store
+type S3Config struct {
+	// Endpoint is the URL of the object store, such as https://s3.us-east-1.amazonaws.com
+	Endpoint string
+	// Region is the region the requests are signed for, us-east-1 if empty
+	Region          string
+	Bucket          string
+	AccessKeyId     string
+	SecretAccessKey string
+	// PathStyle addresses the bucket in the path of the URLs instead of in the host name,
+	// as most S3-compatible stores other than AWS expect
+	PathStyle bool
+	// HTTPClient sends the requests, a client giving up on unresponsive stores if nil
+	HTTPClient *http.Client
+}
+
+const (
+	s3DefaultRegion  = "us-east-1"
+	s3SigningAlgo    = "AWS4-HMAC-SHA256"
+	s3DateFormat     = "20060102T150405Z"
+	s3EmptyHash      = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3ListObjectsMax = 1000
+	// s3ConnectTimeout and s3ResponseTimeout bound the wait for an unresponsive store by the default HTTP client,
+	// s3ClientTimeout bounds whole requests, the transfer of the largest images included
+	s3ConnectTimeout  = 10 * time.Second
+	s3ResponseTimeout = 30 * time.Second
+	s3ClientTimeout   = 10 * time.Minute
+)
+
+// s3Client sends the requests of the S3 REST API, signed with AWS Signature Version 4
+type s3Client struct {
+	config     S3Config
+	endpoint   *url.URL
+	httpClient *http.Client
+	// now returns the time the requests are signed at
+	now func() time.Time
+}
+
+func newS3Client(config S3Config) (*s3Client, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse S3 endpoint: %w", err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("S3 endpoint %q is not an http or https URL", config.Endpoint)
+	}
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("S3 bucket is required")
+	}
+	if config.AccessKeyId == "" || config.SecretAccessKey == "" {
+		return nil, fmt.Errorf("S3 access key id and secret access key are required")
+	}
+
+	if config.Region == "" {
+		config.Region = s3DefaultRegion
+	}
+
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = newS3HTTPClient()
+	}
+
+	return &s3Client{
+		config:     config,
+		endpoint:   endpoint,
+		httpClient: httpClient,
+		now:        time.Now,
+	}, nil
+}
+
+// newS3HTTPClient returns the default HTTP client of the S3 requests,
+// which unlike http.DefaultClient never waits forever for the store
+func newS3HTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: s3ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = s3ConnectTimeout
+	transport.ResponseHeaderTimeout = s3ResponseTimeout
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   s3ClientTimeout,
+	}
+}
+
+// objectURL returns the URL of an object, or of the bucket if key is empty
+func (client *s3Client) objectURL(key string) *url.URL {
+	objectURL := *client.endpoint
+	path := strings.TrimSuffix(objectURL.Path, "/")
+
+	if client.config.PathStyle {
+		path += "/" + client.config.Bucket
+	} else {
+		objectURL.Host = client.config.Bucket + "." + objectURL.Host
+	}
+	path += "/" + key
+
+	objectURL.Path = path
+	objectURL.RawPath = s3Escape(path, false)
+	return &objectURL
+}
+
+// putObject uploads an object of the given size, payloadHash is the hex SHA-256 of its data
+func (client *s3Client) putObject(ctx context.Context, key string, data io.Reader, size int64, payloadHash string, contentType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, client.objectURL(key).String(), data)
+	if err != nil {
+		return fmt.Errorf("cannot create S3 request: %w", err)
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	res, err := client.do(req, payloadHash)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+// putBytes uploads an object from memory
+func (client *s3Client) putBytes(ctx context.Context, key string, data []byte, contentType string) error {
+	hash := sha256.Sum256(data)
+	return client.putObject(ctx, key, bytes.NewReader(data), int64(len(data)), hex.EncodeToString(hash[:]), contentType)
+}
+
+// getObject downloads an object, it returns ErrNotFound if the object does not exist
+func (client *s3Client) getObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, client.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create S3 request: %w", err)
+	}
+
+	res, err := client.do(req, s3EmptyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+// getBytes downloads an object in memory
+func (client *s3Client) getBytes(ctx context.Context, key string) ([]byte, error) {
+	body, err := client.getObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read S3 object %s: %w", key, err)
+	}
+
+	return data, nil
+}
+
+// deleteObject deletes an object, deleting a missing object succeeds
+func (client *s3Client) deleteObject(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, client.objectURL(key).String(), nil)
+	if err != nil {
+		return fmt.Errorf("cannot create S3 request: %w", err)
+	}
+
+	res, err := client.do(req, s3EmptyHash)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if res != nil {
+		res.Body.Close()
+	}
+
+	return nil
+}
+
+// s3ListBucketResult is the response of ListObjectsV2
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// listObjects lists the keys of the objects starting with prefix, following the pages of the listing
+func (client *s3Client) listObjects(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	continuationToken := ""
+
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		query.Set("max-keys", fmt.Sprint(s3ListObjectsMax))
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		bucketURL := client.objectURL("")
+		bucketURL.RawQuery = query.Encode()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, bucketURL.String(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create S3 request: %w", err)
+		}
+
+		res, err := client.do(req, s3EmptyHash)
+		if err != nil {
+			return nil, err
+		}
+
+		result := &s3ListBucketResult{}
+		err = xml.NewDecoder(res.Body).Decode(result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse S3 object list: %w", err)
+		}
+
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		if result.NextContinuationToken == "" {
+			return nil, fmt.Errorf("truncated S3 object list has no continuation token")
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+// s3ErrorResponse is the body of the S3 error responses
+type s3ErrorResponse struct {
+	Code    string
+	Message string
+}
+
+// do signs and sends a request, it returns ErrNotFound for the missing objects
+// and an error with the S3 error code for the other failures
+func (client *s3Client) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	client.sign(req, payloadHash, client.now())
+
+	res, err := client.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot send S3 request: %w", err)
+	}
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+
+	errorResponse := &s3ErrorResponse{}
+	data, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if xml.Unmarshal(data, errorResponse) != nil || errorResponse.Code == "" {
+		errorResponse.Code = res.Status
+	}
+
+	// a missing bucket is a configuration error rather than a missing object
+	if res.StatusCode == http.StatusNotFound && errorResponse.Code != "NoSuchBucket" {
+		return nil, ErrNotFound
+	}
+
+	return nil, fmt.Errorf("S3 %s %s failed: %s: %s", req.Method, req.URL.Path, errorResponse.Code, errorResponse.Message)
+}
+
+// sign adds the AWS Signature Version 4 of a request to its headers,
+// along with the headers the signature requires
+func (client *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(s3DateFormat)
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", amzDate[:8], client.config.Region)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	canonicalRequest, signedHeaders := canonicalS3Request(req, payloadHash)
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3SigningAlgo,
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+client.config.SecretAccessKey), amzDate[:8])
+	key = hmacSHA256(key, client.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3SigningAlgo,
+		client.config.AccessKeyId,
+		scope,
+		signedHeaders,
+		signature,
+	))
+}
+
+// canonicalS3Request returns the canonical form of a request that is signed,
+// and the names of its signed headers. The escaped path and query of the request
+// are set to their canonical form so that the request sent is the one signed
+func canonicalS3Request(req *http.Request, payloadHash string) (string, string) {
+	req.URL.RawPath = s3Escape(req.URL.Path, false)
+
+	var query []string
+	for name, values := range req.URL.Query() {
+		for _, value := range values {
+			query = append(query, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	sort.Strings(query)
+	req.URL.RawQuery = strings.Join(query, "&")
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		if name == "Authorization" {
+			continue
+		}
+		headers[strings.ToLower(name)] = strings.Join(strings.Fields(strings.Join(values, ",")), " ")
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.RawPath
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	return canonicalRequest, signedHeaders
+}
+
+// s3Escape percent-encodes everything but the unreserved characters of RFC 3986,
+// and the slashes of the paths unless escapeSlash is true
+func s3Escape(text string, escapeSlash bool) string {
+	var escaped strings.Builder
+	for _, b := range []byte(text) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~':
+			escaped.WriteByte(b)
+		case b == '/' && !escapeSlash:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+
+	return escaped.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
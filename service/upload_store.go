@@ -0,0 +1,353 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrUploadGap error
+var ErrUploadGap = errors.New("chunk does not continue the upload")
+
+// uploadSessionTTL is how long an upload can stay idle before it is dropped
+const uploadSessionTTL = time.Hour
+
+// UploadStore is an interface to store the image uploads in progress
+type UploadStore interface {
+	// Start starts a new upload of an image of a laptop and returns its ID
+	Start(laptopId string) (string, error)
+	// Find finds an upload, returns nil if it does not exist or has expired
+	Find(uploadId string) (*UploadSession, error)
+	// Append appends a chunk at the offset of the upload and returns its new size,
+	// the bytes already received are skipped so that a chunk can be sent again
+	Append(uploadId string, offset int64, data []byte) (int64, error)
+	// Open opens the bytes received for an upload for reading
+	Open(uploadId string) (io.ReadCloser, error)
+	// Delete deletes an upload
+	Delete(uploadId string) error
+}
+
+// UploadSession contains information about an image upload in progress
+type UploadSession struct {
+	Id        string
+	LaptopId  string
+	Size      int64
+	UpdatedAt time.Time
+}
+
+// InMemoryUploadStore stores image uploads in memory, it suits small images only
+type InMemoryUploadStore struct {
+	mutex   sync.Mutex
+	uploads map[string]*upload
+}
+
+type upload struct {
+	session UploadSession
+	data    []byte
+}
+
+// NewInMemoryUploadStore returns a new InMemoryUploadStore
+func NewInMemoryUploadStore() *InMemoryUploadStore {
+	return &InMemoryUploadStore{
+		uploads: make(map[string]*upload),
+	}
+}
+
+// Start starts a new upload of an image of a laptop and returns its ID
+func (store *InMemoryUploadStore) Start(laptopId string) (string, error) {
+	uploadId, err := uuid.NewRandom()
+	if err != nil {
+		return "", fmt.Errorf("cannot generate upload id: %w", err)
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.expire(time.Now())
+
+	store.uploads[uploadId.String()] = &upload{
+		session: UploadSession{
+			Id:        uploadId.String(),
+			LaptopId:  laptopId,
+			UpdatedAt: time.Now(),
+		},
+	}
+
+	return uploadId.String(), nil
+}
+
+// expire drops the uploads idle for too long, the caller must hold the lock
+func (store *InMemoryUploadStore) expire(now time.Time) {
+	for uploadId, upload := range store.uploads {
+		if now.Sub(upload.session.UpdatedAt) > uploadSessionTTL {
+			delete(store.uploads, uploadId)
+		}
+	}
+}
+
+// find returns an upload unless it has expired, the caller must hold the lock
+func (store *InMemoryUploadStore) find(uploadId string) *upload {
+	upload := store.uploads[uploadId]
+	if upload == nil || time.Since(upload.session.UpdatedAt) > uploadSessionTTL {
+		return nil
+	}
+
+	return upload
+}
+
+// Find finds an upload, returns nil if it does not exist or has expired
+func (store *InMemoryUploadStore) Find(uploadId string) (*UploadSession, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	upload := store.find(uploadId)
+	if upload == nil {
+		return nil, nil
+	}
+
+	session := upload.session
+	return &session, nil
+}
+
+// Append appends a chunk at the offset of the upload and returns its new size
+func (store *InMemoryUploadStore) Append(uploadId string, offset int64, data []byte) (int64, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	upload := store.find(uploadId)
+	if upload == nil {
+		return 0, ErrNotFound
+	}
+
+	size := upload.session.Size
+	if offset > size {
+		return size, fmt.Errorf("%w: offset %d is after the %d bytes received", ErrUploadGap, offset, size)
+	}
+
+	// skip the part of the chunk already received
+	if skip := size - offset; skip < int64(len(data)) {
+		upload.data = append(upload.data, data[skip:]...)
+		upload.session.Size = int64(len(upload.data))
+	}
+	upload.session.UpdatedAt = time.Now()
+
+	return upload.session.Size, nil
+}
+
+// Open opens the bytes received for an upload for reading
+func (store *InMemoryUploadStore) Open(uploadId string) (io.ReadCloser, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	upload := store.find(uploadId)
+	if upload == nil {
+		return nil, ErrNotFound
+	}
+
+	data := make([]byte, len(upload.data))
+	copy(data, upload.data)
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Delete deletes an upload
+func (store *InMemoryUploadStore) Delete(uploadId string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.uploads, uploadId)
+	return nil
+}
+
+// uploadFileSuffix is the suffix of the files of DiskUploadStore
+const uploadFileSuffix = ".upload"
+
+// DiskUploadStore stores the bytes of image uploads in files and their sessions in memory
+type DiskUploadStore struct {
+	mutex    sync.Mutex
+	folder   string
+	sessions map[string]*UploadSession
+}
+
+// NewDiskUploadStore returns a new DiskUploadStore,
+// the files of the uploads of a previous run are removed as their sessions are lost
+func NewDiskUploadStore(folder string) (*DiskUploadStore, error) {
+	err := os.MkdirAll(folder, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create upload folder: %w", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(folder, "*"+uploadFileSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("cannot list upload files: %w", err)
+	}
+
+	for _, file := range files {
+		err := os.Remove(file)
+		if err != nil {
+			return nil, fmt.Errorf("cannot remove upload file: %w", err)
+		}
+	}
+
+	return &DiskUploadStore{
+		folder:   folder,
+		sessions: make(map[string]*UploadSession),
+	}, nil
+}
+
+func (store *DiskUploadStore) path(uploadId string) string {
+	return filepath.Join(store.folder, uploadId+uploadFileSuffix)
+}
+
+// Start starts a new upload of an image of a laptop and returns its ID
+func (store *DiskUploadStore) Start(laptopId string) (string, error) {
+	uploadId, err := uuid.NewRandom()
+	if err != nil {
+		return "", fmt.Errorf("cannot generate upload id: %w", err)
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.expire(time.Now())
+
+	file, err := os.Create(store.path(uploadId.String()))
+	if err != nil {
+		return "", fmt.Errorf("cannot create upload file: %w", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return "", fmt.Errorf("cannot create upload file: %w", err)
+	}
+
+	store.sessions[uploadId.String()] = &UploadSession{
+		Id:        uploadId.String(),
+		LaptopId:  laptopId,
+		UpdatedAt: time.Now(),
+	}
+
+	return uploadId.String(), nil
+}
+
+// expire drops the uploads idle for too long, the caller must hold the lock
+func (store *DiskUploadStore) expire(now time.Time) {
+	for uploadId, session := range store.sessions {
+		if now.Sub(session.UpdatedAt) > uploadSessionTTL {
+			store.remove(uploadId)
+		}
+	}
+}
+
+// remove removes an upload and its file, the caller must hold the lock
+func (store *DiskUploadStore) remove(uploadId string) error {
+	delete(store.sessions, uploadId)
+
+	err := os.Remove(store.path(uploadId))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("cannot remove upload file: %w", err)
+	}
+
+	return nil
+}
+
+// find returns an upload unless it has expired, the caller must hold the lock
+func (store *DiskUploadStore) find(uploadId string) *UploadSession {
+	session := store.sessions[uploadId]
+	if session == nil || time.Since(session.UpdatedAt) > uploadSessionTTL {
+		return nil
+	}
+
+	return session
+}
+
+// Find finds an upload, returns nil if it does not exist or has expired
+func (store *DiskUploadStore) Find(uploadId string) (*UploadSession, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	session := store.find(uploadId)
+	if session == nil {
+		return nil, nil
+	}
+
+	found := *session
+	return &found, nil
+}
+
+// Append appends a chunk at the offset of the upload and returns its new size
+func (store *DiskUploadStore) Append(uploadId string, offset int64, data []byte) (int64, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	session := store.find(uploadId)
+	if session == nil {
+		return 0, ErrNotFound
+	}
+
+	if offset > session.Size {
+		return session.Size, fmt.Errorf("%w: offset %d is after the %d bytes received", ErrUploadGap, offset, session.Size)
+	}
+
+	// skip the part of the chunk already received
+	if skip := session.Size - offset; skip < int64(len(data)) {
+		file, err := os.OpenFile(store.path(uploadId), os.O_WRONLY, 0)
+		if err != nil {
+			return session.Size, fmt.Errorf("cannot open upload file: %w", err)
+		}
+		defer file.Close()
+
+		// a failed write may have written part of the chunk, it is overwritten by the next one
+		n, err := file.WriteAt(data[skip:], session.Size)
+		if err != nil {
+			return session.Size, fmt.Errorf("cannot write upload file: %w", err)
+		}
+
+		err = file.Close()
+		if err != nil {
+			return session.Size, fmt.Errorf("cannot write upload file: %w", err)
+		}
+
+		session.Size += int64(n)
+	}
+	session.UpdatedAt = time.Now()
+
+	return session.Size, nil
+}
+
+// Open opens the bytes received for an upload for reading
+func (store *DiskUploadStore) Open(uploadId string) (io.ReadCloser, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	session := store.find(uploadId)
+	if session == nil {
+		return nil, ErrNotFound
+	}
+
+	file, err := os.Open(store.path(uploadId))
+	if err != nil {
+		return nil, fmt.Errorf("cannot open upload file: %w", err)
+	}
+
+	// bytes written after the upload is opened are not read
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, session.Size), file}, nil
+}
+
+// Delete deletes an upload
+func (store *DiskUploadStore) Delete(uploadId string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.remove(uploadId)
+}